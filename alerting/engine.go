@@ -0,0 +1,264 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerting
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"app-metrics-nozzle/domain"
+)
+
+// State is the lifecycle position of an alert.
+type State string
+
+const (
+	Pending  State = "pending"
+	Firing   State = "firing"
+	Resolved State = "resolved"
+)
+
+// resolvedRetention is how long a resolved alert stays visible before it is forgotten.
+const resolvedRetention = 24 * time.Hour
+
+// Alert is the state of one rule for one app.
+type Alert struct {
+	Rule        string  `json:"rule"`
+	App         string  `json:"app"`
+	State       State   `json:"state"`
+	Value       float64 `json:"value"`
+	ActiveSince int64   `json:"active_since"`
+	FiredAt     int64   `json:"fired_at,omitempty"`
+	ResolvedAt  int64   `json:"resolved_at,omitempty"`
+}
+
+// Notifier delivers a notification about an alert transition.
+type Notifier func(subject string, body string) error
+
+// Engine evaluates rules against app snapshots and tracks alert state between evaluations.
+type Engine struct {
+	rules     []Rule
+	store     Store
+	notify    Notifier
+	alerts    map[string]*Alert
+	previous  map[string]domain.App
+	firstSeen map[string]time.Time
+	lastEval  time.Time
+	mutex     sync.Mutex
+}
+
+var logger = log.New(os.Stdout, "", 0)
+
+// NewEngine creates an engine and restores any alerts persisted in the store.
+func NewEngine(rules []Rule, store Store, notify Notifier) *Engine {
+	e := &Engine{
+		rules:     rules,
+		store:     store,
+		notify:    notify,
+		alerts:    make(map[string]*Alert),
+		previous:  make(map[string]domain.App),
+		firstSeen: make(map[string]time.Time),
+	}
+
+	if store != nil {
+		alerts, err := store.Load()
+		if err != nil {
+			logger.Println("Error loading persisted alerts:", err)
+		}
+		for idx := range alerts {
+			alert := alerts[idx]
+			e.alerts[alertKey(alert.Rule, alert.App)] = &alert
+		}
+	}
+	return e
+}
+
+// Run evaluates the rules against the apps returned by snapshot every interval. It never returns.
+func (e *Engine) Run(interval time.Duration, snapshot func() map[string]domain.App) {
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		e.Evaluate(snapshot(), now)
+	}
+}
+
+// Evaluate applies every rule to every app and advances alert states. Notifications are sent after the
+// alerts are unlocked, so a slow mail server doesn't hold up Alerts.
+func (e *Engine) Evaluate(apps map[string]domain.App, now time.Time) {
+	for _, transition := range e.advance(apps, now) {
+		e.send(transition)
+	}
+}
+
+// advance moves every alert to its state at now and returns the alerts that started firing or resolved.
+func (e *Engine) advance(apps map[string]domain.App, now time.Time) []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var transitions []Alert
+	active := make(map[string]bool)
+
+	firstSeen := make(map[string]time.Time, len(apps))
+	for appKey := range apps {
+		if seenAt, known := e.firstSeen[appKey]; known {
+			firstSeen[appKey] = seenAt
+		} else {
+			firstSeen[appKey] = now
+		}
+	}
+
+	for idx := range e.rules {
+		rule := &e.rules[idx]
+		for appKey, app := range apps {
+			if !rule.selects(app, now) {
+				continue
+			}
+
+			previous, seen := e.previous[appKey]
+			value := rule.value(sample{app: app, previous: previous, seen: seen, firstSeen: firstSeen[appKey], now: now, lastEval: e.lastEval})
+			key := alertKey(rule.Name, appKey)
+			active[key] = true
+
+			if transition := e.step(rule, key, appKey, value, now); transition != nil {
+				transitions = append(transitions, *transition)
+			}
+		}
+	}
+
+	// Alerts whose app or rule disappeared resolve like any other condition that stopped holding.
+	for key, alert := range e.alerts {
+		if active[key] {
+			continue
+		}
+		if transition := e.clear(key, alert, now); transition != nil {
+			transitions = append(transitions, *transition)
+		}
+	}
+
+	e.previous = apps
+	e.firstSeen = firstSeen
+	e.lastEval = now
+	e.persist()
+
+	return transitions
+}
+
+// step advances the alert for one rule/app pair and returns the alert if it started firing or resolved.
+func (e *Engine) step(rule *Rule, key string, appKey string, value float64, now time.Time) *Alert {
+	alert, exists := e.alerts[key]
+
+	if !rule.matches(value) {
+		if !exists {
+			return nil
+		}
+		return e.clear(key, alert, now)
+	}
+
+	if !exists || alert.State == Resolved {
+		alert = &Alert{Rule: rule.Name, App: appKey, State: Pending, ActiveSince: now.UnixNano()}
+		e.alerts[key] = alert
+	}
+	alert.Value = value
+
+	if alert.State == Pending && now.Sub(time.Unix(0, alert.ActiveSince)) >= rule.For {
+		alert.State = Firing
+		alert.FiredAt = now.UnixNano()
+		fired := *alert
+		return &fired
+	}
+	return nil
+}
+
+// clear handles an alert whose condition no longer holds and returns it if it resolved.
+func (e *Engine) clear(key string, alert *Alert, now time.Time) *Alert {
+	switch alert.State {
+	case Pending:
+		delete(e.alerts, key)
+	case Firing:
+		alert.State = Resolved
+		alert.ResolvedAt = now.UnixNano()
+		resolved := *alert
+		return &resolved
+	case Resolved:
+		if now.Sub(time.Unix(0, alert.ResolvedAt)) > resolvedRetention {
+			delete(e.alerts, key)
+		}
+	}
+	return nil
+}
+
+// Alerts returns the current alerts ordered by rule and app.
+func (e *Engine) Alerts() []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	alerts := make([]Alert, 0, len(e.alerts))
+	for _, alert := range e.alerts {
+		alerts = append(alerts, *alert)
+	}
+	sort.Sort(byRuleAndApp(alerts))
+	return alerts
+}
+
+func (e *Engine) persist() {
+	if e.store == nil {
+		return
+	}
+
+	alerts := make([]Alert, 0, len(e.alerts))
+	for _, alert := range e.alerts {
+		alerts = append(alerts, *alert)
+	}
+	if err := e.store.Save(alerts); err != nil {
+		logger.Println("Error persisting alerts:", err)
+	}
+}
+
+func (e *Engine) send(alert Alert) {
+	if e.notify == nil {
+		return
+	}
+
+	subject := fmt.Sprintf("[%s] %s: %s", alert.State, alert.Rule, alert.App)
+	body := fmt.Sprintf("Alert %s for app %s is %s.\nCurrent value: %g\nActive since: %s\n",
+		alert.Rule, alert.App, alert.State, alert.Value, time.Unix(0, alert.ActiveSince).Format(time.RFC3339))
+	if alert.State == Resolved {
+		body = body + fmt.Sprintf("Resolved at: %s\n", time.Unix(0, alert.ResolvedAt).Format(time.RFC3339))
+	}
+
+	if err := e.notify(subject, body); err != nil {
+		logger.Println("Error sending alert notification:", err)
+	}
+}
+
+func alertKey(rule string, app string) string {
+	return fmt.Sprintf("%s|%s", rule, app)
+}
+
+type byRuleAndApp []Alert
+
+func (a byRuleAndApp) Len() int      { return len(a) }
+func (a byRuleAndApp) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byRuleAndApp) Less(i, j int) bool {
+	if a[i].Rule != a[j].Rule {
+		return a[i].Rule < a[j].Rule
+	}
+	return a[i].App < a[j].App
+}
@@ -0,0 +1,175 @@
+package alerting_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/alerting"
+	"app-metrics-nozzle/domain"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var _ = Describe("Engine", func() {
+	var (
+		engine        *alerting.Engine
+		notifications []string
+		onNotify      func()
+		start         time.Time
+		app           domain.App
+	)
+
+	newEngine := func(rulesJSON string) *alerting.Engine {
+		file, err := ioutil.TempFile("", "rules")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.Remove(file.Name())
+		file.WriteString(rulesJSON)
+		file.Close()
+
+		rules, err := alerting.LoadRules(file.Name())
+		Expect(err).ToNot(HaveOccurred())
+		return alerting.NewEngine(rules, nil, func(subject string, body string) error {
+			notifications = append(notifications, subject)
+			if onNotify != nil {
+				onNotify()
+			}
+			return nil
+		})
+	}
+
+	apps := func(app domain.App) map[string]domain.App {
+		return map[string]domain.App{"org/space/app": app}
+	}
+
+	BeforeEach(func() {
+		notifications = nil
+		onNotify = nil
+		start = time.Unix(1500000000, 0)
+		app = domain.App{Name: "app", State: "STARTED"}
+		app.Organization.Name = "team-a"
+		app.Space.Name = "space"
+	})
+
+	Context("When: an app goes idle", func() {
+		BeforeEach(func() {
+			engine = newEngine(`[{"name":"idle","metric":"idle_seconds","comparator":">","threshold":3600,"for":"10m","org":"^team-"}]`)
+			app.LastEventTime = start.Add(-2 * time.Hour).UnixNano()
+		})
+
+		It("then: it should move from pending to firing after the for-duration and resolve on traffic", func() {
+			engine.Evaluate(apps(app), start)
+			Expect(engine.Alerts()).To(HaveLen(1))
+			Expect(engine.Alerts()[0].State).To(Equal(alerting.Pending))
+			Expect(notifications).To(BeEmpty())
+
+			engine.Evaluate(apps(app), start.Add(10*time.Minute))
+			Expect(engine.Alerts()[0].State).To(Equal(alerting.Firing))
+			Expect(notifications).To(Equal([]string{"[firing] idle: org/space/app"}))
+
+			app.EventCount++
+			app.LastEventTime = start.Add(11 * time.Minute).UnixNano()
+			engine.Evaluate(apps(app), start.Add(11*time.Minute))
+			Expect(engine.Alerts()[0].State).To(Equal(alerting.Resolved))
+			Expect(notifications).To(HaveLen(2))
+		})
+
+		It("then: it should drop a pending alert silently when the condition clears", func() {
+			engine.Evaluate(apps(app), start)
+			app.LastEventTime = start.UnixNano()
+			engine.Evaluate(apps(app), start.Add(time.Minute))
+			Expect(engine.Alerts()).To(BeEmpty())
+			Expect(notifications).To(BeEmpty())
+		})
+
+		It("then: it should notify without holding the alerts locked", func() {
+			var seen []alerting.Alert
+			onNotify = func() { seen = engine.Alerts() }
+
+			engine.Evaluate(apps(app), start)
+			engine.Evaluate(apps(app), start.Add(10*time.Minute))
+			Expect(notifications).To(HaveLen(1))
+			Expect(seen).To(HaveLen(1))
+			Expect(seen[0].State).To(Equal(alerting.Firing))
+		})
+
+		It("then: it should ignore apps outside the org selector", func() {
+			app.Organization.Name = "system"
+			engine.Evaluate(apps(app), start)
+			Expect(engine.Alerts()).To(BeEmpty())
+		})
+	})
+
+	Context("When: an app has never received an event", func() {
+		BeforeEach(func() {
+			app.LastEventTime = 0
+		})
+
+		It("then: it should count it idle from when it was first seen, not since the epoch", func() {
+			engine = newEngine(`[{"name":"idle","metric":"idle_seconds","comparator":">","threshold":3600}]`)
+			engine.Evaluate(apps(app), start)
+			Expect(engine.Alerts()).To(BeEmpty())
+
+			engine.Evaluate(apps(app), start.Add(30*time.Minute))
+			Expect(engine.Alerts()).To(BeEmpty())
+
+			engine.Evaluate(apps(app), start.Add(61*time.Minute))
+			Expect(engine.Alerts()).To(HaveLen(1))
+			Expect(engine.Alerts()[0].Value).To(BeNumerically("~", 3660))
+		})
+
+		It("then: it should not report its first event as waking up", func() {
+			engine = newEngine(`[{"name":"woke-up","metric":"woke_after_idle_seconds","comparator":">","threshold":604800}]`)
+			engine.Evaluate(apps(app), start)
+
+			app.EventCount = 1
+			app.LastEventTime = start.Add(time.Minute).UnixNano()
+			engine.Evaluate(apps(app), start.Add(2*time.Minute))
+			Expect(engine.Alerts()).To(BeEmpty())
+			Expect(notifications).To(BeEmpty())
+		})
+	})
+
+	Context("When: the 5xx ratio spikes", func() {
+		It("then: it should compare errors to events received since the previous evaluation", func() {
+			engine = newEngine(`[{"name":"errors","metric":"server_error_ratio","comparator":">=","threshold":0.5}]`)
+			app.EventCount = 100
+			app.ServerErrorCount = 1
+			engine.Evaluate(apps(app), start)
+			Expect(engine.Alerts()).To(BeEmpty())
+
+			app.EventCount = 110
+			app.ServerErrorCount = 8
+			engine.Evaluate(apps(app), start.Add(time.Minute))
+			Expect(engine.Alerts()).To(HaveLen(1))
+			Expect(engine.Alerts()[0].State).To(Equal(alerting.Firing))
+			Expect(engine.Alerts()[0].Value).To(BeNumerically("~", 0.7))
+		})
+	})
+
+	Context("When: a rule has a filter expression", func() {
+		It("then: it should only evaluate the apps the filter selects", func() {
+			engine = newEngine(`[{"name":"busy","metric":"event_count","comparator":">","threshold":10,"filter":"space == \"prod\" and requests_per_second > 1"}]`)
+			app.EventCount = 100
+			app.RequestsPerSecond = 2
+			engine.Evaluate(apps(app), start)
+			Expect(engine.Alerts()).To(BeEmpty())
+
+			app.Space.Name = "prod"
+			engine.Evaluate(apps(app), start.Add(time.Minute))
+			Expect(engine.Alerts()).To(HaveLen(1))
+		})
+	})
+
+	Context("When: a rule is invalid", func() {
+		It("then: it should fail to load", func() {
+			file, _ := ioutil.TempFile("", "rules")
+			defer os.Remove(file.Name())
+			file.WriteString(`[{"name":"bad","metric":"nope","comparator":">"}]`)
+			file.Close()
+
+			_, err := alerting.LoadRules(file.Name())
+			Expect(err).To(MatchError(ContainSubstring(`unknown metric "nope"`)))
+		})
+	})
+})
@@ -0,0 +1,209 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerting
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"app-metrics-nozzle/domain"
+	"app-metrics-nozzle/filter"
+)
+
+// Metrics a rule can be evaluated against.
+const (
+	MetricEventCount        = "event_count"
+	MetricRequestsPerSecond = "requests_per_second"
+	MetricIdleSeconds       = "idle_seconds"
+	MetricWindowEvents      = "window_events"
+	MetricServerErrorRatio  = "server_error_ratio"
+	MetricWokeAfterIdle     = "woke_after_idle_seconds"
+)
+
+// Rule describes a condition on an app's usage that should raise an alert.
+type Rule struct {
+	Name       string        `json:"name"`
+	Metric     string        `json:"metric"`
+	Comparator string        `json:"comparator"`
+	Threshold  float64       `json:"threshold"`
+	For        time.Duration `json:"-"`
+	ForText    string        `json:"for"`
+	Org        string        `json:"org"`
+	Space      string        `json:"space"`
+	State      string        `json:"state"`
+	Filter     string        `json:"filter"`
+
+	orgPattern   *regexp.Regexp
+	spacePattern *regexp.Regexp
+	appFilter    *filter.Filter
+}
+
+// sample is the view of an app a rule is evaluated against, including the change since the previous evaluation.
+type sample struct {
+	app       domain.App
+	previous  domain.App
+	seen      bool
+	firstSeen time.Time
+	now       time.Time
+	lastEval  time.Time
+}
+
+// LoadRules reads a JSON array of rules from a file and validates them.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing alert rules %s: %v", path, err)
+	}
+
+	for idx := range rules {
+		if err := rules[idx].compile(); err != nil {
+			return nil, fmt.Errorf("alert rule %d (%s): %v", idx, rules[idx].Name, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	switch r.Metric {
+	case MetricEventCount, MetricRequestsPerSecond, MetricIdleSeconds, MetricWindowEvents, MetricServerErrorRatio, MetricWokeAfterIdle:
+	default:
+		return fmt.Errorf("unknown metric %q", r.Metric)
+	}
+
+	switch r.Comparator {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return fmt.Errorf("unknown comparator %q", r.Comparator)
+	}
+
+	if r.ForText != "" {
+		duration, err := time.ParseDuration(r.ForText)
+		if err != nil {
+			return fmt.Errorf("invalid for duration %q: %v", r.ForText, err)
+		}
+		r.For = duration
+	}
+
+	var err error
+	if r.Org != "" {
+		if r.orgPattern, err = regexp.Compile(r.Org); err != nil {
+			return fmt.Errorf("invalid org selector: %v", err)
+		}
+	}
+	if r.Space != "" {
+		if r.spacePattern, err = regexp.Compile(r.Space); err != nil {
+			return fmt.Errorf("invalid space selector: %v", err)
+		}
+	}
+	if r.Filter != "" {
+		if r.appFilter, err = filter.Parse(r.Filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// selects reports whether the rule applies to an app.
+func (r *Rule) selects(app domain.App, now time.Time) bool {
+	if app.Name == "" {
+		return false
+	}
+	if r.orgPattern != nil && !r.orgPattern.MatchString(app.Organization.Name) {
+		return false
+	}
+	if r.spacePattern != nil && !r.spacePattern.MatchString(app.Space.Name) {
+		return false
+	}
+	if r.State != "" && r.State != app.State {
+		return false
+	}
+	return r.appFilter.Match(app, now)
+}
+
+// value computes the rule's metric for a sample.
+func (r *Rule) value(s sample) float64 {
+	windowEvents := s.app.EventCount - s.previous.EventCount
+	windowErrors := s.app.ServerErrorCount - s.previous.ServerErrorCount
+	if !s.seen || windowEvents < 0 {
+		// First sighting or the counters were reset: treat the totals as the window.
+		windowEvents = s.app.EventCount
+		windowErrors = s.app.ServerErrorCount
+	}
+
+	switch r.Metric {
+	case MetricEventCount:
+		return float64(s.app.EventCount)
+	case MetricRequestsPerSecond:
+		return s.app.RequestsPerSecond
+	case MetricIdleSeconds:
+		if s.app.LastEventTime == 0 {
+			// No events yet: the app has been idle for as long as we have known it
+			return s.now.Sub(s.firstSeen).Seconds()
+		}
+		return idleSeconds(s.app.LastEventTime, s.now)
+	case MetricWindowEvents:
+		return float64(windowEvents)
+	case MetricServerErrorRatio:
+		if windowEvents == 0 {
+			return 0
+		}
+		return float64(windowErrors) / float64(windowEvents)
+	case MetricWokeAfterIdle:
+		if !s.seen || windowEvents == 0 || s.previous.LastEventTime == 0 {
+			// An app's first events end no idle period we could measure
+			return 0
+		}
+		return idleSeconds(s.previous.LastEventTime, s.lastEval)
+	}
+	return 0
+}
+
+// matches applies the rule's comparator to a value.
+func (r *Rule) matches(value float64) bool {
+	switch r.Comparator {
+	case ">":
+		return value > r.Threshold
+	case ">=":
+		return value >= r.Threshold
+	case "<":
+		return value < r.Threshold
+	case "<=":
+		return value <= r.Threshold
+	case "==":
+		return value == r.Threshold
+	case "!=":
+		return value != r.Threshold
+	}
+	return false
+}
+
+// idleSeconds returns the seconds between the last event and now. lastEventTime must not be zero.
+func idleSeconds(lastEventTime int64, now time.Time) float64 {
+	return float64(now.UnixNano()-lastEventTime) / float64(time.Second)
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package alerting
+
+import (
+	"encoding/json"
+
+	"github.com/boltdb/bolt"
+)
+
+// Store persists alert state across restarts.
+type Store interface {
+	Load() ([]Alert, error)
+	Save(alerts []Alert) error
+}
+
+var alertsBucket = []byte("Alerts")
+
+// BoltStore keeps alerts in a bucket of the nozzle's bolt database.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore creates the alerts bucket if needed and returns a store backed by it.
+func NewBoltStore(db *bolt.DB) (*BoltStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(alertsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Load() ([]Alert, error) {
+	var alerts []Alert
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(alertsBucket).ForEach(func(k, v []byte) error {
+			var alert Alert
+			if err := json.Unmarshal(v, &alert); err != nil {
+				return err
+			}
+			alerts = append(alerts, alert)
+			return nil
+		})
+	})
+	return alerts, err
+}
+
+// Save replaces the persisted alerts with the given set.
+func (s *BoltStore) Save(alerts []Alert) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(alertsBucket); err != nil {
+			return err
+		}
+		bucket, err := tx.CreateBucket(alertsBucket)
+		if err != nil {
+			return err
+		}
+		for _, alert := range alerts {
+			data, err := json.Marshal(alert)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(alertKey(alert.Rule, alert.App)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
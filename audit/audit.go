@@ -0,0 +1,110 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// Event records one API call or report send.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Identity  string    `json:"identity"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Path      string    `json:"path"`
+	Org       string    `json:"org,omitempty"`
+	Space     string    `json:"space,omitempty"`
+	Status    int       `json:"status"`
+	LatencyMs float64   `json:"latency_ms"`
+	ClientIP  string    `json:"client_ip"`
+}
+
+// Sink stores audit events.
+type Sink interface {
+	Write(event Event) error
+}
+
+// Querier returns the stored events with from <= Time < to, oldest first, at most limit of them.
+type Querier interface {
+	Query(from time.Time, to time.Time, limit int) ([]Event, error)
+}
+
+// Log fans events out to its sinks and answers queries from the first sink that supports them.
+type Log struct {
+	sinks []Sink
+}
+
+var logger = log.New(os.Stdout, "", 0)
+
+func NewLog(sinks ...Sink) *Log {
+	return &Log{sinks: sinks}
+}
+
+// Record writes the event to every sink. Failures are logged rather than returned so auditing never breaks a request.
+func (l *Log) Record(event Event) {
+	if l == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	for _, sink := range l.sinks {
+		if err := sink.Write(event); err != nil {
+			logger.Println("Error writing audit event:", err)
+		}
+	}
+}
+
+// Query reads events back. It returns nil without error if no sink can be queried.
+func (l *Log) Query(from time.Time, to time.Time, limit int) ([]Event, error) {
+	if l == nil {
+		return nil, nil
+	}
+	for _, sink := range l.sinks {
+		if querier, ok := sink.(Querier); ok {
+			return querier.Query(from, to, limit)
+		}
+	}
+	return nil, nil
+}
+
+// Queryable reports whether any sink supports queries.
+func (l *Log) Queryable() bool {
+	if l == nil {
+		return false
+	}
+	for _, sink := range l.sinks {
+		if _, ok := sink.(Querier); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type byTime []Event
+
+func (e byTime) Len() int           { return len(e) }
+func (e byTime) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byTime) Less(i, j int) bool { return e[i].Time.Before(e[j].Time) }
+
+func sortByTime(events []Event) {
+	sort.Stable(byTime(events))
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var auditBucket = []byte("Audit")
+
+// BoltSink stores events in a bucket of the nozzle's bolt database keyed by time,
+// dropping events older than Retention as new ones arrive.
+type BoltSink struct {
+	Retention time.Duration
+
+	db         *bolt.DB
+	lastPruned time.Time
+}
+
+func NewBoltSink(db *bolt.DB, retention time.Duration) (*BoltSink, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(auditBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltSink{db: db, Retention: retention}, nil
+}
+
+func (s *BoltSink) Write(event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(eventKey(event.Time, seq), data); err != nil {
+			return err
+		}
+
+		if s.Retention > 0 && event.Time.Sub(s.lastPruned) > time.Minute {
+			s.lastPruned = event.Time
+			return prune(bucket, event.Time.Add(-s.Retention))
+		}
+		return nil
+	})
+}
+
+func (s *BoltSink) Query(from time.Time, to time.Time, limit int) ([]Event, error) {
+	var events []Event
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(auditBucket).Cursor()
+		end := eventKey(to, 0)
+		for k, v := cursor.Seek(eventKey(from, 0)); k != nil && bytes.Compare(k, end) < 0; k, v = cursor.Next() {
+			var event Event
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, err
+}
+
+func prune(bucket *bolt.Bucket, before time.Time) error {
+	var expired [][]byte
+	cursor := bucket.Cursor()
+	end := eventKey(before, 0)
+	for k, _ := cursor.First(); k != nil && bytes.Compare(k, end) < 0; k, _ = cursor.Next() {
+		expired = append(expired, append([]byte(nil), k...))
+	}
+	for _, k := range expired {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventKey sorts by time, with the bucket sequence breaking ties between events in the same nanosecond.
+func eventKey(t time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileSink appends events as JSON lines and rotates the file once it reaches MaxBytes,
+// keeping MaxBackups old files named path.1 (newest) to path.N (oldest).
+type FileSink struct {
+	Path       string
+	MaxBytes   int64
+	MaxBackups int
+
+	file  *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+func NewFileSink(path string, maxBytes int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{Path: path, MaxBytes: maxBytes, MaxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *FileSink) Write(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.MaxBytes > 0 && s.size+int64(len(line)) > s.MaxBytes && s.size > 0 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(s.backup(s.MaxBackups))
+	for i := s.MaxBackups - 1; i >= 1; i-- {
+		os.Rename(s.backup(i), s.backup(i+1))
+	}
+	if s.MaxBackups > 0 {
+		if err := os.Rename(s.Path, s.backup(1)); err != nil {
+			return err
+		}
+	} else {
+		os.Remove(s.Path)
+	}
+	return s.open()
+}
+
+func (s *FileSink) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.Path, i)
+}
+
+// Query scans the backups, oldest first, and then the current file.
+func (s *FileSink) Query(from time.Time, to time.Time, limit int) ([]Event, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var events []Event
+	files := []string{}
+	for i := s.MaxBackups; i >= 1; i-- {
+		files = append(files, s.backup(i))
+	}
+	files = append(files, s.Path)
+
+	for _, path := range files {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event Event
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				continue
+			}
+			if event.Time.Before(from) || !event.Time.Before(to) {
+				continue
+			}
+			events = append(events, event)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	sortByTime(events)
+	if limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events, nil
+}
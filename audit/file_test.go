@@ -0,0 +1,76 @@
+package audit_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"app-metrics-nozzle/audit"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("FileSink", func() {
+	var (
+		dir  string
+		path string
+		base time.Time
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "audit")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "audit.log")
+		base = time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	event := func(minute int) audit.Event {
+		return audit.Event{Time: base.Add(time.Duration(minute) * time.Minute), Identity: "ops", Method: "GET", Route: "/api/apps", Path: "/api/apps", Status: 200}
+	}
+
+	It("returns events within the range, most recent first when limited", func() {
+		sink, err := audit.NewFileSink(path, 0, 0)
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 5; i++ {
+			Expect(sink.Write(event(i))).To(Succeed())
+		}
+
+		events, err := sink.Query(base.Add(time.Minute), base.Add(4*time.Minute), 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events).To(HaveLen(2))
+		Expect(events[0].Time).To(Equal(base.Add(2 * time.Minute)))
+		Expect(events[1].Time).To(Equal(base.Add(3 * time.Minute)))
+	})
+
+	It("rotates the file and drops backups beyond the limit", func() {
+		sink, err := audit.NewFileSink(path, 1, 2)
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 4; i++ {
+			Expect(sink.Write(event(i))).To(Succeed())
+		}
+
+		Expect(path + ".1").To(BeAnExistingFile())
+		Expect(path + ".2").To(BeAnExistingFile())
+		Expect(path + ".3").NotTo(BeAnExistingFile())
+
+		events, err := sink.Query(base, base.Add(time.Hour), 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(events).To(HaveLen(3))
+		Expect(events[0].Time).To(Equal(base.Add(time.Minute)))
+	})
+})
+
+var _ = Describe("Log", func() {
+	It("ignores records when auditing is disabled", func() {
+		var log *audit.Log
+		log.Record(audit.Event{})
+		Expect(log.Queryable()).To(BeFalse())
+	})
+})
@@ -0,0 +1,353 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cluster shares per-app counts between nozzle instances. Doppler splits the firehose between all
+// connections of a subscription, so each instance only counts its share; instances push the counts that
+// changed to their peers, and each adds the peers' counts to its own when answering.
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"app-metrics-nozzle/domain"
+)
+
+var logger = log.New(os.Stdout, "", 0)
+
+// SecretHeader carries the shared cluster secret on pushes between instances.
+const SecretHeader = "X-Cluster-Secret"
+
+// Counts are one instance's counters of one app.
+type Counts struct {
+	EventCount       int64                         `json:"event_count"`
+	ServerErrorCount int64                         `json:"server_error_count"`
+	LastEventTime    int64                         `json:"last_event_time"`
+	Sources          map[string]domain.SourceUsage `json:"sources,omitempty"`
+}
+
+// Add combines the counts of two instances.
+func (c Counts) Add(other Counts) Counts {
+	c.EventCount += other.EventCount
+	c.ServerErrorCount += other.ServerErrorCount
+	if other.LastEventTime > c.LastEventTime {
+		c.LastEventTime = other.LastEventTime
+	}
+	c.Sources = domain.AddSources(c.Sources, other.Sources)
+	return c
+}
+
+// Equal tells whether two counts are the same.
+func (c Counts) Equal(other Counts) bool {
+	if c.EventCount != other.EventCount || c.ServerErrorCount != other.ServerErrorCount || c.LastEventTime != other.LastEventTime || len(c.Sources) != len(other.Sources) {
+		return false
+	}
+	for source, usage := range c.Sources {
+		if otherUsage, ok := other.Sources[source]; !ok || otherUsage != usage {
+			return false
+		}
+	}
+	return true
+}
+
+// State is what an instance pushes: its counts by app GUID. Apps maps only the apps that changed since the
+// previous push to the same peer unless Full is set.
+type State struct {
+	Instance string `json:"instance"`
+	// Epoch identifies the instance's run. Counts restart from zero with a new epoch.
+	Epoch int64             `json:"epoch"`
+	Full  bool              `json:"full"`
+	Apps  map[string]Counts `json:"apps"`
+}
+
+// Ack answers a push with the receiver's identity, so the sender notices restarts that lost its state.
+type Ack struct {
+	Instance string `json:"instance"`
+	Epoch    int64  `json:"epoch"`
+}
+
+// PeerStatus describes the last push to a peer.
+type PeerStatus struct {
+	URL         string    `json:"url"`
+	Instance    string    `json:"instance,omitempty"`
+	LastSuccess time.Time `json:"last_success,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// remoteState is what is known of another instance.
+type remoteState struct {
+	epoch    int64
+	apps     map[string]Counts
+	received time.Time
+}
+
+// peer is another instance this one pushes to.
+type peer struct {
+	status PeerStatus
+	epoch  int64
+	// acked holds the counts the peer has confirmed; apps whose local counts differ are pushed
+	acked map[string]Counts
+}
+
+// Node is this instance's view of the cluster.
+type Node struct {
+	ID     string
+	Epoch  int64
+	Secret string
+	Client *http.Client
+	// Local returns this instance's own counts by app GUID.
+	Local func() map[string]Counts
+	// Expiry drops the counts of instances not heard from for this long, such as after scaling down.
+	Expiry time.Duration
+	// Heartbeat is the longest time between pushes to a peer, even when no counts changed.
+	Heartbeat time.Duration
+
+	peers   []*peer
+	remotes map[string]*remoteState
+	mutex   sync.Mutex
+}
+
+// NewNode creates a node pushing to the peers' base URLs.
+func NewNode(id string, peerURLs []string, secret string, local func() map[string]Counts) *Node {
+	node := &Node{
+		ID:        id,
+		Epoch:     time.Now().UnixNano(),
+		Secret:    secret,
+		Client:    &http.Client{Timeout: 10 * time.Second},
+		Local:     local,
+		Expiry:    10 * time.Minute,
+		Heartbeat: 5 * time.Minute,
+		remotes:   make(map[string]*remoteState),
+	}
+	for _, url := range peerURLs {
+		node.peers = append(node.peers, &peer{status: PeerStatus{URL: strings.TrimRight(url, "/")}})
+	}
+	return node
+}
+
+// Receive merges a push from another instance.
+func (n *Node) Receive(state State, now time.Time) Ack {
+	if n == nil {
+		return Ack{}
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if state.Instance != n.ID {
+		remote := n.remotes[state.Instance]
+		switch {
+		case remote == nil || state.Epoch > remote.epoch:
+			// New or restarted instance: what it counted before is gone, so forget it rather than add to it
+			remote = &remoteState{epoch: state.Epoch, apps: make(map[string]Counts)}
+			n.remotes[state.Instance] = remote
+		case state.Epoch < remote.epoch:
+			// A delayed push from before a restart
+			return Ack{Instance: n.ID, Epoch: n.Epoch}
+		}
+		if state.Full {
+			remote.apps = make(map[string]Counts, len(state.Apps))
+		}
+		for guid, counts := range state.Apps {
+			remote.apps[guid] = counts
+		}
+		remote.received = now
+	}
+	return Ack{Instance: n.ID, Epoch: n.Epoch}
+}
+
+// Totals returns the counts of all other instances by app GUID, added up.
+func (n *Node) Totals() map[string]Counts {
+	if n == nil {
+		return nil
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	totals := make(map[string]Counts)
+	for _, remote := range n.remotes {
+		for guid, counts := range remote.apps {
+			totals[guid] = totals[guid].Add(counts)
+		}
+	}
+	return totals
+}
+
+// TotalFor returns the counts of all other instances for one app.
+func (n *Node) TotalFor(guid string) (Counts, bool) {
+	if n == nil {
+		return Counts{}, false
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	var total Counts
+	var found bool
+	for _, remote := range n.remotes {
+		if counts, ok := remote.apps[guid]; ok {
+			total = total.Add(counts)
+			found = true
+		}
+	}
+	return total, found
+}
+
+// Instances returns the IDs of the other instances counts are known of.
+func (n *Node) Instances() []string {
+	if n == nil {
+		return nil
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	instances := make([]string, 0, len(n.remotes))
+	for id := range n.remotes {
+		instances = append(instances, id)
+	}
+	return instances
+}
+
+// Peers returns the status of the pushes to each peer.
+func (n *Node) Peers() []PeerStatus {
+	if n == nil {
+		return nil
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	statuses := make([]PeerStatus, 0, len(n.peers))
+	for _, peer := range n.peers {
+		statuses = append(statuses, peer.status)
+	}
+	return statuses
+}
+
+// Run pushes to every peer each interval and forgets instances that went quiet.
+func (n *Node) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		n.Push(now)
+	}
+}
+
+// Push sends each peer the counts that changed since it last acknowledged them.
+func (n *Node) Push(now time.Time) {
+	local := n.Local()
+	for _, peer := range n.peers {
+		n.push(peer, local, now)
+	}
+
+	n.mutex.Lock()
+	for id, remote := range n.remotes {
+		if now.Sub(remote.received) > n.Expiry {
+			logger.Println(fmt.Sprintf("Forgetting cluster instance %s, not heard from since %s", id, remote.received.Format(time.RFC3339)))
+			delete(n.remotes, id)
+		}
+	}
+	n.mutex.Unlock()
+}
+
+func (n *Node) push(peer *peer, local map[string]Counts, now time.Time) {
+	state := State{Instance: n.ID, Epoch: n.Epoch, Full: peer.acked == nil, Apps: make(map[string]Counts)}
+	for guid, counts := range local {
+		if acked, ok := peer.acked[guid]; !ok || !acked.Equal(counts) {
+			state.Apps[guid] = counts
+		}
+	}
+	if len(state.Apps) == 0 && !state.Full && now.Sub(peer.status.LastSuccess) < n.Heartbeat {
+		// Nothing new, but the peer still hears from us often enough not to forget us
+		return
+	}
+
+	ack, err := n.send(peer.status.URL, state)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if err != nil {
+		peer.status.LastError = err.Error()
+		return
+	}
+	peer.status.LastError = ""
+	peer.status.LastSuccess = now
+	peer.status.Instance = ack.Instance
+
+	if peer.acked == nil || ack.Epoch != peer.epoch {
+		if peer.acked != nil {
+			// The peer restarted after we pushed; it only has this delta, so send everything next time
+			peer.acked = nil
+			peer.epoch = ack.Epoch
+			return
+		}
+		peer.acked = make(map[string]Counts, len(local))
+		peer.epoch = ack.Epoch
+	}
+	for guid, counts := range state.Apps {
+		peer.acked[guid] = counts
+	}
+}
+
+func (n *Node) send(url string, state State) (Ack, error) {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return Ack{}, err
+	}
+
+	req, err := http.NewRequest("POST", url+"/api/cluster", bytes.NewReader(body))
+	if err != nil {
+		return Ack{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SecretHeader, n.Secret)
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return Ack{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Ack{}, fmt.Errorf("peer answered %s", resp.Status)
+	}
+	var ack Ack
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil {
+		return Ack{}, fmt.Errorf("peer answered with invalid JSON: %s", err)
+	}
+	return ack, nil
+}
+
+// PeersFromTemplate lists the peer URLs of a Cloud Foundry app with the given number of instances by
+// replacing {index} in template, leaving out this instance's own index.
+func PeersFromTemplate(template string, instances int, ownIndex int) []string {
+	var peers []string
+	for index := 0; index < instances; index++ {
+		if index != ownIndex {
+			peers = append(peers, strings.Replace(template, "{index}", strconv.Itoa(index), -1))
+		}
+	}
+	return peers
+}
@@ -0,0 +1,157 @@
+package cluster_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"app-metrics-nozzle/cluster"
+	"app-metrics-nozzle/domain"
+)
+
+var _ = Describe("Node", func() {
+	var (
+		local    map[string]cluster.Counts
+		receiver *cluster.Node
+		pushes   []cluster.State
+		mutex    sync.Mutex
+		server   *httptest.Server
+		node     *cluster.Node
+		now      time.Time
+	)
+
+	BeforeEach(func() {
+		local = map[string]cluster.Counts{"guid-1": {EventCount: 3, LastEventTime: 10}}
+		receiver = cluster.NewNode("b", nil, "secret", nil)
+		pushes = nil
+		now = time.Now()
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			Expect(req.URL.Path).To(Equal("/api/cluster"))
+			if req.Header.Get(cluster.SecretHeader) != "secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			var state cluster.State
+			Expect(json.NewDecoder(req.Body).Decode(&state)).To(Succeed())
+
+			mutex.Lock()
+			pushes = append(pushes, state)
+			target := receiver
+			mutex.Unlock()
+			json.NewEncoder(w).Encode(target.Receive(state, time.Now()))
+		}))
+		node = cluster.NewNode("a", []string{server.URL + "/"}, "secret", func() map[string]cluster.Counts {
+			counts := make(map[string]cluster.Counts, len(local))
+			for guid, c := range local {
+				counts[guid] = c
+			}
+			return counts
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("pushes everything first and only changed apps afterwards", func() {
+		node.Push(now)
+		local["guid-2"] = cluster.Counts{EventCount: 1, ServerErrorCount: 1, LastEventTime: 20}
+		node.Push(now.Add(time.Second))
+		node.Push(now.Add(2 * time.Second))
+
+		Expect(pushes).To(HaveLen(2))
+		Expect(pushes[0].Full).To(BeTrue())
+		Expect(pushes[0].Apps).To(HaveKey("guid-1"))
+		Expect(pushes[1].Full).To(BeFalse())
+		Expect(pushes[1].Apps).To(Equal(map[string]cluster.Counts{"guid-2": local["guid-2"]}))
+
+		Expect(receiver.Totals()).To(Equal(local))
+		Expect(receiver.Instances()).To(ConsistOf("a"))
+		Expect(node.Peers()[0].Instance).To(Equal("b"))
+	})
+
+	It("adds up the counts of several instances", func() {
+		receiver.Receive(cluster.State{Instance: "c", Epoch: 1, Full: true, Apps: map[string]cluster.Counts{"guid-1": {EventCount: 2, LastEventTime: 30}}}, now)
+		node.Push(now)
+
+		total, ok := receiver.TotalFor("guid-1")
+		Expect(ok).To(BeTrue())
+		Expect(total).To(Equal(cluster.Counts{EventCount: 5, LastEventTime: 30}))
+		_, ok = receiver.TotalFor("guid-unknown")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("adds up the breakdown by source and pushes apps whose breakdown changed", func() {
+		local["guid-1"] = cluster.Counts{EventCount: 3, LastEventTime: 10, Sources: map[string]domain.SourceUsage{"RTR": {EventCount: 3, LastEventTime: 10}}}
+		receiver.Receive(cluster.State{Instance: "c", Epoch: 1, Full: true, Apps: map[string]cluster.Counts{"guid-1": {Sources: map[string]domain.SourceUsage{"TASK": {EventCount: 1, LastEventTime: 40}}}}}, now)
+		node.Push(now)
+		local["guid-1"] = cluster.Counts{EventCount: 3, LastEventTime: 10, Sources: map[string]domain.SourceUsage{"RTR": {EventCount: 3, LastEventTime: 10}, "APP/PROC": {EventCount: 2, LastEventTime: 50}}}
+		node.Push(now.Add(time.Second))
+
+		Expect(pushes).To(HaveLen(2))
+		total, _ := receiver.TotalFor("guid-1")
+		Expect(total.EventCount).To(Equal(int64(3)))
+		Expect(total.Sources).To(Equal(map[string]domain.SourceUsage{
+			"RTR":      {EventCount: 3, LastEventTime: 10},
+			"APP/PROC": {EventCount: 2, LastEventTime: 50},
+			"TASK":     {EventCount: 1, LastEventTime: 40},
+		}))
+	})
+
+	It("replaces the counts of a restarted instance instead of adding to them", func() {
+		receiver.Receive(cluster.State{Instance: "c", Epoch: 1, Full: true, Apps: map[string]cluster.Counts{"guid-1": {EventCount: 100}}}, now)
+		receiver.Receive(cluster.State{Instance: "c", Epoch: 2, Apps: map[string]cluster.Counts{"guid-1": {EventCount: 1}}}, now)
+		receiver.Receive(cluster.State{Instance: "c", Epoch: 1, Apps: map[string]cluster.Counts{"guid-1": {EventCount: 200}}}, now)
+
+		Expect(receiver.Totals()["guid-1"].EventCount).To(Equal(int64(1)))
+	})
+
+	It("pushes everything again when the peer restarted", func() {
+		node.Push(now)
+
+		mutex.Lock()
+		receiver = cluster.NewNode("b", nil, "secret", nil)
+		receiver.Epoch++
+		mutex.Unlock()
+		local["guid-2"] = cluster.Counts{EventCount: 1}
+		node.Push(now.Add(time.Second))
+		node.Push(now.Add(2 * time.Second))
+
+		Expect(pushes).To(HaveLen(3))
+		Expect(pushes[2].Full).To(BeTrue())
+		Expect(receiver.Totals()).To(Equal(local))
+	})
+
+	It("forgets instances that went quiet", func() {
+		receiver.Receive(cluster.State{Instance: "c", Epoch: 1, Full: true, Apps: map[string]cluster.Counts{"guid-1": {EventCount: 2}}}, now)
+		receiver.Local = func() map[string]cluster.Counts { return nil }
+
+		receiver.Push(now.Add(receiver.Expiry + time.Second))
+
+		Expect(receiver.Instances()).To(BeEmpty())
+		Expect(receiver.Totals()).To(BeEmpty())
+	})
+
+	It("records failed pushes", func() {
+		node.Secret = "wrong"
+		node.Push(now)
+
+		Expect(node.Peers()[0].LastError).To(ContainSubstring("403"))
+		Expect(receiver.Instances()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("PeersFromTemplate", func() {
+	It("expands the template for every other instance", func() {
+		Expect(cluster.PeersFromTemplate("http://{index}.nozzle.apps.internal:8080", 3, 1)).To(Equal([]string{
+			"http://0.nozzle.apps.internal:8080",
+			"http://2.nozzle.apps.internal:8080",
+		}))
+	})
+})
@@ -0,0 +1,195 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Lease grants leadership to one instance at a time.
+type Lease interface {
+	// Acquire takes or renews the lease for holder until now+ttl unless another instance holds it, and
+	// returns the holder. An empty holder means nobody leads yet.
+	Acquire(holder string, ttl time.Duration, now time.Time) (string, error)
+}
+
+// LeaderStatus describes who leads the cluster, as seen by this instance.
+type LeaderStatus struct {
+	Instance  string    `json:"instance"`
+	Leader    string    `json:"leader"`
+	IsLeader  bool      `json:"is_leader"`
+	Since     time.Time `json:"since,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Elector keeps track of whether this instance leads, renewing its lease every third of TTL. Another
+// instance takes over once a leader failed to renew for TTL.
+type Elector struct {
+	ID    string
+	Lease Lease
+	TTL   time.Duration
+
+	status  LeaderStatus
+	renewed time.Time
+	mutex   sync.Mutex
+}
+
+// NewElector creates an elector for the instance id.
+func NewElector(id string, lease Lease, ttl time.Duration) *Elector {
+	return &Elector{ID: id, Lease: lease, TTL: ttl, status: LeaderStatus{Instance: id}}
+}
+
+// Run tries to lead right away and then every third of TTL. It never returns.
+func (e *Elector) Run() {
+	e.Elect(time.Now())
+	for now := range time.Tick(e.TTL / 3) {
+		e.Elect(now)
+	}
+}
+
+// Elect takes or renews the lease.
+func (e *Elector) Elect(now time.Time) {
+	holder, err := e.Lease.Acquire(e.ID, e.TTL, now)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if err != nil {
+		e.status.LastError = err.Error()
+		if e.status.IsLeader && now.Sub(e.renewed) >= e.TTL {
+			// Our lease ran out, so another instance may lead by now
+			e.change("", now)
+		}
+		return
+	}
+	e.status.LastError = ""
+	if holder == e.ID {
+		e.renewed = now
+	}
+	if holder != e.status.Leader {
+		e.change(holder, now)
+	}
+}
+
+func (e *Elector) change(holder string, now time.Time) {
+	wasLeader := e.status.IsLeader
+	e.status.Leader = holder
+	e.status.IsLeader = holder == e.ID
+	e.status.Since = now
+
+	switch {
+	case e.status.IsLeader:
+		logger.Println(fmt.Sprintf("Instance %s is now the cluster leader", e.ID))
+	case wasLeader:
+		logger.Println(fmt.Sprintf("Instance %s is no longer the cluster leader", e.ID))
+	}
+}
+
+// IsLeader tells whether this instance runs the work only one instance should do. Without an elector the
+// instance is on its own and always leads.
+func (e *Elector) IsLeader() bool {
+	if e == nil {
+		return true
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.status.IsLeader
+}
+
+// Status returns who leads.
+func (e *Elector) Status() LeaderStatus {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.status
+}
+
+// PeerLease elects the instance with the lowest ID among the node and the instances it heard from within
+// the TTL, so it needs no shared store. The node must push at least every third of the TTL to stay in.
+type PeerLease struct {
+	Node *Node
+}
+
+// Acquire returns the elected instance. Nobody is elected during the node's first TTL, while it may not
+// have heard from its peers yet.
+func (l PeerLease) Acquire(holder string, ttl time.Duration, now time.Time) (string, error) {
+	if now.Sub(time.Unix(0, l.Node.Epoch)) < ttl {
+		return "", nil
+	}
+
+	l.Node.mutex.Lock()
+	defer l.Node.mutex.Unlock()
+
+	leader := l.Node.ID
+	for id, remote := range l.Node.remotes {
+		if now.Sub(remote.received) < ttl && id < leader {
+			leader = id
+		}
+	}
+	return leader, nil
+}
+
+// FileLease keeps the lease in a file locked while it is read and written. On a volume shared by all
+// instances it elects one of them.
+type FileLease struct {
+	Path string
+}
+
+type fileLeaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// Acquire takes the lease if it is free, expired or already held by holder.
+func (l FileLease) Acquire(holder string, ttl time.Duration, now time.Time) (string, error) {
+	file, err := os.OpenFile(l.Path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return "", err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	var record fileLeaseRecord
+	if err := json.NewDecoder(file).Decode(&record); err != nil && err != io.EOF {
+		return "", fmt.Errorf("invalid lease file %s: %s", l.Path, err)
+	}
+	if record.Holder != "" && record.Holder != holder && now.Before(record.Expires) {
+		return record.Holder, nil
+	}
+
+	body, err := json.Marshal(fileLeaseRecord{Holder: holder, Expires: now.Add(ttl)})
+	if err != nil {
+		return "", err
+	}
+	if err := file.Truncate(0); err != nil {
+		return "", err
+	}
+	if _, err := file.WriteAt(body, 0); err != nil {
+		return "", err
+	}
+	return holder, file.Sync()
+}
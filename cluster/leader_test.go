@@ -0,0 +1,96 @@
+package cluster_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"app-metrics-nozzle/cluster"
+)
+
+var _ = Describe("Elector", func() {
+	var (
+		dir  string
+		now  time.Time
+		a, b *cluster.Elector
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "lease")
+		Expect(err).NotTo(HaveOccurred())
+		now = time.Now()
+
+		lease := cluster.FileLease{Path: filepath.Join(dir, "leader")}
+		a = cluster.NewElector("a", lease, 30*time.Second)
+		b = cluster.NewElector("b", lease, 30*time.Second)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("lets one instance lead at a time", func() {
+		a.Elect(now)
+		b.Elect(now)
+
+		Expect(a.IsLeader()).To(BeTrue())
+		Expect(b.IsLeader()).To(BeFalse())
+		Expect(b.Status().Leader).To(Equal("a"))
+
+		a.Elect(now.Add(20 * time.Second))
+		b.Elect(now.Add(40 * time.Second))
+		Expect(b.IsLeader()).To(BeFalse())
+	})
+
+	It("fails over once the leader stops renewing", func() {
+		a.Elect(now)
+		b.Elect(now.Add(31 * time.Second))
+		a.Elect(now.Add(32 * time.Second))
+
+		Expect(b.IsLeader()).To(BeTrue())
+		Expect(a.IsLeader()).To(BeFalse())
+		Expect(a.Status().Leader).To(Equal("b"))
+	})
+
+	It("steps down when it cannot renew its lease", func() {
+		a.Elect(now)
+		a.Lease = cluster.FileLease{Path: filepath.Join(dir, "missing", "leader")}
+
+		a.Elect(now.Add(10 * time.Second))
+		Expect(a.IsLeader()).To(BeTrue())
+		Expect(a.Status().LastError).NotTo(BeEmpty())
+
+		a.Elect(now.Add(30 * time.Second))
+		Expect(a.IsLeader()).To(BeFalse())
+	})
+
+	It("always leads without an elector", func() {
+		var none *cluster.Elector
+		Expect(none.IsLeader()).To(BeTrue())
+	})
+})
+
+var _ = Describe("PeerLease", func() {
+	It("elects the lowest instance heard from recently", func() {
+		node := cluster.NewNode("b", nil, "secret", nil)
+		lease := cluster.PeerLease{Node: node}
+		start := time.Unix(0, node.Epoch)
+
+		holder, err := lease.Acquire("b", 30*time.Second, start.Add(time.Second))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(holder).To(BeEmpty())
+
+		node.Receive(cluster.State{Instance: "a", Epoch: 1}, start.Add(20*time.Second))
+		node.Receive(cluster.State{Instance: "c", Epoch: 1}, start.Add(40*time.Second))
+		holder, _ = lease.Acquire("b", 30*time.Second, start.Add(45*time.Second))
+		Expect(holder).To(Equal("a"))
+
+		holder, _ = lease.Acquire("b", 30*time.Second, start.Add(60*time.Second))
+		Expect(holder).To(Equal("b"))
+	})
+})
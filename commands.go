@@ -0,0 +1,270 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"app-metrics-nozzle/domain"
+	"app-metrics-nozzle/filter"
+	"app-metrics-nozzle/recording"
+	"app-metrics-nozzle/service"
+	"app-metrics-nozzle/state"
+	"app-metrics-nozzle/usageevents"
+	"github.com/boltdb/bolt"
+	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// saveStateEvery saves the app usage each interval for the report, export and inspect commands.
+func saveStateEvery(db *bolt.DB, interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := state.Save(db, usageevents.AllAppDetailsSnapshot(), now); err != nil {
+			logger.Println("Error saving app usage:", err)
+		}
+	}
+}
+
+// openState opens the bolt database read-only. Bolt locks the file while the nozzle serves from it.
+func openState() *bolt.DB {
+	if _, err := os.Stat(*boltDatabasePath); err != nil {
+		logger.Fatal("Error opening bolt db: ", err)
+	}
+	db, err := bolt.Open(*boltDatabasePath, 0600, &bolt.Options{Timeout: 3 * time.Second, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		logger.Fatal(fmt.Sprintf("%s is in use by a running nozzle; stop it or work on a copy of the file", *boltDatabasePath))
+	}
+	if err != nil {
+		logger.Fatal("Error opening bolt db: ", err)
+	}
+	return db
+}
+
+// loadState returns the saved app usage, exiting if there is none.
+func loadState() map[string]domain.App {
+	db := openState()
+	defer db.Close()
+
+	apps, _, err := state.Load(db)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Error loading app usage from %s: ", *boltDatabasePath), err)
+	}
+	now := time.Now()
+	for key, app := range apps {
+		apps[key] = app.AsOf(now)
+	}
+	return apps
+}
+
+// runReport prints the report of the saved app usage or emails it.
+func runReport() {
+	apps := loadState()
+
+	appFilter, err := service.ReportFilter()
+	if len(*reportFilterOverride) > 0 {
+		appFilter, err = filter.Parse(*reportFilterOverride)
+	}
+	if err != nil {
+		logger.Fatal("Error parsing report filter: ", err)
+	}
+
+	report := service.ReportFor(apps, appFilter)
+	if !*reportSend {
+		os.Stdout.Write(report)
+		return
+	}
+	if err := service.SendReport(report); err != nil {
+		logger.Fatal("Error sending report: ", err)
+	}
+	logger.Println("Report sent")
+}
+
+// writeApps writes apps to the output file, or standard output when there is none, as CSV or JSON.
+func writeApps(apps map[string]domain.App, format string, output string) {
+	var out io.Writer = os.Stdout
+	if len(output) > 0 {
+		file, err := os.Create(output)
+		if err != nil {
+			logger.Fatal("Error creating output file: ", err)
+		}
+		defer file.Close()
+		out = file
+	}
+
+	write := state.WriteCSV
+	if format == "json" {
+		write = state.WriteJSON
+	}
+	if err := write(out, apps); err != nil {
+		logger.Fatal("Error writing app usage: ", err)
+	}
+}
+
+// runExport writes the saved app usage as CSV or JSON.
+func runExport() {
+	apps := loadState()
+
+	if len(*exportFilter) > 0 {
+		appFilter, err := filter.Parse(*exportFilter)
+		if err != nil {
+			logger.Fatal("Error parsing export filter: ", err)
+		}
+		now := time.Now()
+		for key, app := range apps {
+			if !appFilter.Match(app, now) {
+				delete(apps, key)
+			}
+		}
+	}
+
+	writeApps(apps, *exportFormat, *exportOutput)
+}
+
+// runInspect describes the bolt database.
+func runInspect() {
+	db := openState()
+	defer db.Close()
+
+	info, err := state.Inspect(db)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Error inspecting %s: ", *boltDatabasePath), err)
+	}
+
+	if *inspectJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(info)
+		return
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(out, "File:\t%s\n", *boltDatabasePath)
+	if info.SchemaVersion == 0 {
+		fmt.Fprintf(out, "App usage:\tnot saved yet\n")
+	} else {
+		fmt.Fprintf(out, "Schema version:\t%d\n", info.SchemaVersion)
+		fmt.Fprintf(out, "Saved at:\t%s\n", info.SavedAt.Format(time.RFC3339))
+		fmt.Fprintf(out, "Apps:\t%d (%d deleted, %d never used)\n", info.Apps, info.DeletedApps, info.NeverUsedApps)
+		if !info.OldestEvent.IsZero() {
+			fmt.Fprintf(out, "Oldest last event:\t%s\n", info.OldestEvent.Format(time.RFC3339))
+			fmt.Fprintf(out, "Newest last event:\t%s\n", info.NewestEvent.Format(time.RFC3339))
+		}
+	}
+
+	buckets := make([]string, 0, len(info.Records))
+	for bucket := range info.Records {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	fmt.Fprintf(out, "Records:\t\n")
+	for _, bucket := range buckets {
+		fmt.Fprintf(out, "  %s\t%d\n", bucket, info.Records[bucket])
+	}
+	out.Flush()
+}
+
+// runReplay counts the app usage of a recording the way the nozzle would have, with the clock following
+// the recorded receive times rather than the wall clock, and writes it.
+func runReplay() {
+	file, err := os.Open(*replayFile)
+	if err != nil {
+		logger.Fatal("Error opening recording: ", err)
+	}
+	defer file.Close()
+	reader, err := recording.NewReader(file)
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Error reading %s: ", *replayFile), err)
+	}
+
+	usageevents.AppDbCache = newReplayAppCache()
+	usageevents.MaxClockSkew = *maxClockSkew
+	usageevents.UsageSources = parseUsageSources()
+	clock := &recording.Clock{}
+	usageevents.SetClock(clock.Now)
+	started := false
+	count, err := recording.Replay(reader, *replaySpeed, clock, func(envelope *events.Envelope) {
+		if !started {
+			// Rates are over the recorded time, so the feed starts with the first envelope
+			usageevents.StartFeed()
+			started = true
+		}
+		usageevents.ProcessEvent(envelope)
+	})
+	if err != nil {
+		logger.Fatal(fmt.Sprintf("Error replaying %s: ", *replayFile), err)
+	}
+	fmt.Fprintf(os.Stderr, "Replayed %d envelopes\n", count)
+
+	writeApps(usageevents.AllAppDetailsSnapshot(), *replayFormat, *replayOutput)
+}
+
+// replayAppCache names the apps of a replay without the Cloud Controller: from the app usage saved in
+// the bolt database when there is one, otherwise by GUID in org and space "unknown".
+type replayAppCache struct {
+	apps map[string]caching.App
+}
+
+func newReplayAppCache() *replayAppCache {
+	cache := &replayAppCache{apps: make(map[string]caching.App)}
+	if _, err := os.Stat(*boltDatabasePath); err != nil {
+		return cache
+	}
+
+	db := openState()
+	defer db.Close()
+	apps, _, err := state.Load(db)
+	if err != nil {
+		logger.Println(fmt.Sprintf("Not naming apps from %s: %s", *boltDatabasePath, err))
+		return cache
+	}
+	for _, app := range apps {
+		cache.apps[app.GUID] = caching.App{
+			Name:      app.Name,
+			Guid:      app.GUID,
+			SpaceName: app.Space.Name,
+			SpaceGuid: app.Space.ID,
+			OrgName:   app.Organization.Name,
+			OrgGuid:   app.Organization.ID,
+		}
+	}
+	return cache
+}
+
+func (c *replayAppCache) GetAppByGuid(appGuid string) []caching.App {
+	return []caching.App{c.GetAppInfo(appGuid)}
+}
+
+func (c *replayAppCache) GetAppInfo(appGuid string) caching.App {
+	if app, ok := c.apps[appGuid]; ok {
+		return app
+	}
+	return caching.App{Name: appGuid, Guid: appGuid, SpaceName: "unknown", OrgName: "unknown"}
+}
+
+func (c *replayAppCache) GetAllApp() []caching.App {
+	apps := make([]caching.App, 0, len(c.apps))
+	for _, app := range c.apps {
+		apps = append(apps, app)
+	}
+	return apps
+}
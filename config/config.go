@@ -0,0 +1,362 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config reads settings from a YAML or JSON file into the command line flags. A flag given on the
+// command line or through its environment variable wins over the file, and the file wins over the flag's
+// default, so the flags stay the one place settings are read from.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// Redacted replaces the values of secret settings in dumps.
+const Redacted = "(redacted)"
+
+// Setting ties a key of the configuration file to the flag it sets.
+type Setting struct {
+	// Key is section.name in the file, e.g. reports.time_zone.
+	Key  string
+	Flag string
+	// Separator joins the items of a list in the file into the flag's value.
+	Separator string
+	Secret    bool
+	// Reload marks settings that may change while running, i.e. when the configuration is reloaded.
+	Reload bool
+	// Check validates the value in addition to parsing it.
+	Check func(value string) error
+}
+
+// Errors lists everything wrong with a configuration.
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Dump is the effective configuration by section and name, with secrets redacted.
+type Dump struct {
+	File     string                            `json:"file,omitempty"`
+	LoadedAt time.Time                         `json:"loaded_at"`
+	Settings map[string]map[string]interface{} `json:"settings"`
+	// Sources names where each setting not at its default comes from: a flag, an environment variable or the file.
+	Sources map[string]string `json:"sources"`
+}
+
+// Store merges a configuration file into the flags of an application.
+type Store struct {
+	Path string
+
+	settings []Setting
+	flags    map[string]*kingpin.FlagModel
+	// explicit holds the flags given on the command line or by environment variable, with how they were given
+	explicit map[string]string
+	// fromFile holds the file's value of each flag set from the file
+	fromFile map[string]string
+	required map[string]bool
+	loadedAt time.Time
+	mutex    sync.Mutex
+}
+
+// NewStore creates a store for the file at path, which may be empty, and the flags app parsed from args.
+func NewStore(app *kingpin.Application, args []string, path string, settings []Setting) (*Store, error) {
+	store := &Store{
+		Path:     path,
+		settings: settings,
+		flags:    make(map[string]*kingpin.FlagModel),
+		explicit: make(map[string]string),
+		fromFile: make(map[string]string),
+		required: make(map[string]bool),
+	}
+
+	for _, setting := range settings {
+		clause := app.GetFlag(setting.Flag)
+		if clause == nil {
+			return nil, fmt.Errorf("setting %s refers to unknown flag --%s", setting.Key, setting.Flag)
+		}
+		model := clause.Model()
+		store.flags[setting.Flag] = model
+		if model.Envar != "" && os.Getenv(model.Envar) != "" {
+			store.explicit[setting.Flag] = model.Envar
+		}
+	}
+
+	context, err := app.ParseContext(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, element := range context.Elements {
+		if clause, ok := element.Clause.(*kingpin.FlagClause); ok {
+			store.explicit[clause.Model().Name] = "--" + clause.Model().Name
+		}
+	}
+	return store, nil
+}
+
+// Load sets the flags not given explicitly from the file and validates all settings, requiring a value
+// for the required keys. The error lists every problem found.
+func (s *Store) Load(required ...string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, key := range required {
+		s.required[key] = true
+	}
+
+	values, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	var errs Errors
+	for _, setting := range s.settings {
+		value, ok := values[setting.Key]
+		if !ok || s.explicit[setting.Flag] != "" {
+			continue
+		}
+		if err := s.flags[setting.Flag].Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: invalid value %q: %s", s.Path, setting.Key, value, err))
+			continue
+		}
+		s.fromFile[setting.Flag] = value
+	}
+	errs = append(errs, s.validate()...)
+	if len(errs) > 0 {
+		return errs
+	}
+	s.loadedAt = time.Now()
+	return nil
+}
+
+// Reload re-reads the file and applies the settings marked Reload that changed in it. Other settings
+// that changed are returned in restart, as they only apply after a restart. Nothing changes if the new
+// configuration is invalid.
+func (s *Store) Reload() (changed []string, restart []string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	values, err := s.read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	previous := make(map[string]string)
+	var errs Errors
+	for _, setting := range s.settings {
+		if s.explicit[setting.Flag] != "" {
+			continue
+		}
+		model := s.flags[setting.Flag]
+		value, inFile := values[setting.Key]
+		applied, wasInFile := s.fromFile[setting.Flag]
+		if inFile == wasInFile && value == applied {
+			continue
+		}
+		if !setting.Reload {
+			restart = append(restart, setting.Key)
+			continue
+		}
+		if !inFile {
+			// Removed from the file, so back to the default
+			value = strings.Join(model.Default, "\n")
+		}
+
+		previous[setting.Flag] = model.Value.String()
+		if err := model.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s: invalid value %q: %s", s.Path, setting.Key, value, err))
+			continue
+		}
+		changed = append(changed, setting.Key)
+	}
+	errs = append(errs, s.validate()...)
+
+	if len(errs) > 0 {
+		for flag, value := range previous {
+			s.flags[flag].Value.Set(value)
+		}
+		return nil, nil, errs
+	}
+
+	for _, setting := range s.settings {
+		if !setting.Reload || s.explicit[setting.Flag] != "" {
+			continue
+		}
+		if value, ok := values[setting.Key]; ok {
+			s.fromFile[setting.Flag] = value
+		} else {
+			delete(s.fromFile, setting.Flag)
+		}
+	}
+	s.loadedAt = time.Now()
+	return changed, restart, nil
+}
+
+// Dump returns the effective configuration.
+func (s *Store) Dump() Dump {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	dump := Dump{File: s.Path, LoadedAt: s.loadedAt, Settings: make(map[string]map[string]interface{}), Sources: make(map[string]string)}
+	for _, setting := range s.settings {
+		section, name := splitKey(setting.Key)
+		if dump.Settings[section] == nil {
+			dump.Settings[section] = make(map[string]interface{})
+		}
+
+		model := s.flags[setting.Flag]
+		var value interface{} = model.Value.String()
+		if getter, ok := model.Value.(kingpin.Getter); ok {
+			value = getter.Get()
+			if duration, ok := value.(time.Duration); ok {
+				value = duration.String()
+			}
+		}
+		if setting.Secret && model.Value.String() != "" {
+			value = Redacted
+		}
+		dump.Settings[section][name] = value
+
+		if source := s.source(setting); source != "default" {
+			dump.Sources[setting.Key] = source
+		}
+	}
+	return dump
+}
+
+// read parses the file into values by key, rejecting keys that are not settings.
+func (s *Store) read() (map[string]string, error) {
+	values := make(map[string]string)
+	if s.Path == "" {
+		return values, nil
+	}
+
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	var sections map[string]map[string]interface{}
+	if err := yaml.Unmarshal(data, &sections); err != nil {
+		return nil, fmt.Errorf("%s: %s", s.Path, err)
+	}
+
+	known := make(map[string]Setting, len(s.settings))
+	for _, setting := range s.settings {
+		known[setting.Key] = setting
+	}
+
+	var errs Errors
+	for section, entries := range sections {
+		for name, raw := range entries {
+			key := section + "." + name
+			setting, ok := known[key]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %s", s.Path, key))
+				continue
+			}
+			value, err := scalar(raw, setting.Separator)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %s", s.Path, key, err))
+				continue
+			}
+			values[key] = value
+		}
+	}
+	if len(errs) > 0 {
+		sort.Sort(byMessage(errs))
+		return nil, errs
+	}
+	return values, nil
+}
+
+// validate checks required and checked settings wherever their values came from.
+func (s *Store) validate() Errors {
+	var errs Errors
+	for _, setting := range s.settings {
+		value := s.flags[setting.Flag].Value.String()
+		if s.required[setting.Key] && value == "" {
+			errs = append(errs, fmt.Errorf("%s is required: set it in the configuration file, with --%s or with %s", setting.Key, setting.Flag, s.flags[setting.Flag].Envar))
+			continue
+		}
+		if setting.Check == nil || value == "" {
+			continue
+		}
+		if err := setting.Check(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s (from %s): %s", setting.Key, s.source(setting), err))
+		}
+	}
+	return errs
+}
+
+// source tells where the value of a setting comes from.
+func (s *Store) source(setting Setting) string {
+	if explicit := s.explicit[setting.Flag]; explicit != "" {
+		return explicit
+	}
+	if _, ok := s.fromFile[setting.Flag]; ok {
+		return s.Path
+	}
+	return "default"
+}
+
+// scalar turns a value of the file into a flag value. Lists are joined with separator, or commas.
+func scalar(raw interface{}, separator string) (string, error) {
+	switch value := raw.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		if separator == "" {
+			separator = ","
+		}
+		items := make([]string, 0, len(value))
+		for _, item := range value {
+			text, err := scalar(item, separator)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, text)
+		}
+		return strings.Join(items, separator), nil
+	case map[interface{}]interface{}:
+		return "", fmt.Errorf("expected a value, not a section")
+	}
+	return fmt.Sprint(raw), nil
+}
+
+func splitKey(key string) (string, string) {
+	if idx := strings.Index(key, "."); idx >= 0 {
+		return key[:idx], key[idx+1:]
+	}
+	return "", key
+}
+
+type byMessage Errors
+
+func (e byMessage) Len() int           { return len(e) }
+func (e byMessage) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byMessage) Less(i, j int) bool { return e[i].Error() < e[j].Error() }
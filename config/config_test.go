@@ -0,0 +1,213 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"app-metrics-nozzle/config"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var _ = Describe("Store", func() {
+	var (
+		dir      string
+		path     string
+		app      *kingpin.Application
+		settings []config.Setting
+
+		endpoint *string
+		workers  *int
+		interval *time.Duration
+		password *string
+		subject  *string
+		peers    *string
+	)
+
+	write := func(content string) {
+		Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(Succeed())
+	}
+
+	store := func(args ...string) *config.Store {
+		_, err := app.Parse(args)
+		Expect(err).NotTo(HaveOccurred())
+		s, err := config.NewStore(app, args, path, settings)
+		Expect(err).NotTo(HaveOccurred())
+		return s
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "config")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(dir, "nozzle.yml")
+
+		app = kingpin.New("test", "")
+		endpoint = app.Flag("api-endpoint", "").OverrideDefaultFromEnvar("CONFIG_TEST_API_ENDPOINT").String()
+		workers = app.Flag("firehose-workers", "").Default("4").OverrideDefaultFromEnvar("CONFIG_TEST_WORKERS").Int()
+		interval = app.Flag("cc-pull-time", "").Default("60s").Duration()
+		password = app.Flag("password", "").Default("admin").String()
+		subject = app.Flag("email-subject", "").Default("Report").String()
+		peers = app.Flag("cluster-peers", "").Default("").String()
+
+		settings = []config.Setting{
+			{Key: "cloud_controller.api_endpoint", Flag: "api-endpoint"},
+			{Key: "cloud_controller.poll_interval", Flag: "cc-pull-time"},
+			{Key: "firehose.workers", Flag: "firehose-workers", Check: func(value string) error {
+				if value == "0" {
+					return fmt.Errorf("must not be 0")
+				}
+				return nil
+			}},
+			{Key: "firehose.password", Flag: "password", Secret: true},
+			{Key: "reports.subject", Flag: "email-subject", Reload: true},
+			{Key: "cluster.peers", Flag: "cluster-peers"},
+		}
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("CONFIG_TEST_WORKERS")
+		os.RemoveAll(dir)
+	})
+
+	It("fills in the flags not given from the file", func() {
+		os.Setenv("CONFIG_TEST_WORKERS", "8")
+		write(`
+cloud_controller:
+  api_endpoint: https://api.example.com
+  poll_interval: 5m
+firehose:
+  workers: 2
+  password: secret
+cluster:
+  peers: [http://a:8080, http://b:8080]
+`)
+		s := store("--cc-pull-time=10m")
+
+		Expect(s.Load("cloud_controller.api_endpoint")).To(Succeed())
+		Expect(*endpoint).To(Equal("https://api.example.com"))
+		Expect(*interval).To(Equal(10 * time.Minute))
+		Expect(*workers).To(Equal(8))
+		Expect(*password).To(Equal("secret"))
+		Expect(*peers).To(Equal("http://a:8080,http://b:8080"))
+	})
+
+	It("reads JSON as well", func() {
+		write(`{"cloud_controller": {"api_endpoint": "https://api.example.com"}, "firehose": {"workers": 3}}`)
+
+		Expect(store().Load("cloud_controller.api_endpoint")).To(Succeed())
+		Expect(*workers).To(Equal(3))
+	})
+
+	It("reports every problem at once", func() {
+		write(`
+cloud_controller:
+  poll_interval: soon
+firehose:
+  wrokers: 2
+`)
+		err := store().Load("cloud_controller.api_endpoint")
+		Expect(err).To(MatchError(ContainSubstring("unknown setting firehose.wrokers")))
+
+		write(`
+cloud_controller:
+  poll_interval: soon
+firehose:
+  workers: 0
+`)
+		err = store().Load("cloud_controller.api_endpoint")
+		Expect(err).To(HaveLen(3))
+		Expect(err.Error()).To(ContainSubstring(`nozzle.yml: cloud_controller.poll_interval: invalid value "soon"`))
+		Expect(err.Error()).To(ContainSubstring("cloud_controller.api_endpoint is required"))
+		Expect(err.Error()).To(ContainSubstring("firehose.workers (from " + path + "): must not be 0"))
+	})
+
+	It("validates values that came from flags", func() {
+		write("")
+		err := store("--api-endpoint=https://api.example.com", "--firehose-workers=0").Load("cloud_controller.api_endpoint")
+		Expect(err).To(MatchError("firehose.workers (from --firehose-workers): must not be 0"))
+	})
+
+	It("dumps the configuration with secrets redacted", func() {
+		write(`
+cloud_controller:
+  api_endpoint: https://api.example.com
+firehose:
+  password: secret
+`)
+		s := store("--firehose-workers=6")
+		Expect(s.Load("cloud_controller.api_endpoint")).To(Succeed())
+
+		dump := s.Dump()
+		Expect(dump.Settings["firehose"]).To(Equal(map[string]interface{}{"workers": 6, "password": config.Redacted}))
+		Expect(dump.Settings["cloud_controller"]["poll_interval"]).To(Equal("1m0s"))
+		Expect(dump.Sources).To(Equal(map[string]string{
+			"cloud_controller.api_endpoint": path,
+			"firehose.password":             path,
+			"firehose.workers":              "--firehose-workers",
+		}))
+	})
+
+	It("reloads only the settings that may change while running", func() {
+		write(`
+cloud_controller:
+  api_endpoint: https://api.example.com
+reports:
+  subject: Usage
+`)
+		s := store()
+		Expect(s.Load("cloud_controller.api_endpoint")).To(Succeed())
+
+		write(`
+cloud_controller:
+  api_endpoint: https://api2.example.com
+reports:
+  subject: Weekly usage
+`)
+		changed, restart, err := s.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(Equal([]string{"reports.subject"}))
+		Expect(restart).To(Equal([]string{"cloud_controller.api_endpoint"}))
+		Expect(*subject).To(Equal("Weekly usage"))
+		Expect(*endpoint).To(Equal("https://api.example.com"))
+
+		write(`
+cloud_controller:
+  api_endpoint: https://api.example.com
+`)
+		changed, _, err = s.Reload()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(Equal([]string{"reports.subject"}))
+		Expect(*subject).To(Equal("Report"))
+	})
+
+	It("keeps the current configuration when the new one is invalid", func() {
+		settings[4].Check = func(value string) error {
+			if value == "Usage" {
+				return fmt.Errorf("rejected")
+			}
+			return nil
+		}
+		write(`
+cloud_controller:
+  api_endpoint: https://api.example.com
+`)
+		s := store()
+		Expect(s.Load("cloud_controller.api_endpoint")).To(Succeed())
+
+		write(`
+cloud_controller:
+  api_endpoint: https://api.example.com
+reports:
+  subject: Usage
+`)
+		_, _, err := s.Reload()
+		Expect(err).To(MatchError(ContainSubstring("reports.subject")))
+		Expect(*subject).To(Equal("Report"))
+	})
+})
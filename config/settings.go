@@ -0,0 +1,173 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"app-metrics-nozzle/filter"
+	"app-metrics-nozzle/usageevents"
+)
+
+// Settings are the keys of the nozzle's configuration file and the flags they set.
+var Settings = []Setting{
+	{Key: "firehose.subscription_id", Flag: "subscription-id"},
+	{Key: "firehose.user", Flag: "user"},
+	{Key: "firehose.password", Flag: "password", Secret: true},
+	{Key: "firehose.doppler_endpoint", Flag: "doppler-endpoint", Check: checkURL},
+	{Key: "firehose.skip_ssl_validation", Flag: "skip-ssl-validation"},
+	{Key: "firehose.debug", Flag: "debug"},
+	{Key: "firehose.workers", Flag: "firehose-workers", Check: checkPositive},
+	{Key: "firehose.queue_size", Flag: "firehose-queue-size", Check: checkPositive},
+	{Key: "firehose.overflow", Flag: "firehose-overflow", Check: checkOverflow},
+	{Key: "firehose.usage_sources", Flag: "usage-sources", Check: checkUsageSources},
+	{Key: "firehose.max_clock_skew", Flag: "max-clock-skew", Check: checkPositiveDuration},
+	{Key: "firehose.record_file", Flag: "record-file"},
+
+	{Key: "cloud_controller.api_endpoint", Flag: "api-endpoint", Check: checkURL},
+	{Key: "cloud_controller.poll_interval", Flag: "cc-pull-time", Check: checkPositiveDuration},
+	{Key: "cloud_controller.deleted_app_retention", Flag: "deleted-app-retention"},
+	{Key: "cloud_controller.resolver_batch_size", Flag: "resolver-batch-size", Check: checkPositive},
+	{Key: "cloud_controller.resolver_retry_after", Flag: "resolver-retry-after"},
+	{Key: "cloud_controller.resolver_max_pending", Flag: "resolver-max-pending", Check: checkPositive},
+
+	{Key: "storage.boltdb_path", Flag: "boltdb-path"},
+	{Key: "storage.state_save_interval", Flag: "state-save-interval"},
+
+	{Key: "http.tls_cert_file", Flag: "tls-cert-file"},
+	{Key: "http.tls_key_file", Flag: "tls-key-file"},
+	{Key: "http.tls_client_ca_file", Flag: "tls-client-ca-file"},
+	{Key: "http.tls_require_client_cert", Flag: "tls-require-client-cert"},
+	{Key: "http.tls_client_identities_file", Flag: "tls-client-identities-file"},
+	{Key: "http.tls_reload_interval", Flag: "tls-reload-interval", Check: checkPositiveDuration},
+	{Key: "http.legacy_app_map", Flag: "api-legacy-app-map"},
+	{Key: "http.stream_throttle", Flag: "stream-throttle"},
+	{Key: "http.stream_backlog", Flag: "stream-backlog"},
+	{Key: "http.tail_buffer", Flag: "tail-buffer"},
+	{Key: "http.tail_allowed_origins", Flag: "tail-allowed-origins"},
+
+	{Key: "auth.api_key", Flag: "api-key"},
+	{Key: "auth.api_secret", Flag: "api-secret", Secret: true},
+	{Key: "auth.credentials_file", Flag: "api-credentials-file"},
+	{Key: "auth.authorization_file", Flag: "api-authorization-file"},
+	{Key: "auth.signature_max_skew", Flag: "api-signature-max-skew"},
+	{Key: "auth.rate_limit", Flag: "api-rate-limit"},
+	{Key: "auth.rate_burst", Flag: "api-rate-burst"},
+	{Key: "auth.failure_rate_limit", Flag: "api-failure-rate-limit"},
+	{Key: "auth.failure_burst", Flag: "api-failure-burst"},
+	{Key: "auth.trusted_proxies", Flag: "api-trusted-proxies"},
+	{Key: "auth.require_https", Flag: "api-require-https"},
+	{Key: "auth.uaa_token_keys_url", Flag: "uaa-token-keys-url", Check: checkURL},
+	{Key: "auth.uaa_audience", Flag: "uaa-audience"},
+	{Key: "auth.uaa_scopes", Flag: "uaa-scopes"},
+
+	{Key: "reports.frequency", Flag: "email-frequency-in-minutes", Check: checkPositiveDuration},
+	{Key: "reports.time_zone", Flag: "report-time-zone", Reload: true, Check: checkTimeZone},
+	{Key: "reports.filter", Flag: "report-filter", Reload: true, Check: checkFilter},
+	{Key: "reports.subject", Flag: "email-subject", Reload: true},
+	{Key: "reports.body", Flag: "email-body", Reload: true},
+	{Key: "reports.attachment_name", Flag: "email-attachment-name", Reload: true},
+
+	{Key: "notifications.sender", Flag: "email-sender", Reload: true},
+	{Key: "notifications.receiver", Flag: "email-receiver", Reload: true},
+	{Key: "notifications.server_host", Flag: "email-server-host", Reload: true},
+	{Key: "notifications.server_port", Flag: "email-server-port", Reload: true, Check: checkPort},
+	{Key: "notifications.user_name", Flag: "email-user-name", Reload: true},
+	{Key: "notifications.user_password", Flag: "email-user-password", Reload: true, Secret: true},
+	{Key: "notifications.alert_rules_file", Flag: "alert-rules-file"},
+	{Key: "notifications.alert_evaluation_interval", Flag: "alert-evaluation-interval", Check: checkPositiveDuration},
+
+	{Key: "audit.log_file", Flag: "audit-log-file"},
+	{Key: "audit.log_max_size", Flag: "audit-log-max-size"},
+	{Key: "audit.log_max_backups", Flag: "audit-log-max-backups"},
+	{Key: "audit.bolt", Flag: "audit-bolt"},
+	{Key: "audit.retention", Flag: "audit-retention"},
+
+	{Key: "sinks.urls", Flag: "event-sinks", Separator: " "},
+	{Key: "sinks.types", Flag: "event-sink-types"},
+	{Key: "sinks.queue_size", Flag: "event-sink-queue-size", Check: checkPositive},
+	{Key: "sinks.batch_size", Flag: "event-sink-batch-size", Check: checkPositive},
+	{Key: "sinks.flush_interval", Flag: "event-sink-flush-interval", Check: checkPositiveDuration},
+
+	{Key: "cluster.peers", Flag: "cluster-peers"},
+	{Key: "cluster.peer_template", Flag: "cluster-peer-template"},
+	{Key: "cluster.instances", Flag: "cluster-instances"},
+	{Key: "cluster.instance_id", Flag: "cluster-instance-id"},
+	{Key: "cluster.secret", Flag: "cluster-secret", Secret: true},
+	{Key: "cluster.push_interval", Flag: "cluster-push-interval", Check: checkPositiveDuration},
+	{Key: "cluster.leader_lease_file", Flag: "leader-lease-file"},
+	{Key: "cluster.leader_lease_ttl", Flag: "leader-lease-ttl", Check: checkPositiveDuration},
+}
+
+func checkURL(value string) error {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL", value)
+	}
+	return nil
+}
+
+func checkPositive(value string) error {
+	if number, err := strconv.Atoi(value); err != nil || number <= 0 {
+		return fmt.Errorf("%q is not a positive number", value)
+	}
+	return nil
+}
+
+func checkPositiveDuration(value string) error {
+	if duration, err := time.ParseDuration(value); err != nil || duration <= 0 {
+		return fmt.Errorf("%q is not a positive duration", value)
+	}
+	return nil
+}
+
+func checkPort(value string) error {
+	if port, err := strconv.Atoi(value); err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("%q is not a port number", value)
+	}
+	return nil
+}
+
+func checkOverflow(value string) error {
+	_, err := usageevents.ParseOverflowPolicy(value)
+	return err
+}
+
+func checkUsageSources(value string) error {
+	_, err := usageevents.ParseUsageSources(value)
+	return err
+}
+
+func checkTimeZone(value string) error {
+	_, err := time.LoadLocation(value)
+	return err
+}
+
+func checkFilter(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	_, err := filter.Parse(value)
+	return err
+}
@@ -1,5 +1,7 @@
 package domain
 
+import "time"
+
 type App struct {
 	GUID                  string `json:"guid"`
 	Name                  string `json:"name"`
@@ -10,12 +12,51 @@ type App struct {
 	EventCount            int64 `json:"event_count"`
 	LastEventTime         int64   `json:"last_event_time"`
 	RequestsPerSecond     float64      `json:"requests_per_second"`
+	ServerErrorCount      int64 `json:"server_error_count"`
 	ElapsedSinceLastEvent int64    `json:"elapsed_since_last_event"`
 	Space                 struct {
 				      ID   string `json:"id"`
 				      Name string `json:"name"`
 			      } `json:"space"`
 	State                 string `json:"state"`
+	DeletedAt             int64 `json:"deleted_at,omitempty"`
+	// Sources breaks the app's log messages down by source type, whether or not they count as usage.
+	// The map is replaced rather than modified, so copies of an App may share it.
+	Sources map[string]SourceUsage `json:"sources,omitempty"`
 }
 
+// SourceUsage counts the log messages of an app from one source type, such as RTR or APP/PROC.
+type SourceUsage struct {
+	EventCount    int64 `json:"event_count"`
+	LastEventTime int64 `json:"last_event_time"`
+}
 
+// AddSources returns the two breakdowns added up in a new map, leaving both untouched.
+func AddSources(a map[string]SourceUsage, b map[string]SourceUsage) map[string]SourceUsage {
+	if len(b) == 0 {
+		return a
+	}
+	sum := make(map[string]SourceUsage, len(a)+len(b))
+	for source, usage := range a {
+		sum[source] = usage
+	}
+	for source, usage := range b {
+		total := sum[source]
+		total.EventCount += usage.EventCount
+		if usage.LastEventTime > total.LastEventTime {
+			total.LastEventTime = usage.LastEventTime
+		}
+		sum[source] = total
+	}
+	return sum
+}
+
+// AsOf returns the app with ElapsedSinceLastEvent, in seconds, as it is at now. Apps without events, or
+// whose last event is stamped slightly ahead of now, get 0.
+func (a App) AsOf(now time.Time) App {
+	a.ElapsedSinceLastEvent = 0
+	if a.LastEventTime > 0 && now.UnixNano() > a.LastEventTime {
+		a.ElapsedSinceLastEvent = (now.UnixNano() - a.LastEventTime) / int64(time.Second)
+	}
+	return a
+}
@@ -0,0 +1,396 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package filter implements the expression language used to select apps in listings, reports and alert rules, e.g.
+//
+//	state == "STARTED" and last_event_time < now-30d and org =~ "^team-"
+//
+// Comparisons combine with and, or, not and parentheses. Strings support ==, !=, =~ and !~ (regular expressions);
+// numbers support ==, !=, <, <=, > and >=. last_event_time is compared against now, optionally offset by a
+// duration such as now-30d; elapsed_since_last_event accepts durations such as 2h as well as plain seconds.
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"app-metrics-nozzle/domain"
+)
+
+type fieldKind int
+
+const (
+	kindString  fieldKind = iota
+	kindNumber            // plain numbers only
+	kindSeconds           // numbers or durations, compared in seconds
+	kindTime              // now, now+duration or now-duration, compared in nanoseconds since the epoch
+)
+
+type field struct {
+	kind fieldKind
+	str  func(domain.App) string
+	num  func(domain.App) float64
+}
+
+var fields = map[string]field{
+	"guid":                     {kind: kindString, str: func(app domain.App) string { return app.GUID }},
+	"name":                     {kind: kindString, str: func(app domain.App) string { return app.Name }},
+	"org":                      {kind: kindString, str: func(app domain.App) string { return app.Organization.Name }},
+	"space":                    {kind: kindString, str: func(app domain.App) string { return app.Space.Name }},
+	"state":                    {kind: kindString, str: func(app domain.App) string { return app.State }},
+	"event_count":              {kind: kindNumber, num: func(app domain.App) float64 { return float64(app.EventCount) }},
+	"requests_per_second":      {kind: kindNumber, num: func(app domain.App) float64 { return app.RequestsPerSecond }},
+	"server_error_count":       {kind: kindNumber, num: func(app domain.App) float64 { return float64(app.ServerErrorCount) }},
+	"elapsed_since_last_event": {kind: kindSeconds, num: func(app domain.App) float64 { return float64(app.ElapsedSinceLastEvent) }},
+	"last_event_time":          {kind: kindTime, num: func(app domain.App) float64 { return float64(app.LastEventTime) }},
+}
+
+// Fields returns the names that can be used in filters.
+func Fields() []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Filter is a parsed filter expression. The zero value and nil match every app.
+type Filter struct {
+	source string
+	root   node
+}
+
+// Parse compiles a filter expression. Errors are *SyntaxError values naming the offending column.
+// A blank expression yields a nil Filter, which matches every app.
+func Parse(expression string) (*Filter, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, nil
+	}
+
+	tokens, err := lex(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); next.kind != tokenEOF {
+		return nil, &SyntaxError{next.pos, fmt.Sprintf("unexpected %s, expected and, or or end of filter", next.describe())}
+	}
+	return &Filter{source: expression, root: root}, nil
+}
+
+// Match evaluates the filter for an app. now anchors relative times such as now-30d.
+func (f *Filter) Match(app domain.App, now time.Time) bool {
+	if f == nil || f.root == nil {
+		return true
+	}
+	return f.root.match(app, now)
+}
+
+// String returns the expression the filter was parsed from.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.source
+}
+
+type node interface {
+	match(app domain.App, now time.Time) bool
+}
+
+type orNode struct{ left, right node }
+
+func (n orNode) match(app domain.App, now time.Time) bool {
+	return n.left.match(app, now) || n.right.match(app, now)
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) match(app domain.App, now time.Time) bool {
+	return n.left.match(app, now) && n.right.match(app, now)
+}
+
+type notNode struct{ operand node }
+
+func (n notNode) match(app domain.App, now time.Time) bool {
+	return !n.operand.match(app, now)
+}
+
+type comparison struct {
+	field    field
+	operator string
+	str      string
+	pattern  *regexp.Regexp
+	num      float64
+	relative bool // num is an offset in nanoseconds from now
+}
+
+func (c comparison) match(app domain.App, now time.Time) bool {
+	if c.field.kind == kindString {
+		value := c.field.str(app)
+		switch c.operator {
+		case "==":
+			return value == c.str
+		case "!=":
+			return value != c.str
+		case "=~":
+			return c.pattern.MatchString(value)
+		case "!~":
+			return !c.pattern.MatchString(value)
+		}
+		return false
+	}
+
+	value, operand := c.field.num(app), c.num
+	if c.relative {
+		operand += float64(now.UnixNano())
+	}
+	switch c.operator {
+	case "==":
+		return value == operand
+	case "!=":
+		return value != operand
+	case "<":
+		return value < operand
+	case "<=":
+		return value <= operand
+	case ">":
+		return value > operand
+	case ">=":
+		return value >= operand
+	}
+	return false
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokenIdent && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.keyword("not") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenLParen:
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, &SyntaxError{closing.pos, fmt.Sprintf("expected ) to close the ( at column %d, found %s", t.pos, closing.describe())}
+		}
+		return inner, nil
+	case tokenIdent:
+		return p.parseComparison(t)
+	}
+	return nil, &SyntaxError{t.pos, fmt.Sprintf("expected a field name or (, found %s", t.describe())}
+}
+
+func (p *parser) parseComparison(name token) (node, error) {
+	f, ok := fields[name.text]
+	if !ok {
+		return nil, &SyntaxError{name.pos, fmt.Sprintf("unknown field %q, expected one of %s", name.text, strings.Join(Fields(), ", "))}
+	}
+
+	op := p.next()
+	if op.kind != tokenOperator || op.text == "+" || op.text == "-" {
+		return nil, &SyntaxError{op.pos, fmt.Sprintf("expected a comparison operator after %s, found %s", name.text, op.describe())}
+	}
+
+	c := comparison{field: f, operator: op.text}
+	if f.kind == kindString {
+		switch op.text {
+		case "==", "!=", "=~", "!~":
+		default:
+			return nil, &SyntaxError{op.pos, fmt.Sprintf("%s is a string; use ==, !=, =~ or !~", name.text)}
+		}
+		value := p.next()
+		if value.kind != tokenString {
+			return nil, &SyntaxError{value.pos, fmt.Sprintf("expected a quoted string to compare %s with, found %s", name.text, value.describe())}
+		}
+		c.str = value.text
+		if op.text == "=~" || op.text == "!~" {
+			pattern, err := regexp.Compile(value.text)
+			if err != nil {
+				return nil, &SyntaxError{value.pos, fmt.Sprintf("invalid regular expression: %v", err)}
+			}
+			c.pattern = pattern
+		}
+		return c, nil
+	}
+
+	if op.text == "=~" || op.text == "!~" {
+		return nil, &SyntaxError{op.pos, fmt.Sprintf("%s is a number; use ==, !=, <, <=, > or >=", name.text)}
+	}
+
+	var err error
+	if f.kind == kindTime {
+		c.relative = true
+		c.num, err = p.parseRelativeTime(name.text)
+	} else {
+		c.num, err = p.parseNumber(f.kind == kindSeconds)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// parseRelativeTime reads now, now+duration or now-duration and returns the offset from now in nanoseconds.
+func (p *parser) parseRelativeTime(fieldName string) (float64, error) {
+	t := p.next()
+	if t.kind != tokenIdent || t.text != "now" {
+		return 0, &SyntaxError{t.pos, fmt.Sprintf("%s is compared with now, now-<duration> or now+<duration>, found %s", fieldName, t.describe())}
+	}
+
+	sign := p.peek()
+	if sign.kind != tokenOperator || (sign.text != "+" && sign.text != "-") {
+		return 0, nil
+	}
+	p.next()
+
+	amount := p.next()
+	if amount.kind != tokenNumber {
+		return 0, &SyntaxError{amount.pos, fmt.Sprintf("expected a duration such as 30d after now%s, found %s", sign.text, amount.describe())}
+	}
+	duration, err := parseDuration(amount.text)
+	if err != nil {
+		return 0, &SyntaxError{amount.pos, err.Error()}
+	}
+	if sign.text == "-" {
+		duration = -duration
+	}
+	return float64(duration), nil
+}
+
+// parseNumber reads an optionally negative number. When durations are allowed, a value with a unit is converted to seconds.
+func (p *parser) parseNumber(durations bool) (float64, error) {
+	negative := false
+	if t := p.peek(); t.kind == tokenOperator && t.text == "-" {
+		negative = true
+		p.next()
+	}
+
+	t := p.next()
+	if t.kind != tokenNumber {
+		return 0, &SyntaxError{t.pos, fmt.Sprintf("expected a number, found %s", t.describe())}
+	}
+
+	value, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		if !durations {
+			return 0, &SyntaxError{t.pos, fmt.Sprintf("invalid number %q", t.text)}
+		}
+		duration, err := parseDuration(t.text)
+		if err != nil {
+			return 0, &SyntaxError{t.pos, err.Error()}
+		}
+		value = duration.Seconds()
+	}
+	if negative {
+		value = -value
+	}
+	return value, nil
+}
+
+// parseDuration accepts Go durations plus d (days) and w (weeks).
+func parseDuration(text string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(text, suffix) {
+			count, err := strconv.ParseFloat(strings.TrimSuffix(text, suffix), 64)
+			if err != nil {
+				break
+			}
+			return time.Duration(count * float64(unit)), nil
+		}
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, use units such as s, m, h, d or w", text)
+	}
+	return duration, nil
+}
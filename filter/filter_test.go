@@ -0,0 +1,82 @@
+package filter_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/domain"
+	"app-metrics-nozzle/filter"
+	"time"
+)
+
+var _ = Describe("Filter", func() {
+	var (
+		now time.Time
+		app domain.App
+	)
+
+	BeforeEach(func() {
+		now = time.Date(2016, 6, 30, 12, 0, 0, 0, time.UTC)
+		app = domain.App{Name: "billing", State: "STARTED", EventCount: 42, RequestsPerSecond: 0.5, ElapsedSinceLastEvent: 7200}
+		app.Organization.Name = "team-payments"
+		app.Space.Name = "prod"
+		app.LastEventTime = now.Add(-40 * 24 * time.Hour).UnixNano()
+	})
+
+	matches := func(expression string) bool {
+		f, err := filter.Parse(expression)
+		Expect(err).ToNot(HaveOccurred())
+		return f.Match(app, now)
+	}
+
+	parseError := func(expression string) *filter.SyntaxError {
+		_, err := filter.Parse(expression)
+		Expect(err).To(HaveOccurred())
+		syntaxError, ok := err.(*filter.SyntaxError)
+		Expect(ok).To(BeTrue())
+		return syntaxError
+	}
+
+	It("combines string, time and regular expression comparisons", func() {
+		Expect(matches(`state == "STARTED" and last_event_time < now-30d and org =~ "^team-"`)).To(BeTrue())
+		Expect(matches(`state == "STARTED" and last_event_time < now-60d`)).To(BeFalse())
+		Expect(matches(`org !~ "^team-"`)).To(BeFalse())
+	})
+
+	It("binds and tighter than or and honours parentheses and not", func() {
+		Expect(matches(`space == "dev" and event_count > 100 or name == "billing"`)).To(BeTrue())
+		Expect(matches(`space == "dev" and (event_count > 100 or name == "billing")`)).To(BeFalse())
+		Expect(matches(`not space == "dev"`)).To(BeTrue())
+	})
+
+	It("compares numbers, including durations in seconds", func() {
+		Expect(matches(`event_count >= 42 and requests_per_second < 1`)).To(BeTrue())
+		Expect(matches(`elapsed_since_last_event > 1h and elapsed_since_last_event <= 7200`)).To(BeTrue())
+		Expect(matches(`event_count > -1`)).To(BeTrue())
+	})
+
+	It("matches everything without an expression", func() {
+		var f *filter.Filter
+		Expect(f.Match(app, now)).To(BeTrue())
+	})
+
+	It("parses a blank expression to a nil filter", func() {
+		for _, expression := range []string{"", "   "} {
+			f, err := filter.Parse(expression)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f).To(BeNil())
+			Expect(f.Match(app, now)).To(BeTrue())
+		}
+	})
+
+	It("reports where parsing failed", func() {
+		Expect(parseError(`state == "STARTED" and`).Pos).To(Equal(23))
+		Expect(parseError(`colour == "red"`).Msg).To(ContainSubstring(`unknown field "colour"`))
+		Expect(parseError(`event_count =~ "1"`).Msg).To(ContainSubstring("event_count is a number"))
+		Expect(parseError(`name == STARTED`).Msg).To(ContainSubstring("expected a quoted string"))
+		Expect(parseError(`last_event_time < 5`).Msg).To(ContainSubstring("now-<duration>"))
+		Expect(parseError(`(name == "a"`).Msg).To(ContainSubstring("expected ) to close"))
+		Expect(parseError(`name =~ "("`).Msg).To(ContainSubstring("invalid regular expression"))
+		Expect(parseError(`name == "a`).Msg).To(Equal("unterminated string"))
+	})
+})
@@ -0,0 +1,143 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenLParen
+	tokenRParen
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of filter"
+	case tokenIdent:
+		return "name"
+	case tokenString:
+		return "string"
+	case tokenNumber:
+		return "number"
+	case tokenOperator:
+		return "operator"
+	case tokenLParen:
+		return "("
+	case tokenRParen:
+		return ")"
+	}
+	return "token"
+}
+
+type token struct {
+	kind tokenKind
+	text string // identifier, operator or number as written; unquoted value of strings
+	pos  int    // 1-based column of the first character
+}
+
+func (t token) describe() string {
+	switch t.kind {
+	case tokenEOF, tokenLParen, tokenRParen:
+		return t.kind.String()
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// SyntaxError reports where a filter could not be parsed.
+type SyntaxError struct {
+	Pos int // 1-based column
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("filter column %d: %s", e.Pos, e.Msg)
+}
+
+// lex splits a filter into tokens. Numbers may carry a unit suffix (30d, 1.5h), which the parser interprets.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: start + 1})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: start + 1})
+			i++
+		case r == '"':
+			var value strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, &SyntaxError{start + 1, "unterminated string"}
+			}
+			i++
+			tokens = append(tokens, token{kind: tokenString, text: value.String(), pos: start + 1})
+		case strings.ContainsRune("=!<>+-", r):
+			op := string(r)
+			if i+1 < len(runes) && strings.ContainsRune("=~", runes[i+1]) && r != '+' && r != '-' {
+				op += string(runes[i+1])
+			}
+			i += len(op)
+			switch op {
+			case "==", "!=", "<", "<=", ">", ">=", "=~", "!~", "+", "-":
+			default:
+				return nil, &SyntaxError{start + 1, fmt.Sprintf("unknown operator %q", op)}
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: start + 1})
+		case unicode.IsDigit(r) || r == '.':
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || unicode.IsLetter(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i]), pos: start + 1})
+		case unicode.IsLetter(r) || r == '_':
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(runes[start:i]), pos: start + 1})
+		default:
+			return nil, &SyntaxError{start + 1, fmt.Sprintf("unexpected character %q", r)}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(runes) + 1}), nil
+}
@@ -0,0 +1,143 @@
+package jsonerror
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ProblemContentType is the media type of RFC 7807 problem details.
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object.
+// Type identifies the kind of problem and Instance the particular occurrence; Extensions are
+// serialized as additional top level members next to the standard ones.
+type Problem struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	Instance   string
+	Extensions map[string]interface{}
+}
+
+// NewProblem creates a Problem of the given type. An empty problemType means "about:blank",
+// in which case title should be the HTTP status text.
+func NewProblem(problemType string, title string, status int) Problem {
+	if problemType == "" {
+		problemType = "about:blank"
+	}
+	return Problem{Type: problemType, Title: title, Status: status}
+}
+
+// WithDetail returns a copy of p with a human readable explanation of this occurrence.
+func (p Problem) WithDetail(detail string) Problem {
+	p.Detail = detail
+	return p
+}
+
+// WithInstance returns a copy of p identifying this occurrence, usually the request path.
+func (p Problem) WithInstance(instance string) Problem {
+	p.Instance = instance
+	return p
+}
+
+// With returns a copy of p with an extension member added. Standard member names are ignored.
+func (p Problem) With(name string, value interface{}) Problem {
+	switch name {
+	case "type", "title", "status", "detail", "instance":
+		return p
+	}
+	extensions := make(map[string]interface{}, len(p.Extensions)+1)
+	for k, v := range p.Extensions {
+		extensions[k] = v
+	}
+	extensions[name] = value
+	p.Extensions = extensions
+	return p
+}
+
+// Error satisfies the error interface.
+func (p Problem) Error() string {
+	if p.Detail != "" {
+		return p.Title + ": " + p.Detail
+	}
+	return p.Title
+}
+
+// MarshalJSON flattens the extension members into the problem object.
+func (p Problem) MarshalJSON() ([]byte, error) {
+	members := make(map[string]interface{}, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		members[k] = v
+	}
+	members["type"] = p.Type
+	members["title"] = p.Title
+	if p.Status != 0 {
+		members["status"] = p.Status
+	}
+	if p.Detail != "" {
+		members["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		members["instance"] = p.Instance
+	}
+	return json.Marshal(members)
+}
+
+// UnmarshalJSON reads a problem back, collecting unknown members as extensions.
+func (p *Problem) UnmarshalJSON(data []byte) error {
+	var members map[string]interface{}
+	if err := json.Unmarshal(data, &members); err != nil {
+		return err
+	}
+
+	*p = Problem{}
+	for name, value := range members {
+		switch name {
+		case "type":
+			p.Type, _ = value.(string)
+		case "title":
+			p.Title, _ = value.(string)
+		case "status":
+			if status, ok := value.(float64); ok {
+				p.Status = int(status)
+			}
+		case "detail":
+			p.Detail, _ = value.(string)
+		case "instance":
+			p.Instance, _ = value.(string)
+		default:
+			if p.Extensions == nil {
+				p.Extensions = make(map[string]interface{})
+			}
+			p.Extensions[name] = value
+		}
+	}
+	return nil
+}
+
+// Write sends the problem as the response with its status code and the problem+json content type.
+func (p Problem) Write(w http.ResponseWriter) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	status := p.Status
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(status)
+	_, err = w.Write(data)
+	return err
+}
+
+// Problem converts a JE into problem details, keeping its code and domain as extension members.
+// The JE error becomes the title and its message the detail.
+func (j JE) Problem(problemType string, status int) Problem {
+	p := NewProblem(problemType, j.error, status).WithDetail(j.message).With("code", j.Code)
+	if j.Domain != "" {
+		p = p.With("domain", j.Domain)
+	}
+	return p
+}
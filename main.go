@@ -17,9 +17,15 @@ limitations under the License.
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/CrowdSurge/banner"
@@ -32,21 +38,113 @@ import (
 	"app-metrics-nozzle/service"
 	"app-metrics-nozzle/usageevents"
 	"app-metrics-nozzle/api"
+	"app-metrics-nozzle/alerting"
+	"app-metrics-nozzle/audit"
+	"app-metrics-nozzle/cluster"
+	"app-metrics-nozzle/config"
+	"app-metrics-nozzle/recording"
+	"app-metrics-nozzle/restgate"
+	"app-metrics-nozzle/state"
+	"app-metrics-nozzle/stream"
 	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
 	"github.com/cloudfoundry/noaa/consumer"
 )
 
 var (
+	serveCommand = kingpin.Command("serve", "Count app usage from the firehose and serve the REST API. This is the default").Default()
+	reportCommand = kingpin.Command("report", "Print the report of the app usage saved in the bolt database, or email it with --send")
+	reportSend = reportCommand.Flag("send", "Email the report instead of printing it").Bool()
+	reportFilterOverride = reportCommand.Flag("filter", "Filter expression used instead of --report-filter").String()
+	exportCommand = kingpin.Command("export", "Write the app usage saved in the bolt database as CSV or JSON")
+	exportFormat = exportCommand.Flag("format", "Output format: csv or json").Default("csv").Enum("csv", "json")
+	exportOutput = exportCommand.Flag("output", "File to write instead of standard output").Short('o').String()
+	exportFilter = exportCommand.Flag("filter", "Filter expression selecting the apps to export, e.g. 'event_count == 0'").String()
+	inspectCommand = kingpin.Command("inspect", "Describe the bolt database: schema version, record counts and oldest and newest events")
+	inspectJSON = inspectCommand.Flag("json", "Print the description as JSON").Bool()
+	replayCommand = kingpin.Command("replay", "Count app usage from a file recorded with --record-file and write it as CSV or JSON")
+	replayFile = replayCommand.Arg("file", "Recording to replay").Required().ExistingFile()
+	replaySpeed = replayCommand.Flag("speed", "How many times faster than recorded envelopes are replayed. 0 replays as fast as possible").Default("1").Float64()
+	replayFormat = replayCommand.Flag("format", "Output format: csv or json").Default("csv").Enum("csv", "json")
+	replayOutput = replayCommand.Flag("output", "File to write instead of standard output").Short('o').String()
+
+	configFile = kingpin.Flag("config-file", "YAML or JSON file with the settings not given as flags or environment variables. Report and notification settings are reloaded on SIGHUP").Default("").OverrideDefaultFromEnvar("CONFIG_FILE").String()
 	debug = kingpin.Flag("debug", "Enable debug mode. This disables forwarding to syslog").Default("false").OverrideDefaultFromEnvar("DEBUG").Bool()
-	apiEndpoint = kingpin.Flag("api-endpoint", "Api endpoint address. For bosh-lite installation of CF: https://api.10.244.0.34.xip.io").OverrideDefaultFromEnvar("API_ENDPOINT").Required().String()
+	apiEndpoint = kingpin.Flag("api-endpoint", "Api endpoint address. For bosh-lite installation of CF: https://api.10.244.0.34.xip.io").OverrideDefaultFromEnvar("API_ENDPOINT").String()
 	dopplerEndpoint = kingpin.Flag("doppler-endpoint", "Overwrite default doppler endpoint return by /v2/info").OverrideDefaultFromEnvar("DOPPLER_ENDPOINT").String()
 	subscriptionID = kingpin.Flag("subscription-id", "Id for the subscription.").Default("firehose").OverrideDefaultFromEnvar("FIREHOSE_SUBSCRIPTION_ID").String()
 	user = kingpin.Flag("user", "Admin user.").Default("admin").OverrideDefaultFromEnvar("FIREHOSE_USER").String()
 	password = kingpin.Flag("password", "Admin password.").Default("admin").OverrideDefaultFromEnvar("FIREHOSE_PASSWORD").String()
 	skipSSLValidation = kingpin.Flag("skip-ssl-validation", "Please don't").Default("false").OverrideDefaultFromEnvar("SKIP_SSL_VALIDATION").Bool()
 	boltDatabasePath = kingpin.Flag("boltdb-path", "Bolt Database path ").Default("my.db").OverrideDefaultFromEnvar("BOLTDB_PATH").String()
+	stateSaveInterval = kingpin.Flag("state-save-interval", "How often app usage is saved to the bolt database for the report, export and inspect commands. 0 disables saving").Default("1m").OverrideDefaultFromEnvar("STATE_SAVE_INTERVAL").Duration()
 	tickerTime = kingpin.Flag("cc-pull-time", "CloudController Polling time in sec").Default("60s").OverrideDefaultFromEnvar("CF_PULL_TIME").Duration()
+	deletedAppRetention = kingpin.Flag("deleted-app-retention", "How long apps deleted from the Cloud Controller are kept and reported before they are purged").Default("168h").OverrideDefaultFromEnvar("DELETED_APP_RETENTION").Duration()
 	emailFrequency = kingpin.Flag("email-frequency-in-minutes", "How frequent report needs to be sent in minutes. ie. XXm").Default("24h").OverrideDefaultFromEnvar("EMAIL_FREQUENCY_IN_HOURS").Duration()
+	apiKey = kingpin.Flag("api-key", "API key accepted in the X-Auth-Key header.").Default("").OverrideDefaultFromEnvar("API_KEY").String()
+	apiSecret = kingpin.Flag("api-secret", "API secret accepted in the X-Auth-Secret header for --api-key.").Default("").OverrideDefaultFromEnvar("API_SECRET").String()
+	apiCredentialsFile = kingpin.Flag("api-credentials-file", "JSON file with named API keys and bcrypt hashed secrets. Reloaded on SIGHUP").Default("").OverrideDefaultFromEnvar("API_CREDENTIALS_FILE").String()
+	apiAuthorizationFile = kingpin.Flag("api-authorization-file", "JSON file mapping API keys and UAA users to the orgs and spaces they may see. Everyone is admin when empty. Reloaded on SIGHUP").Default("").OverrideDefaultFromEnvar("API_AUTHORIZATION_FILE").String()
+	apiSignatureMaxSkew = kingpin.Flag("api-signature-max-skew", "Clock skew allowed for HMAC signed requests. 0 disables signed requests").Default("5m").OverrideDefaultFromEnvar("API_SIGNATURE_MAX_SKEW").Duration()
+	apiRateLimit = kingpin.Flag("api-rate-limit", "Requests per second allowed for each API key or token. 0 disables rate limiting").Default("5").OverrideDefaultFromEnvar("API_RATE_LIMIT").Float64()
+	apiRateBurst = kingpin.Flag("api-rate-burst", "Requests an API key or token may make in a burst").Default("20").OverrideDefaultFromEnvar("API_RATE_BURST").Int()
+	apiFailureRateLimit = kingpin.Flag("api-failure-rate-limit", "Failed authentication attempts per second allowed for each client IP. 0 disables the limit").Default("0.1").OverrideDefaultFromEnvar("API_FAILURE_RATE_LIMIT").Float64()
+	apiFailureBurst = kingpin.Flag("api-failure-burst", "Failed authentication attempts a client IP may make in a burst").Default("10").OverrideDefaultFromEnvar("API_FAILURE_BURST").Int()
+	apiTrustedProxies = kingpin.Flag("api-trusted-proxies", "Proxies in front of the nozzle that append to X-Forwarded-For, such as the gorouter and a load balancer. 0 uses the connection's peer as the client IP").Default("1").OverrideDefaultFromEnvar("API_TRUSTED_PROXIES").Int()
+	apiRequireHTTPS = kingpin.Flag("api-require-https", "Reject API requests that did not arrive over HTTPS").Default("false").OverrideDefaultFromEnvar("API_REQUIRE_HTTPS").Bool()
+	uaaTokenKeysURL = kingpin.Flag("uaa-token-keys-url", "UAA token keys endpoint, e.g. https://uaa.example.com/token_keys. Enables bearer token authentication").Default("").OverrideDefaultFromEnvar("UAA_TOKEN_KEYS_URL").String()
+	uaaAudience = kingpin.Flag("uaa-audience", "Audience bearer tokens must be issued for. Not checked when empty").Default("").OverrideDefaultFromEnvar("UAA_AUDIENCE").String()
+	uaaScopes = kingpin.Flag("uaa-scopes", "Comma separated scopes, one of which bearer tokens must carry").Default("cloud_controller.admin,nozzle.read").OverrideDefaultFromEnvar("UAA_SCOPES").String()
+	tlsCertFile = kingpin.Flag("tls-cert-file", "PEM certificate to serve the API over HTTPS with. Plain HTTP is served when empty").Default("").OverrideDefaultFromEnvar("TLS_CERT_FILE").String()
+	tlsKeyFile = kingpin.Flag("tls-key-file", "PEM private key for --tls-cert-file").Default("").OverrideDefaultFromEnvar("TLS_KEY_FILE").String()
+	tlsClientCAFile = kingpin.Flag("tls-client-ca-file", "PEM CA bundle client certificates are verified against").Default("").OverrideDefaultFromEnvar("TLS_CLIENT_CA_FILE").String()
+	tlsRequireClientCert = kingpin.Flag("tls-require-client-cert", "Refuse TLS connections without a valid client certificate").Default("false").OverrideDefaultFromEnvar("TLS_REQUIRE_CLIENT_CERT").Bool()
+	tlsClientIdentitiesFile = kingpin.Flag("tls-client-identities-file", "JSON file mapping client certificate subjects to API identities").Default("").OverrideDefaultFromEnvar("TLS_CLIENT_IDENTITIES_FILE").String()
+	tlsReloadInterval = kingpin.Flag("tls-reload-interval", "How often the certificate files are checked for changes").Default("30s").OverrideDefaultFromEnvar("TLS_RELOAD_INTERVAL").Duration()
+	apiLegacyAppMap = kingpin.Flag("api-legacy-app-map", "Serve /api/apps as one map keyed by org/space/app instead of sorted pages").Default("false").OverrideDefaultFromEnvar("API_LEGACY_APP_MAP").Bool()
+	streamThrottle = kingpin.Flag("stream-throttle", "Minimum time between two /api/stream updates of the same app. 0 disables the stream").Default("1s").OverrideDefaultFromEnvar("STREAM_THROTTLE").Duration()
+	tailBuffer = kingpin.Flag("tail-buffer", "Events a /tail WebSocket client may lag behind before events are dropped. 0 disables tailing").Default("256").OverrideDefaultFromEnvar("TAIL_BUFFER").Int()
+	tailAllowedOrigins = kingpin.Flag("tail-allowed-origins", "Comma separated origins, besides the nozzle's own, whose pages may open a /tail WebSocket, e.g. https://dashboard.example.com").Default("").OverrideDefaultFromEnvar("TAIL_ALLOWED_ORIGINS").String()
+	streamBacklog = kingpin.Flag("stream-backlog", "Updates kept in memory for /api/stream clients resuming with Last-Event-ID").Default("1000").OverrideDefaultFromEnvar("STREAM_BACKLOG").Int()
+	firehoseWorkers = kingpin.Flag("firehose-workers", "Goroutines processing firehose envelopes").Default("4").OverrideDefaultFromEnvar("FIREHOSE_WORKERS").Int()
+	firehoseQueueSize = kingpin.Flag("firehose-queue-size", "Envelopes queued between the firehose reader and the workers").Default("10000").OverrideDefaultFromEnvar("FIREHOSE_QUEUE_SIZE").Int()
+	usageSources = kingpin.Flag("usage-sources", "Comma separated source types whose log messages count as app usage: RTR, APP/PROC, TASK, STG, API, CELL or SSH. Every source type is still broken down per app").Default("RTR").OverrideDefaultFromEnvar("USAGE_SOURCES").String()
+	maxClockSkew = kingpin.Flag("max-clock-skew", "How far an event's timestamp may be from the nozzle's clock before the event is counted at the time it arrived instead").Default("5m").OverrideDefaultFromEnvar("MAX_CLOCK_SKEW").Duration()
+	recordFile = kingpin.Flag("record-file", "File every firehose envelope is appended to, for the replay command. Nothing is recorded when empty").Default("").OverrideDefaultFromEnvar("RECORD_FILE").String()
+	firehoseOverflow = kingpin.Flag("firehose-overflow", "What to do with envelopes when the queue is full: drop-oldest, drop-newest or block").Default("drop-oldest").OverrideDefaultFromEnvar("FIREHOSE_OVERFLOW").String()
+	resolverBatchSize = kingpin.Flag("resolver-batch-size", "Unknown app GUIDs looked up in the Cloud Controller together").Default("50").OverrideDefaultFromEnvar("RESOLVER_BATCH_SIZE").Int()
+	resolverRetryAfter = kingpin.Flag("resolver-retry-after", "How long an app GUID the Cloud Controller could not resolve is left alone").Default("5m").OverrideDefaultFromEnvar("RESOLVER_RETRY_AFTER").Duration()
+	resolverMaxPending = kingpin.Flag("resolver-max-pending", "Unknown apps whose events are held back until they are resolved").Default("10000").OverrideDefaultFromEnvar("RESOLVER_MAX_PENDING").Int()
+	clusterPeers = kingpin.Flag("cluster-peers", "Comma separated base URLs of the other nozzle instances counts are shared with").Default("").OverrideDefaultFromEnvar("CLUSTER_PEERS").String()
+	clusterPeerTemplate = kingpin.Flag("cluster-peer-template", "Base URL of the other instances of this app with {index} for the instance index, e.g. http://{index}.app-metrics-nozzle.apps.internal:8080").Default("").OverrideDefaultFromEnvar("CLUSTER_PEER_TEMPLATE").String()
+	clusterInstances = kingpin.Flag("cluster-instances", "Instances of this app the peer template is expanded for").Default("0").OverrideDefaultFromEnvar("CLUSTER_INSTANCES").Int()
+	clusterInstanceID = kingpin.Flag("cluster-instance-id", "Name of this instance in the cluster. Defaults to CF_INSTANCE_INDEX or the host name").Default("").OverrideDefaultFromEnvar("CLUSTER_INSTANCE_ID").String()
+	clusterSecret = kingpin.Flag("cluster-secret", "Secret shared by all instances of the cluster").Default("").OverrideDefaultFromEnvar("CLUSTER_SECRET").String()
+	clusterPushInterval = kingpin.Flag("cluster-push-interval", "How often changed counts are pushed to the other instances").Default("5s").OverrideDefaultFromEnvar("CLUSTER_PUSH_INTERVAL").Duration()
+	leaderLeaseFile = kingpin.Flag("leader-lease-file", "File on a volume shared by all instances holding the leader lease. Defaults to electing a leader among the cluster peers").Default("").OverrideDefaultFromEnvar("LEADER_LEASE_FILE").String()
+	leaderLeaseTTL = kingpin.Flag("leader-lease-ttl", "How long a leader that stopped renewing its lease keeps it before another instance takes over").Default("30s").OverrideDefaultFromEnvar("LEADER_LEASE_TTL").Duration()
+	eventSinks = kingpin.Flag("event-sinks", "Space separated URLs of sinks decorated events are forwarded to: syslog[+tls]://host:port, json[+tls]://host:port, kafka[+tls]://broker:port/topic").Default("").OverrideDefaultFromEnvar("EVENT_SINKS").String()
+	eventSinkTypes = kingpin.Flag("event-sink-types", "Comma separated event or source types forwarded to sinks without a types parameter, e.g. RTR,ContainerMetric. Empty forwards all").Default("").OverrideDefaultFromEnvar("EVENT_SINK_TYPES").String()
+	eventSinkQueueSize = kingpin.Flag("event-sink-queue-size", "Events each sink queues before dropping").Default("10000").OverrideDefaultFromEnvar("EVENT_SINK_QUEUE_SIZE").Int()
+	eventSinkBatchSize = kingpin.Flag("event-sink-batch-size", "Events each sink writes at once").Default("100").OverrideDefaultFromEnvar("EVENT_SINK_BATCH_SIZE").Int()
+	eventSinkFlushInterval = kingpin.Flag("event-sink-flush-interval", "Longest time an event waits for its batch to fill").Default("1s").OverrideDefaultFromEnvar("EVENT_SINK_FLUSH_INTERVAL").Duration()
+	auditLogFile = kingpin.Flag("audit-log-file", "File API access is audited to as JSON lines. Auditing is disabled when empty").Default("").OverrideDefaultFromEnvar("AUDIT_LOG_FILE").String()
+	auditLogMaxSize = kingpin.Flag("audit-log-max-size", "Size in bytes at which the audit log file is rotated").Default("104857600").OverrideDefaultFromEnvar("AUDIT_LOG_MAX_SIZE").Int64()
+	auditLogMaxBackups = kingpin.Flag("audit-log-max-backups", "Rotated audit log files to keep").Default("5").OverrideDefaultFromEnvar("AUDIT_LOG_MAX_BACKUPS").Int()
+	auditBolt = kingpin.Flag("audit-bolt", "Also keep audit events in the bolt database").Default("false").OverrideDefaultFromEnvar("AUDIT_BOLT").Bool()
+	auditRetention = kingpin.Flag("audit-retention", "How long audit events are kept in the bolt database").Default("720h").OverrideDefaultFromEnvar("AUDIT_RETENTION").Duration()
+	alertRulesFile = kingpin.Flag("alert-rules-file", "JSON file with alerting rules. Alerting is disabled when empty").Default("").OverrideDefaultFromEnvar("ALERT_RULES_FILE").String()
+	alertInterval = kingpin.Flag("alert-evaluation-interval", "How often alerting rules are evaluated").Default("60s").OverrideDefaultFromEnvar("ALERT_EVALUATION_INTERVAL").Duration()
+	emailSubject = kingpin.Flag("email-subject", "Report email's subject.").Default("Report").OverrideDefaultFromEnvar("EMAIL_SUBJECT").String()
+	emailBody = kingpin.Flag("email-body", "Report email's body.").Default("Please find attachment for the report.").OverrideDefaultFromEnvar("EMAIL_BODY").String()
+	emailSender = kingpin.Flag("email-sender", "Report sender name.").Default("Admin").OverrideDefaultFromEnvar("EMAIL_SENDER").String()
+	emailReceiver = kingpin.Flag("email-receiver", "Report receiver email address.").Default("user@email.com").OverrideDefaultFromEnvar("EMAIL_RECEIVER").String()
+	emailServerHost = kingpin.Flag("email-server-host", "SMTP server address.").Default("localhost").OverrideDefaultFromEnvar("EMAIL_SERVER_HOST").String()
+	emailServerPort = kingpin.Flag("email-server-port", "SMTP server port.").Default("25").OverrideDefaultFromEnvar("EMAIL_SERVER_PORT").String()
+	emailAttachmentName = kingpin.Flag("email-attachment-name", "Report name.").Default("Report.csv").OverrideDefaultFromEnvar("EMAIL_ATTACHMENT_NAME").String()
+	emailUserName = kingpin.Flag("email-user-name", "Report sender's email address.").Default("admin@email.com").OverrideDefaultFromEnvar("EMAIL_USER_NAME").String()
+	emailUserPassword = kingpin.Flag("email-user-password", "Report sender's email account password.").Default("password").OverrideDefaultFromEnvar("EMAIL_USER_PASSWORD").String()
+	reportTimeZone = kingpin.Flag("report-time-zone", "Time zone of the report").Default("Australia/Sydney").OverrideDefaultFromEnvar("REPORT_TIME_ZONE").String()
+	reportFilter = kingpin.Flag("report-filter", "Filter expression selecting the apps in the scheduled report, e.g. 'last_event_time < now-30d'").Default("").OverrideDefaultFromEnvar("REPORT_FILTER").String()
 )
 
 const (
@@ -56,6 +154,38 @@ const (
 var logger = log.New(os.Stdout, "", 0)
 
 func main() {
+	kingpin.Version(version)
+	command := kingpin.Parse()
+
+	// Only serving needs the Cloud Controller; the other commands work from the bolt database alone
+	var required []string
+	if command == serveCommand.FullCommand() {
+		required = append(required, "cloud_controller.api_endpoint")
+	}
+	settings, err := config.NewStore(kingpin.CommandLine, os.Args[1:], *configFile, config.Settings)
+	if err != nil {
+		logger.Fatal("Error reading configuration: ", err)
+	}
+	if err := settings.Load(required...); err != nil {
+		logger.Fatal("Invalid configuration:\n", err)
+	}
+	service.Config = settings
+	service.SetReportSettings(reportSettings())
+
+	switch command {
+	case reportCommand.FullCommand():
+		runReport()
+		return
+	case exportCommand.FullCommand():
+		runExport()
+		return
+	case inspectCommand.FullCommand():
+		runInspect()
+		return
+	case replayCommand.FullCommand():
+		runReplay()
+		return
+	}
 
 	banner.Print("metrics usage nozzle")
 	port := os.Getenv("PORT")
@@ -63,17 +193,92 @@ func main() {
 		port = "3000"
 	}
 
+	logger.Println(fmt.Sprintf("Starting app-metrics-nozzle %s ", version))
+
+	credentials, err := loadCredentials()
+	if err != nil {
+		logger.Fatal("Error loading API credentials: ", err)
+	}
+	if len(credentials) == 0 && len(*uaaTokenKeysURL) == 0 && len(*tlsClientIdentitiesFile) == 0 {
+		logger.Fatal("No API credentials configured. Set API_KEY and API_SECRET, API_CREDENTIALS_FILE, UAA_TOKEN_KEYS_URL or TLS_CLIENT_IDENTITIES_FILE")
+	}
+
+	var certificates *service.CertificateReloader
+	if len(*tlsCertFile) > 0 || len(*tlsKeyFile) > 0 {
+		certificates, err = service.NewCertificateReloader(service.TLSOptions{CertFile: *tlsCertFile, KeyFile: *tlsKeyFile, ClientCAFile: *tlsClientCAFile, RequireClientCert: *tlsRequireClientCert})
+		if err != nil {
+			logger.Fatal("Error loading TLS certificate: ", err)
+		}
+		go certificates.Watch(*tlsReloadInterval)
+	} else if len(*tlsClientCAFile) > 0 || len(*tlsClientIdentitiesFile) > 0 {
+		logger.Fatal("Client certificates require TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+
+	// When we terminate TLS ourselves there is no excuse for accepting keys over plain HTTP
+	auth := service.AuthConfig{Credentials: restgate.NewCredentialStore(credentials), RequireHTTPS: *apiRequireHTTPS || certificates != nil}
+	if len(*tlsClientIdentitiesFile) > 0 {
+		if len(*tlsClientCAFile) == 0 {
+			logger.Fatal("TLS_CLIENT_IDENTITIES_FILE requires TLS_CLIENT_CA_FILE")
+		}
+		identities, err := restgate.LoadCertificateIdentitiesFile(*tlsClientIdentitiesFile)
+		if err != nil {
+			logger.Fatal("Error loading client certificate identities: ", err)
+		}
+		auth.CertificateMapper = restgate.NewCertificateMapper(identities)
+	}
+	if len(*apiAuthorizationFile) > 0 {
+		grants, err := service.LoadAuthorizationFile(*apiAuthorizationFile)
+		if err != nil {
+			logger.Fatal("Error loading API authorization: ", err)
+		}
+		auth.Authorization = service.NewAuthorizer(grants)
+	}
+	if *apiSignatureMaxSkew > 0 {
+		auth.SignatureVerifier = restgate.NewSignatureVerifier(auth.Credentials, *apiSignatureMaxSkew)
+	}
+	if *apiRateLimit > 0 {
+		auth.RateLimiter = restgate.NewRateLimiter(*apiRateLimit, *apiRateBurst)
+	}
+	if *apiFailureRateLimit > 0 {
+		auth.FailureLimiter = restgate.NewRateLimiter(*apiFailureRateLimit, *apiFailureBurst)
+	}
+	auth.TrustedProxies = *apiTrustedProxies
+	go reloadOnHangup(auth)
+
+	if len(*uaaTokenKeysURL) > 0 {
+		httpClient := &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: *skipSSLValidation}},
+		}
+		auth.TokenVerifier = restgate.NewTokenVerifier(*uaaTokenKeysURL, *uaaAudience, splitList(*uaaScopes), httpClient)
+		logger.Println(fmt.Sprintf("Accepting UAA bearer tokens verified against %s", *uaaTokenKeysURL))
+	}
+
+	service.LegacyAppMap = *apiLegacyAppMap
+	if *streamThrottle > 0 {
+		usageevents.Stream = stream.NewBroker(*streamThrottle, *streamBacklog)
+		go usageevents.Stream.Run(*streamThrottle / 4)
+	}
+	if *tailBuffer > 0 {
+		service.TailBuffer = *tailBuffer
+		service.TailAllowedOrigins = splitList(*tailAllowedOrigins)
+		usageevents.Tail = stream.NewTail()
+	}
+	overflow, err := usageevents.ParseOverflowPolicy(*firehoseOverflow)
+	if err != nil {
+		logger.Fatal("Error configuring firehose pipeline: ", err)
+	}
+
 	// Start web server
 	go func() {
-		server := service.NewServer()
-		server.Run(":" + port)
+		server := service.NewServer(auth)
+		if certificates == nil {
+			server.Run(":" + port)
+		} else {
+			logger.Fatal(service.ListenAndServeTLS(":"+port, server, certificates))
+		}
 	}()
 
-	kingpin.Version(version)
-	kingpin.Parse()
-
-	logger.Println(fmt.Sprintf("Starting app-metrics-nozzle %s ", version))
-
 	c := goClient.Config{
 		ApiAddress:        *apiEndpoint,
 		Username:          *user,
@@ -97,12 +302,74 @@ func main() {
 
 	defer db.Close()
 
+	if *stateSaveInterval > 0 {
+		go saveStateEvery(db, *stateSaveInterval)
+	}
+
+	var auditSinks []audit.Sink
+	if len(*auditLogFile) > 0 {
+		fileSink, err := audit.NewFileSink(*auditLogFile, *auditLogMaxSize, *auditLogMaxBackups)
+		if err != nil {
+			logger.Fatal("Error opening audit log: ", err)
+		}
+		auditSinks = append(auditSinks, fileSink)
+	}
+	if *auditBolt {
+		boltSink, err := audit.NewBoltSink(db, *auditRetention)
+		if err != nil {
+			logger.Fatal("Error creating audit bucket: ", err)
+		}
+		// Queries are answered from the first queryable sink, and bolt answers them cheaper than scanning files
+		auditSinks = append([]audit.Sink{boltSink}, auditSinks...)
+	}
+	if len(auditSinks) > 0 {
+		service.AuditLog = audit.NewLog(auditSinks...)
+	}
+
 	caching.SetCfClient(cfClient)
 	caching.SetAppDb(db)
 	caching.CreateBucket()
 
 	api.Client = cfClient
 
+	usageevents.DeletedAppRetention = *deletedAppRetention
+
+	peers := splitList(*clusterPeers)
+	if len(*clusterPeerTemplate) > 0 {
+		ownIndex, err := strconv.Atoi(os.Getenv("CF_INSTANCE_INDEX"))
+		if err != nil {
+			logger.Fatal("CLUSTER_PEER_TEMPLATE needs CF_INSTANCE_INDEX: ", err)
+		}
+		peers = append(peers, cluster.PeersFromTemplate(*clusterPeerTemplate, *clusterInstances, ownIndex)...)
+	}
+	if len(peers) > 0 {
+		if len(*clusterSecret) == 0 {
+			logger.Fatal("CLUSTER_SECRET is required when cluster peers are configured")
+		}
+		usageevents.Peers = cluster.NewNode(clusterInstance(), peers, *clusterSecret, usageevents.LocalCounts)
+		if len(*leaderLeaseFile) == 0 {
+			// Peers elect their leader among the instances they heard from recently
+			if *clusterPushInterval > *leaderLeaseTTL/3 {
+				logger.Fatal("CLUSTER_PUSH_INTERVAL must be at most a third of LEADER_LEASE_TTL")
+			}
+			usageevents.Peers.Heartbeat = *leaderLeaseTTL / 3
+		}
+		go usageevents.Peers.Run(*clusterPushInterval)
+		logger.Println(fmt.Sprintf("Sharing counts as instance %s with %d peers every %s", usageevents.Peers.ID, len(peers), *clusterPushInterval))
+	}
+
+	// Scheduled reports and alert notifications go out from one instance only
+	var lease cluster.Lease
+	if len(*leaderLeaseFile) > 0 {
+		lease = cluster.FileLease{Path: *leaderLeaseFile}
+	} else if usageevents.Peers != nil {
+		lease = cluster.PeerLease{Node: usageevents.Peers}
+	}
+	if lease != nil {
+		service.Leader = cluster.NewElector(clusterInstance(), lease, *leaderLeaseTTL)
+		go service.Leader.Run()
+	}
+
 	//Let's Update the database the first time
 	usageevents.ReloadApps(caching.GetAllApp())
 	reloadEnvDetails()
@@ -112,6 +379,8 @@ func main() {
 	// Ticker Polling the CC every X sec
 	ccPolling := time.NewTicker(*tickerTime)
 
+	// Peers share counts, not the app directory, so every instance polls to see renames, moves, deletions and new
+	// orgs and spaces. Nothing polled here is sent anywhere, so it isn't duplicated by scaling out
 	go func() {
 		for range ccPolling.C {
 			now := time.Now()
@@ -127,27 +396,241 @@ func main() {
 	go func() {
 		for range reportGeneration.C {
 			now := time.Now()
+			if !service.Leader.IsLeader() {
+				logger.Print("Report generation left to the cluster leader ---> " + now.Format(time.RFC3339))
+				continue
+			}
 			logger.Print("Report generation triggered ---> " + now.Format(time.RFC3339))
-			reportData := service.GenerateReport()
-			err := service.SendReport(reportData)
+			status := http.StatusOK
+			appFilter, err := service.ReportFilter()
+			if err == nil {
+				err = service.SendReport(service.GenerateReport(appFilter))
+			}
 			if err != nil {
 				logger.Println(err)
+				status = http.StatusInternalServerError
 			}
+			service.AuditLog.Record(audit.Event{Time: now, Identity: "scheduler", Method: "SEND", Route: "scheduled report", Status: status})
 		}
 	}()
 	
+	// Alert rules evaluated every X seconds
+	if len(*alertRulesFile) > 0 {
+		rules, err := alerting.LoadRules(*alertRulesFile)
+		if err != nil {
+			logger.Fatal("Error loading alert rules: ", err)
+		}
+		store, err := alerting.NewBoltStore(db)
+		if err != nil {
+			logger.Fatal("Error creating alerts bucket: ", err)
+		}
+		// Every instance evaluates the rules so that all of them show the same alerts, but only the leader notifies
+		notify := func(subject string, body string) error {
+			if !service.Leader.IsLeader() {
+				return nil
+			}
+			return service.SendNotification(subject, body)
+		}
+		service.AlertEngine = alerting.NewEngine(rules, store, notify)
+		go service.AlertEngine.Run(*alertInterval, usageevents.AppDetailsSnapshot)
+		logger.Println(fmt.Sprintf("Evaluating %d alert rules every %s", len(rules), *alertInterval))
+	}
+
+	sinkOptions := usageevents.SinkOptions{
+		Types:         splitList(*eventSinkTypes),
+		QueueSize:     *eventSinkQueueSize,
+		BatchSize:     *eventSinkBatchSize,
+		FlushInterval: *eventSinkFlushInterval,
+		TLSConfig:     &tls.Config{InsecureSkipVerify: *skipSSLValidation},
+	}
+	for _, sinkURL := range strings.Fields(*eventSinks) {
+		sink, err := usageevents.NewSink(sinkURL, sinkOptions)
+		if err != nil {
+			logger.Fatal("Error creating event sink: ", err)
+		}
+		usageevents.Sinks = append(usageevents.Sinks, sink)
+		logger.Println(fmt.Sprintf("Forwarding events to %s", sink))
+	}
+
+	usageevents.MaxClockSkew = *maxClockSkew
+	usageevents.UsageSources = parseUsageSources()
+	usageevents.AppResolver = usageevents.NewResolver(usageevents.ResolverOptions{BatchSize: *resolverBatchSize, RetryAfter: *resolverRetryAfter, MaxPending: *resolverMaxPending})
+	usageevents.FirehosePipeline = usageevents.NewPipeline(usageevents.PipelineOptions{Workers: *firehoseWorkers, QueueSize: *firehoseQueueSize, Policy: overflow})
+
 	token, _ := cfClient.GetToken()
 
 	firehose := firehose.CreateFirehoseChan(cfClient.Endpoint.DopplerEndpoint, token, *subscriptionID, *skipSSLValidation, consumer.KeepAlive)
 	if firehose != nil {
-		usageevents.ProcessEvents(firehose)
+		if len(*recordFile) > 0 {
+			recorder, err := recording.Create(*recordFile)
+			if err != nil {
+				logger.Fatal("Error opening record file: ", err)
+			}
+			defer recorder.Close()
+			go closeRecordingOnTerminate(recorder)
+			firehose = recorder.Tee(firehose)
+			logger.Println(fmt.Sprintf("Recording envelopes to %s", *recordFile))
+		}
+		usageevents.FirehosePipeline.Run(firehose)
 		logger.Println("Firehose Subscription Succesfull! Routing events...")
+		for _, sink := range usageevents.Sinks {
+			sink.Close()
+		}
+		if err := state.Save(db, usageevents.AllAppDetailsSnapshot(), time.Now()); err != nil {
+			logger.Println("Error saving app usage:", err)
+		}
 	} else {
 		logger.Fatal("Failed connecting to Firehose...Please check settings and try again!")
 	}
 }
 
+// parseUsageSources reads --usage-sources, which the configuration has validated already.
+func parseUsageSources() map[string]bool {
+	sources, err := usageevents.ParseUsageSources(*usageSources)
+	if err != nil {
+		logger.Fatal("Error configuring usage sources: ", err)
+	}
+	return sources
+}
+
 func reloadEnvDetails() {
 	usageevents.Orgs = api.OrgsDetailsFromCloudController()
 	usageevents.Spaces = api.SpacesDetailsFromCloudController()
-}
\ No newline at end of file
+}
+
+// loadCredentials combines the credentials file with the key and secret given as flags.
+func loadCredentials() ([]restgate.Credential, error) {
+	var credentials []restgate.Credential
+
+	if len(*apiCredentialsFile) > 0 {
+		fromFile, err := restgate.LoadCredentialsFile(*apiCredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, fromFile...)
+	}
+
+	if len(*apiKey) > 0 {
+		if len(*apiSecret) == 0 {
+			return nil, fmt.Errorf("--api-key requires --api-secret")
+		}
+		for _, credential := range credentials {
+			if credential.Key == *apiKey {
+				return nil, fmt.Errorf("--api-key %s is also in the credentials file; remove one of them", *apiKey)
+			}
+		}
+		hash, err := restgate.HashSecret(*apiSecret)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, restgate.Credential{Name: *apiKey, Description: "from --api-key", Key: *apiKey, SecretHash: hash})
+	}
+
+	return credentials, nil
+}
+
+// reportSettings collects the report and notification settings from their flags.
+func reportSettings() service.ReportSettings {
+	return service.ReportSettings{
+		Subject:        *emailSubject,
+		Body:           *emailBody,
+		AttachmentName: *emailAttachmentName,
+		TimeZone:       *reportTimeZone,
+		Filter:         *reportFilter,
+		Sender:         *emailSender,
+		Receiver:       *emailReceiver,
+		ServerHost:     *emailServerHost,
+		ServerPort:     *emailServerPort,
+		UserName:       *emailUserName,
+		UserPassword:   *emailUserPassword,
+	}
+}
+
+// reloadOnHangup re-reads the configuration file, credentials, certificate identities and grants on SIGHUP, keeping the current ones if the new ones are unusable.
+// closeRecordingOnTerminate flushes and closes the recording when the process is told to stop, so the
+// envelopes still buffered reach the file and it doesn't end in a torn record.
+func closeRecordingOnTerminate(recorder *recording.Writer) {
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM, os.Interrupt)
+	received := <-terminate
+
+	if err := recorder.Close(); err != nil {
+		logger.Println("Error closing record file:", err)
+	}
+	logger.Println(fmt.Sprintf("Recording closed on %s", received))
+	os.Exit(0)
+}
+
+func reloadOnHangup(auth service.AuthConfig) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		changed, restart, err := service.Config.Reload()
+		if err != nil {
+			logger.Println("Error reloading configuration, keeping the current one:\n", err)
+		} else {
+			service.SetReportSettings(reportSettings())
+			if len(changed) > 0 {
+				logger.Println(fmt.Sprintf("Reloaded configuration, changed %s", strings.Join(changed, ", ")))
+			}
+			if len(restart) > 0 {
+				logger.Println(fmt.Sprintf("Restart to apply the changes to %s", strings.Join(restart, ", ")))
+			}
+		}
+
+		credentials, err := loadCredentials()
+		if err != nil {
+			logger.Println("Error reloading API credentials, keeping the current ones:", err)
+		} else if len(credentials) == 0 {
+			logger.Println("Reloaded API credentials are empty, keeping the current ones")
+		} else {
+			auth.Credentials.Replace(credentials)
+			logger.Println(fmt.Sprintf("Reloaded %d API credentials", len(credentials)))
+		}
+
+		if auth.CertificateMapper != nil {
+			identities, err := restgate.LoadCertificateIdentitiesFile(*tlsClientIdentitiesFile)
+			if err != nil {
+				logger.Println("Error reloading client certificate identities, keeping the current ones:", err)
+			} else {
+				auth.CertificateMapper.Replace(identities)
+				logger.Println(fmt.Sprintf("Reloaded %d client certificate identities", len(identities)))
+			}
+		}
+
+		if auth.Authorization != nil {
+			grants, err := service.LoadAuthorizationFile(*apiAuthorizationFile)
+			if err != nil {
+				logger.Println("Error reloading API authorization, keeping the current grants:", err)
+			} else {
+				auth.Authorization.Replace(grants)
+				logger.Println(fmt.Sprintf("Reloaded grants for %d identities", len(grants)))
+			}
+		}
+	}
+}
+
+// clusterInstance names this instance in the cluster: the configured ID, the Cloud Foundry instance index
+// or the host name.
+func clusterInstance() string {
+	if len(*clusterInstanceID) > 0 {
+		return *clusterInstanceID
+	}
+	if index := os.Getenv("CF_INSTANCE_INDEX"); len(index) > 0 {
+		return index
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package recording writes firehose envelopes to a file and replays them, so aggregation can be
+// reproduced from recorded traffic.
+//
+// A recording starts with the header "app-metrics-nozzle recording v1\n". Each envelope follows as the
+// time it was received in nanoseconds since the epoch (8 bytes, big endian), the length of the envelope
+// (uvarint) and the envelope's protobuf encoding.
+package recording
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var logger = log.New(os.Stdout, "", 0)
+
+const header = "app-metrics-nozzle recording v1\n"
+
+// maxEnvelopeSize guards against reading garbage as a huge length.
+const maxEnvelopeSize = 16 << 20
+
+// ErrNotRecording is returned for files that do not start with the recording header.
+var ErrNotRecording = errors.New("not an envelope recording")
+
+// Writer appends envelopes to a recording.
+type Writer struct {
+	out    *bufio.Writer
+	closer io.Closer
+	mutex  sync.Mutex
+	buf    []byte
+}
+
+// NewWriter starts a recording on w.
+func NewWriter(w io.Writer) (*Writer, error) {
+	writer := &Writer{out: bufio.NewWriter(w)}
+	if _, err := writer.out.WriteString(header); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Create opens the recording at path, appending to it if it already holds envelopes.
+func Create(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var writer *Writer
+	if info.Size() == 0 {
+		writer, err = NewWriter(file)
+	} else if err = dropTornRecord(file, info.Size()); err == nil {
+		writer = &Writer{out: bufio.NewWriter(file)}
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	writer.closer = file
+	return writer, nil
+}
+
+// dropTornRecord truncates a recording to its last complete record, so envelopes appended to it can be read
+// back. A run that died before flushing can leave a record cut short at the end.
+func dropTornRecord(file *os.File, size int64) error {
+	reader, err := NewReader(io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return err
+	}
+	for {
+		_, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			logger.Println(fmt.Sprintf("Dropping the %d bytes after the last complete record of %s: %s", size-reader.offset, file.Name(), err))
+			return file.Truncate(reader.offset)
+		}
+	}
+}
+
+// Write appends an envelope received at receivedAt.
+func (w *Writer) Write(envelope *events.Envelope, receivedAt time.Time) error {
+	data, err := envelope.Marshal()
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buf = w.buf[:0]
+	w.buf = append(w.buf, make([]byte, 8+binary.MaxVarintLen64)...)
+	binary.BigEndian.PutUint64(w.buf, uint64(receivedAt.UnixNano()))
+	n := binary.PutUvarint(w.buf[8:], uint64(len(data)))
+	if _, err := w.out.Write(w.buf[:8+n]); err != nil {
+		return err
+	}
+	_, err = w.out.Write(data)
+	return err
+}
+
+// Flush writes buffered envelopes to the file.
+func (w *Writer) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.out.Flush()
+}
+
+// Close flushes the recording and closes its file.
+func (w *Writer) Close() error {
+	err := w.Flush()
+	if w.closer != nil {
+		if closeErr := w.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Tee records every envelope of in while passing it on. Recording stops at the first write error, but
+// envelopes keep flowing. The returned channel closes when in does.
+func (w *Writer) Tee(in <-chan *events.Envelope) <-chan *events.Envelope {
+	out := make(chan *events.Envelope, cap(in))
+	go func() {
+		defer close(out)
+		recording := true
+		for envelope := range in {
+			if recording {
+				err := w.Write(envelope, time.Now())
+				if err == nil && len(in) == 0 {
+					// Nothing waiting, so this is a good moment to get the buffer to disk
+					err = w.Flush()
+				}
+				if err != nil {
+					logger.Println("Error recording envelopes, recording stopped:", err)
+					recording = false
+				}
+			}
+			out <- envelope
+		}
+	}()
+	return out
+}
+
+// Record is an envelope read from a recording.
+type Record struct {
+	ReceivedAt time.Time
+	Envelope   *events.Envelope
+}
+
+// Reader reads envelopes from a recording.
+type Reader struct {
+	in     *bufio.Reader
+	offset int64 //End of the last complete record
+}
+
+// NewReader reads the recording on r.
+func NewReader(r io.Reader) (*Reader, error) {
+	in := bufio.NewReader(r)
+	if err := checkHeader(in); err != nil {
+		return nil, err
+	}
+	return &Reader{in: in, offset: int64(len(header))}, nil
+}
+
+// Next returns the next envelope, or io.EOF at the end of the recording.
+func (r *Reader) Next() (Record, error) {
+	var stamp [8]byte
+	if _, err := io.ReadFull(r.in, stamp[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("truncated record")
+		}
+		return Record{}, err
+	}
+	size, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return Record{}, fmt.Errorf("truncated record: %s", err)
+	}
+	if size > maxEnvelopeSize {
+		return Record{}, fmt.Errorf("envelope of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r.in, data); err != nil {
+		return Record{}, fmt.Errorf("truncated record: %s", err)
+	}
+
+	envelope := &events.Envelope{}
+	if err := envelope.Unmarshal(data); err != nil {
+		return Record{}, fmt.Errorf("invalid envelope: %s", err)
+	}
+	var length [binary.MaxVarintLen64]byte
+	r.offset += int64(len(stamp) + binary.PutUvarint(length[:], size) + len(data))
+	return Record{ReceivedAt: time.Unix(0, int64(binary.BigEndian.Uint64(stamp[:]))), Envelope: envelope}, nil
+}
+
+func checkHeader(in *bufio.Reader) error {
+	start := make([]byte, len(header))
+	if _, err := io.ReadFull(in, start); err != nil || string(start) != header {
+		return ErrNotRecording
+	}
+	return nil
+}
+
+// Clock follows the time the replayed envelopes were received, which is what the nozzle's clock read when
+// it processed them live. Events are still timed by their own timestamps, checked against this clock.
+// It never goes backwards.
+type Clock struct {
+	nanos int64
+}
+
+// Now returns when the latest envelope replayed was received.
+func (c *Clock) Now() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.nanos))
+}
+
+// Advance moves the clock to t unless it is already later.
+func (c *Clock) Advance(t time.Time) {
+	for {
+		current := atomic.LoadInt64(&c.nanos)
+		if t.UnixNano() <= current || atomic.CompareAndSwapInt64(&c.nanos, current, t.UnixNano()) {
+			return
+		}
+	}
+}
+
+// Replay hands every envelope of the recording to process in order and returns how many there were.
+// With a speed of 1 the envelopes are paced as they were received, 2 replays twice as fast and 0 as fast
+// as possible. The clock, if given, is advanced to each envelope's receive time before it is processed.
+func Replay(r *Reader, speed float64, clock *Clock, process func(*events.Envelope)) (int, error) {
+	var count int
+	var first time.Time
+	started := time.Now()
+
+	for {
+		record, err := r.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("record %d: %s", count+1, err)
+		}
+
+		if speed > 0 {
+			if first.IsZero() {
+				first = record.ReceivedAt
+			}
+			due := started.Add(time.Duration(float64(record.ReceivedAt.Sub(first)) / speed))
+			if wait := due.Sub(time.Now()); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		if clock != nil {
+			clock.Advance(record.ReceivedAt)
+		}
+		process(record.Envelope)
+		count++
+	}
+}
@@ -0,0 +1,202 @@
+package recording_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/recording"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var _ = Describe("Recording", func() {
+	var start time.Time
+
+	envelope := func(appID string, timestamp time.Time) *events.Envelope {
+		eventType := events.Envelope_LogMessage
+		origin := "gorouter"
+		sourceType := "RTR"
+		nanos := timestamp.UnixNano()
+		return &events.Envelope{
+			Origin:     &origin,
+			EventType:  &eventType,
+			Timestamp:  &nanos,
+			LogMessage: &events.LogMessage{AppId: &appID, SourceType: &sourceType, Message: []byte("GET / 200")},
+		}
+	}
+
+	readAll := func(data []byte) []recording.Record {
+		reader, err := recording.NewReader(bytes.NewReader(data))
+		Expect(err).NotTo(HaveOccurred())
+		var records []recording.Record
+		for {
+			record, err := reader.Next()
+			if err == io.EOF {
+				return records
+			}
+			Expect(err).NotTo(HaveOccurred())
+			records = append(records, record)
+		}
+	}
+
+	BeforeEach(func() {
+		start = time.Date(2016, 10, 19, 12, 0, 0, 0, time.UTC)
+	})
+
+	It("reads back what was written", func() {
+		var buf bytes.Buffer
+		writer, err := recording.NewWriter(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writer.Write(envelope("a", start), start.Add(time.Second))).To(Succeed())
+		Expect(writer.Write(envelope("b", start.Add(time.Minute)), start.Add(time.Minute))).To(Succeed())
+		Expect(writer.Close()).To(Succeed())
+
+		records := readAll(buf.Bytes())
+		Expect(records).To(HaveLen(2))
+		Expect(records[0].Envelope.GetLogMessage().GetAppId()).To(Equal("a"))
+		Expect(records[0].ReceivedAt.Equal(start.Add(time.Second))).To(BeTrue())
+		Expect(records[1].Envelope.GetLogMessage().GetAppId()).To(Equal("b"))
+	})
+
+	It("rejects files that are not recordings", func() {
+		_, err := recording.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n"))
+		Expect(err).To(Equal(recording.ErrNotRecording))
+	})
+
+	It("reports a truncated record", func() {
+		var buf bytes.Buffer
+		writer, _ := recording.NewWriter(&buf)
+		writer.Write(envelope("a", start), start)
+		writer.Close()
+
+		reader, err := recording.NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = reader.Next()
+		Expect(err).To(MatchError(ContainSubstring("truncated")))
+	})
+
+	Describe("Create", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "recording")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("appends to an existing recording", func() {
+			path := filepath.Join(dir, "firehose.rec")
+			for _, appID := range []string{"a", "b"} {
+				writer, err := recording.Create(path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(writer.Write(envelope(appID, start), start)).To(Succeed())
+				Expect(writer.Close()).To(Succeed())
+			}
+
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			records := readAll(data)
+			Expect(records).To(HaveLen(2))
+			Expect(records[1].Envelope.GetLogMessage().GetAppId()).To(Equal("b"))
+		})
+
+		It("drops a record torn by a run that died before appending", func() {
+			path := filepath.Join(dir, "firehose.rec")
+			writer, err := recording.Create(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Write(envelope("a", start), start)).To(Succeed())
+			Expect(writer.Write(envelope("torn", start), start)).To(Succeed())
+			Expect(writer.Close()).To(Succeed())
+			info, err := os.Stat(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.Truncate(path, info.Size()-3)).To(Succeed())
+
+			writer, err = recording.Create(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(writer.Write(envelope("b", start), start)).To(Succeed())
+			Expect(writer.Close()).To(Succeed())
+
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			records := readAll(data)
+			Expect(records).To(HaveLen(2))
+			Expect(records[0].Envelope.GetLogMessage().GetAppId()).To(Equal("a"))
+			Expect(records[1].Envelope.GetLogMessage().GetAppId()).To(Equal("b"))
+		})
+
+		It("refuses to append to another kind of file", func() {
+			path := filepath.Join(dir, "notes.txt")
+			Expect(ioutil.WriteFile(path, []byte("not a recording at all, honestly"), 0600)).To(Succeed())
+			_, err := recording.Create(path)
+			Expect(err).To(MatchError(ContainSubstring("not an envelope recording")))
+		})
+	})
+
+	It("records envelopes passing through a tee", func() {
+		var buf bytes.Buffer
+		writer, _ := recording.NewWriter(&buf)
+
+		in := make(chan *events.Envelope, 2)
+		in <- envelope("a", start)
+		in <- envelope("b", start)
+		close(in)
+
+		var passed []string
+		for e := range writer.Tee(in) {
+			passed = append(passed, e.GetLogMessage().GetAppId())
+		}
+		Expect(passed).To(Equal([]string{"a", "b"}))
+		Expect(writer.Close()).To(Succeed())
+		Expect(readAll(buf.Bytes())).To(HaveLen(2))
+	})
+
+	Describe("Replay", func() {
+		var data []byte
+
+		BeforeEach(func() {
+			var buf bytes.Buffer
+			writer, _ := recording.NewWriter(&buf)
+			writer.Write(envelope("a", start), start)
+			// Emitted early by a component with a slow clock
+			writer.Write(envelope("b", start.Add(-time.Hour)), start.Add(100*time.Millisecond))
+			writer.Write(envelope("c", start.Add(200*time.Millisecond)), start.Add(200*time.Millisecond))
+			writer.Close()
+			data = buf.Bytes()
+		})
+
+		It("processes every envelope in order with the clock following their receive times", func() {
+			reader, _ := recording.NewReader(bytes.NewReader(data))
+			clock := &recording.Clock{}
+			var seen []string
+			var times []time.Time
+			count, err := recording.Replay(reader, 0, clock, func(e *events.Envelope) {
+				seen = append(seen, e.GetLogMessage().GetAppId())
+				times = append(times, clock.Now())
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(count).To(Equal(3))
+			Expect(seen).To(Equal([]string{"a", "b", "c"}))
+			Expect(times[0].Equal(start)).To(BeTrue())
+			Expect(times[1].Equal(start.Add(100 * time.Millisecond))).To(BeTrue())
+			Expect(times[2].Equal(start.Add(200 * time.Millisecond))).To(BeTrue())
+		})
+
+		It("paces envelopes as recorded, divided by the speed", func() {
+			reader, _ := recording.NewReader(bytes.NewReader(data))
+			began := time.Now()
+			_, err := recording.Replay(reader, 2, nil, func(*events.Envelope) {})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(time.Since(began)).To(BeNumerically(">=", 100*time.Millisecond))
+		})
+	})
+})
@@ -0,0 +1,89 @@
+package restgate
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+//CertificateIdentity maps a client certificate subject to an API identity.
+//Subject is either the full RFC 2253 distinguished name, e.g. "CN=dashboard,OU=ops,O=Example", or just "CN=dashboard".
+type CertificateIdentity struct {
+	Subject  string `json:"subject"`
+	Identity string `json:"identity"`
+}
+
+//CertificateMapper resolves verified client certificates for AuthenticationSource=ClientCert.
+//Only certificates whose chain was verified by the TLS server are considered, so the TLS listener
+//must be configured with the client CA. The mapping can be replaced at runtime.
+type CertificateMapper struct {
+	identities map[string]string
+	lock       sync.RWMutex
+}
+
+func NewCertificateMapper(identities []CertificateIdentity) *CertificateMapper {
+	m := &CertificateMapper{}
+	m.Replace(identities)
+	return m
+}
+
+//Replace swaps the whole mapping atomically.
+func (m *CertificateMapper) Replace(identities []CertificateIdentity) {
+	bySubject := make(map[string]string, len(identities))
+	for _, identity := range identities {
+		bySubject[identity.Subject] = identity.Identity
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.identities = bySubject
+}
+
+//Len returns the number of mapped subjects.
+func (m *CertificateMapper) Len() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.identities)
+}
+
+//Identity returns the identity of the leaf certificate, preferring a full subject match over a common name match.
+func (m *CertificateMapper) Identity(cert *x509.Certificate) (string, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if identity, ok := m.identities[cert.Subject.String()]; ok {
+		return identity, true
+	}
+	if cert.Subject.CommonName == "" {
+		return "", false
+	}
+	identity, ok := m.identities["CN="+cert.Subject.CommonName]
+	return identity, ok
+}
+
+//LoadCertificateIdentitiesFile reads a JSON array of subject to identity mappings.
+func LoadCertificateIdentitiesFile(path string) ([]CertificateIdentity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var identities []CertificateIdentity
+	if err := json.Unmarshal(data, &identities); err != nil {
+		return nil, fmt.Errorf("parsing certificate identities file %s: %v", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for idx, identity := range identities {
+		if identity.Subject == "" || identity.Identity == "" {
+			return nil, fmt.Errorf("certificate identity %d: subject and identity are required", idx)
+		}
+		if seen[identity.Subject] {
+			return nil, fmt.Errorf("certificate identity %d: duplicate subject %s", idx, identity.Subject)
+		}
+		seen[identity.Subject] = true
+	}
+	return identities, nil
+}
@@ -0,0 +1,89 @@
+package restgate_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/restgate"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Client certificates", func() {
+	var (
+		gate    *restgate.RESTGate
+		mapper  *restgate.CertificateMapper
+		subject string
+	)
+
+	withCertificate := func(name pkix.Name) *http.Request {
+		req, _ := http.NewRequest("GET", "https://nozzle.example.com/api/apps", nil)
+		cert := &x509.Certificate{Subject: name}
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+
+	serve := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		gate.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		return w.Code
+	}
+
+	BeforeEach(func() {
+		subject = ""
+		mapper = restgate.NewCertificateMapper([]restgate.CertificateIdentity{
+			{Subject: "CN=dashboard,OU=ops,O=Example", Identity: "ops-dashboard"},
+			{Subject: "CN=billing", Identity: "billing"},
+		})
+		gate = restgate.New("", "", restgate.ClientCert, restgate.Config{
+			CertificateMapper: mapper,
+			Context:           func(r *http.Request, authenticatedKey string) { subject = authenticatedKey },
+		})
+		Expect(gate).ToNot(BeNil())
+	})
+
+	It("maps the full subject to an identity", func() {
+		Expect(serve(withCertificate(pkix.Name{CommonName: "dashboard", OrganizationalUnit: []string{"ops"}, Organization: []string{"Example"}}))).To(Equal(http.StatusOK))
+		Expect(subject).To(Equal("cert:ops-dashboard"))
+	})
+
+	It("falls back to the common name", func() {
+		Expect(serve(withCertificate(pkix.Name{CommonName: "billing", Organization: []string{"Example"}}))).To(Equal(http.StatusOK))
+		Expect(subject).To(Equal("cert:billing"))
+	})
+
+	It("rejects unmapped certificates", func() {
+		Expect(serve(withCertificate(pkix.Name{CommonName: "dashboard"}))).To(Equal(http.StatusUnauthorized))
+		Expect(subject).To(BeEmpty())
+	})
+
+	It("rejects requests without a verified certificate", func() {
+		req := withCertificate(pkix.Name{CommonName: "billing"})
+		req.TLS.VerifiedChains = nil
+		Expect(serve(req)).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("picks up a replaced mapping", func() {
+		mapper.Replace([]restgate.CertificateIdentity{{Subject: "CN=billing", Identity: "finance"}})
+		Expect(serve(withCertificate(pkix.Name{CommonName: "billing"}))).To(Equal(http.StatusOK))
+		Expect(subject).To(Equal("cert:finance"))
+	})
+
+	It("refuses a mapping file with duplicate subjects", func() {
+		dir, _ := ioutil.TempDir("", "identities")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "identities.json")
+		ioutil.WriteFile(path, []byte(`[{"subject":"CN=a","identity":"a"},{"subject":"CN=a","identity":"b"}]`), 0600)
+
+		_, err := restgate.LoadCertificateIdentitiesFile(path)
+		Expect(err).To(HaveOccurred())
+	})
+})
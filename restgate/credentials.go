@@ -0,0 +1,176 @@
+package restgate
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//Credential is a named API key whose secret is stored as a bcrypt hash.
+//SigningSecret is the shared secret for HMAC signed requests (AuthenticationSource=Signed); it has to be kept in plaintext.
+//A credential needs at least one of the two. A zero Expires means the credential never expires.
+type Credential struct {
+	Name          string    `json:"name"`
+	Description   string    `json:"description"`
+	Key           string    `json:"key"`
+	SecretHash    string    `json:"secret_hash"`
+	SigningSecret string    `json:"signing_secret"`
+	Expires       time.Time `json:"expires"`
+}
+
+//How long a key and secret that passed the bcrypt check are accepted without checking them again.
+const verifiedTTL = time.Minute
+
+//CredentialStore holds the credentials used when AuthenticationSource=Hashed.
+//The set can be replaced at runtime (e.g. on SIGHUP) while requests are being served.
+type CredentialStore struct {
+	credentials []Credential
+	//verified remembers recently checked key/secret pairs by their HMAC, so polling clients don't pay for
+	//bcrypt on every request. Only pairs that passed are kept, so it holds at most one entry per credential
+	verified    map[[sha256.Size]byte]time.Time
+	verifiedKey []byte
+	generation  int
+	lock        sync.RWMutex
+}
+
+func NewCredentialStore(credentials []Credential) *CredentialStore {
+	s := &CredentialStore{verifiedKey: make([]byte, 32)}
+	if _, err := rand.Read(s.verifiedKey); err != nil {
+		panic(err)
+	}
+	s.Replace(credentials)
+	return s
+}
+
+//Replace swaps the whole credential set atomically and forgets the pairs verified against the old one.
+func (s *CredentialStore) Replace(credentials []Credential) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.credentials = credentials
+	s.verified = make(map[[sha256.Size]byte]time.Time)
+	s.generation++
+}
+
+//Len returns the number of configured credentials, including expired ones.
+func (s *CredentialStore) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.credentials)
+}
+
+//Authenticate returns the credential matching key and secret if it has not expired.
+func (s *CredentialStore) Authenticate(key string, secret string, now time.Time) (Credential, bool) {
+	digest := s.digest(key, secret)
+
+	s.lock.RLock()
+	credential, found := s.find(key)
+	verifiedUntil, verified := s.verified[digest]
+	generation := s.generation
+	s.lock.RUnlock()
+
+	if !found || (!credential.Expires.IsZero() && now.After(credential.Expires)) {
+		return Credential{}, false
+	}
+	if verified && now.Before(verifiedUntil) {
+		return credential, true
+	}
+	//bcrypt is slow on purpose; it runs without the lock so a reload isn't held up by it
+	if credential.SecretHash == "" || bcrypt.CompareHashAndPassword([]byte(credential.SecretHash), []byte(secret)) != nil {
+		return Credential{}, false
+	}
+
+	s.lock.Lock()
+	if s.generation == generation {
+		s.verified[digest] = now.Add(verifiedTTL)
+	}
+	s.lock.Unlock()
+	return credential, true
+}
+
+//find returns the credential for key. Must be called with the lock held.
+func (s *CredentialStore) find(key string) (Credential, bool) {
+	for _, credential := range s.credentials {
+		if secureCompare(key, credential.Key) {
+			return credential, true
+		}
+	}
+	return Credential{}, false
+}
+
+func (s *CredentialStore) digest(key string, secret string) [sha256.Size]byte {
+	//The key's length goes first so no other key/secret split gives the same input
+	mac := hmac.New(sha256.New, s.verifiedKey)
+	fmt.Fprintf(mac, "%d:%s%s", len(key), key, secret)
+	var digest [sha256.Size]byte
+	copy(digest[:], mac.Sum(nil))
+	return digest
+}
+
+//SigningCredential returns the unexpired credential for key if it has a signing secret.
+func (s *CredentialStore) SigningCredential(key string, now time.Time) (Credential, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, credential := range s.credentials {
+		if !secureCompare(key, credential.Key) {
+			continue
+		}
+		if credential.SigningSecret == "" || (!credential.Expires.IsZero() && now.After(credential.Expires)) {
+			return Credential{}, false
+		}
+		return credential, true
+	}
+	return Credential{}, false
+}
+
+//HashSecret bcrypt-hashes a plaintext secret for use in Credential.SecretHash.
+func HashSecret(secret string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+//LoadCredentialsFile reads a JSON array of credentials and checks that every entry is usable.
+func LoadCredentialsFile(path string) ([]Credential, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials []Credential
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, fmt.Errorf("parsing credentials file %s: %v", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for idx, credential := range credentials {
+		if credential.Key == "" {
+			return nil, fmt.Errorf("credential %d (%s): key is required", idx, credential.Name)
+		}
+		if seen[credential.Key] {
+			return nil, fmt.Errorf("credential %d (%s): duplicate key", idx, credential.Name)
+		}
+		if credential.SecretHash == "" && credential.SigningSecret == "" {
+			return nil, fmt.Errorf("credential %d (%s): secret_hash or signing_secret is required", idx, credential.Name)
+		}
+		if credential.SecretHash != "" {
+			if _, err := bcrypt.Cost([]byte(credential.SecretHash)); err != nil {
+				return nil, fmt.Errorf("credential %d (%s): secret_hash is not a bcrypt hash: %v", idx, credential.Name, err)
+			}
+		}
+		if credential.Name == "" {
+			credentials[idx].Name = credential.Key
+		}
+		seen[credential.Key] = true
+	}
+	return credentials, nil
+}
@@ -0,0 +1,202 @@
+package restgate_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/restgate"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Credentials", func() {
+	var now time.Time
+
+	// hash uses the cheapest bcrypt cost so the specs stay fast.
+	hash := func(secret string) string {
+		hashed, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.MinCost)
+		Expect(err).ToNot(HaveOccurred())
+		return string(hashed)
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2016, 10, 19, 12, 0, 0, 0, time.UTC)
+	})
+
+	Describe("Authenticate", func() {
+		var store *restgate.CredentialStore
+
+		BeforeEach(func() {
+			store = restgate.NewCredentialStore([]restgate.Credential{
+				{Name: "reporting", Key: "reporting", SecretHash: hash("s3cret")},
+				{Name: "temporary", Key: "temporary", SecretHash: hash("s3cret"), Expires: now.Add(time.Hour)},
+				{Name: "signing-only", Key: "signing-only", SigningSecret: "shared"},
+			})
+		})
+
+		It("accepts the right secret", func() {
+			credential, ok := store.Authenticate("reporting", "s3cret", now)
+			Expect(ok).To(BeTrue())
+			Expect(credential.Name).To(Equal("reporting"))
+		})
+
+		It("accepts a credential until it expires", func() {
+			_, ok := store.Authenticate("temporary", "s3cret", now.Add(time.Hour))
+			Expect(ok).To(BeTrue())
+
+			_, ok = store.Authenticate("temporary", "s3cret", now.Add(time.Hour+time.Second))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("refuses a wrong secret", func() {
+			credential, ok := store.Authenticate("reporting", "guess", now)
+			Expect(ok).To(BeFalse())
+			Expect(credential).To(Equal(restgate.Credential{}))
+		})
+
+		It("refuses an unknown key", func() {
+			_, ok := store.Authenticate("nobody", "s3cret", now)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("remembers a verified secret instead of running bcrypt on every request", func() {
+			costly, err := bcrypt.GenerateFromPassword([]byte("s3cret"), 12)
+			Expect(err).ToNot(HaveOccurred())
+			store.Replace([]restgate.Credential{{Key: "dashboard", SecretHash: string(costly), Expires: now.Add(time.Hour)}})
+
+			started := time.Now()
+			_, ok := store.Authenticate("dashboard", "s3cret", now)
+			Expect(ok).To(BeTrue())
+			checked := time.Since(started)
+
+			started = time.Now()
+			for i := 0; i < 10; i++ {
+				_, ok = store.Authenticate("dashboard", "s3cret", now)
+				Expect(ok).To(BeTrue())
+			}
+			Expect(time.Since(started)).To(BeNumerically("<", checked))
+
+			_, ok = store.Authenticate("dashboard", "guess", now)
+			Expect(ok).To(BeFalse())
+			_, ok = store.Authenticate("dashboard", "s3cret", now.Add(time.Hour+time.Second))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("refuses a key that only has a signing secret", func() {
+			_, ok := store.Authenticate("signing-only", "shared", now)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("Replace", func() {
+		It("swaps the whole set, as on SIGHUP", func() {
+			store := restgate.NewCredentialStore([]restgate.Credential{{Key: "old", SecretHash: hash("old-secret")}})
+			Expect(store.Len()).To(Equal(1))
+
+			store.Replace([]restgate.Credential{
+				{Key: "new", SecretHash: hash("new-secret")},
+				{Key: "other", SecretHash: hash("other-secret")},
+			})
+
+			Expect(store.Len()).To(Equal(2))
+			_, ok := store.Authenticate("old", "old-secret", now)
+			Expect(ok).To(BeFalse())
+			_, ok = store.Authenticate("new", "new-secret", now)
+			Expect(ok).To(BeTrue())
+		})
+
+		It("forgets secrets verified against the old set", func() {
+			store := restgate.NewCredentialStore([]restgate.Credential{{Key: "rotating", SecretHash: hash("old-secret")}})
+			_, ok := store.Authenticate("rotating", "old-secret", now)
+			Expect(ok).To(BeTrue())
+
+			store.Replace([]restgate.Credential{{Key: "rotating", SecretHash: hash("new-secret")}})
+
+			_, ok = store.Authenticate("rotating", "old-secret", now)
+			Expect(ok).To(BeFalse())
+			_, ok = store.Authenticate("rotating", "new-secret", now)
+			Expect(ok).To(BeTrue())
+		})
+
+		It("answers requests served while the set is swapped from either set", func() {
+			before := []restgate.Credential{{Key: "rotating", SecretHash: hash("before")}}
+			after := []restgate.Credential{{Key: "rotating", SecretHash: hash("after")}}
+			store := restgate.NewCredentialStore(before)
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				for i := 0; i < 50; i++ {
+					_, withBefore := store.Authenticate("rotating", "before", now)
+					_, withAfter := store.Authenticate("rotating", "after", now)
+					Expect(withBefore || withAfter).To(BeTrue())
+				}
+			}()
+			for i := 0; i < 50; i++ {
+				if i%2 == 0 {
+					store.Replace(after)
+				} else {
+					store.Replace(before)
+				}
+			}
+			wg.Wait()
+		})
+	})
+
+	Describe("LoadCredentialsFile", func() {
+		var path string
+
+		writeFile := func(content string) {
+			file, err := ioutil.TempFile("", "credentials")
+			Expect(err).ToNot(HaveOccurred())
+			file.WriteString(content)
+			file.Close()
+			path = file.Name()
+		}
+
+		AfterEach(func() {
+			os.Remove(path)
+		})
+
+		It("loads usable credentials and names them after their key by default", func() {
+			writeFile(`[
+				{"key": "reporting", "secret_hash": "` + hash("s3cret") + `", "expires": "2017-01-01T00:00:00Z"},
+				{"name": "CI pipeline", "key": "ci", "signing_secret": "shared"}
+			]`)
+
+			credentials, err := restgate.LoadCredentialsFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(credentials).To(HaveLen(2))
+			Expect(credentials[0].Name).To(Equal("reporting"))
+			Expect(credentials[0].Expires).To(Equal(time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)))
+			Expect(credentials[1].Name).To(Equal("CI pipeline"))
+		})
+
+		It("fails on a file that doesn't exist", func() {
+			path = "/nonexistent/credentials.json"
+			_, err := restgate.LoadCredentialsFile(path)
+			Expect(err).To(HaveOccurred())
+		})
+
+		table.DescribeTable("refuses unusable entries",
+			func(content string, message string) {
+				writeFile(content)
+
+				credentials, err := restgate.LoadCredentialsFile(path)
+				Expect(err).To(MatchError(ContainSubstring(message)))
+				Expect(credentials).To(BeNil())
+			},
+			table.Entry("malformed JSON", `[{"key": "ci",`, "parsing credentials file"),
+			table.Entry("a missing key", `[{"name": "ci", "signing_secret": "shared"}]`, "key is required"),
+			table.Entry("a duplicate key", `[{"key": "ci", "signing_secret": "a"}, {"key": "ci", "signing_secret": "b"}]`, "duplicate key"),
+			table.Entry("no secret at all", `[{"key": "ci"}]`, "secret_hash or signing_secret is required"),
+			table.Entry("a plaintext secret_hash", `[{"key": "ci", "secret_hash": "s3cret"}]`, "not a bcrypt hash"),
+		)
+	})
+})
@@ -0,0 +1,159 @@
+package restgate
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Headers of a signed request, next to the key in the gate's headerKeyLabel.
+const (
+	TimestampHeader = "X-Auth-Timestamp"
+	NonceHeader     = "X-Auth-Nonce"
+	SignatureHeader = "X-Auth-Signature"
+)
+
+//Largest request body that is read to compute the body hash.
+const maxSignedBody = 1 << 20
+
+var (
+	ErrMissingSignature = errors.New("missing signature headers")
+	ErrUnknownSigner    = errors.New("no signing secret for key")
+	ErrClockSkew        = errors.New("timestamp outside the allowed clock skew")
+	ErrReplayedNonce    = errors.New("nonce already used")
+	ErrBodyTooLarge     = errors.New("request body too large to verify")
+	ErrBadSignature     = errors.New("signature mismatch")
+)
+
+//SignatureVerifier checks HMAC-SHA256 signed requests for AuthenticationSource=Signed.
+//
+//The signature is the hex encoded HMAC-SHA256, keyed with the credential's SigningSecret, of
+//
+//	METHOD \n PATH \n SORTED_QUERY \n TIMESTAMP \n NONCE \n hex(SHA256(body))
+//
+//where TIMESTAMP is Unix seconds. Requests outside MaxSkew of our clock are rejected, and each nonce is
+//accepted only once per key while its timestamp is within the window. Nonces are remembered by this verifier
+//only, so every process running its own verifier will accept a captured request once more.
+type SignatureVerifier struct {
+	Credentials *CredentialStore
+	MaxSkew     time.Duration
+
+	nonces    map[string]time.Time
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+func NewSignatureVerifier(credentials *CredentialStore, maxSkew time.Duration) *SignatureVerifier {
+	return &SignatureVerifier{Credentials: credentials, MaxSkew: maxSkew, nonces: make(map[string]time.Time)}
+}
+
+//Verify checks the signature of req made with key and returns the signing credential.
+//The request body is read and replaced so handlers can still consume it.
+func (v *SignatureVerifier) Verify(req *http.Request, key string, now time.Time) (Credential, error) {
+	timestamp := req.Header.Get(TimestampHeader)
+	nonce := req.Header.Get(NonceHeader)
+	signature := req.Header.Get(SignatureHeader)
+	if timestamp == "" || nonce == "" || signature == "" {
+		return Credential{}, ErrMissingSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return Credential{}, ErrClockSkew
+	}
+	signedAt := time.Unix(seconds, 0)
+	if signedAt.Before(now.Add(-v.MaxSkew)) || signedAt.After(now.Add(v.MaxSkew)) {
+		return Credential{}, ErrClockSkew
+	}
+
+	credential, ok := v.Credentials.SigningCredential(key, now)
+	if !ok {
+		return Credential{}, ErrUnknownSigner
+	}
+
+	bodyHash, err := hashBody(req)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	expected := Sign(credential.SigningSecret, req.Method, req.URL.Path, req.URL.Query(), timestamp, nonce, bodyHash)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return Credential{}, ErrBadSignature
+	}
+
+	//Only remember nonces of genuine requests, so forged ones can't fill the cache
+	if !v.useNonce(key+"\n"+nonce, signedAt, now) {
+		return Credential{}, ErrReplayedNonce
+	}
+	return credential, nil
+}
+
+//useNonce records a nonce until its timestamp leaves the skew window and reports whether it was new.
+func (v *SignatureVerifier) useNonce(nonce string, signedAt time.Time, now time.Time) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if now.Sub(v.lastSweep) > v.MaxSkew {
+		for n, expires := range v.nonces {
+			if now.After(expires) {
+				delete(v.nonces, n)
+			}
+		}
+		v.lastSweep = now
+	}
+
+	if expires, seen := v.nonces[nonce]; seen && !now.After(expires) {
+		return false
+	}
+	v.nonces[nonce] = signedAt.Add(v.MaxSkew)
+	return true
+}
+
+//Sign computes the request signature. It is exported for clients written in Go.
+func Sign(secret string, method string, path string, query map[string][]string, timestamp string, nonce string, bodyHash string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.ToUpper(method) + "\n" + path + "\n" + canonicalQuery(query) + "\n" + timestamp + "\n" + nonce + "\n" + bodyHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//HashBody returns the hex encoded SHA-256 of a request body, as used in the signature.
+func HashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func hashBody(req *http.Request) (string, error) {
+	if req.Body == nil {
+		return HashBody(nil), nil
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, req.Body, maxSignedBody))
+	req.Body.Close()
+	if err != nil {
+		return "", ErrBodyTooLarge
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return HashBody(body), nil
+}
+
+//canonicalQuery sorts parameters by name and value so clients and the gate agree on one encoding.
+func canonicalQuery(query map[string][]string) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
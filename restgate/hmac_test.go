@@ -0,0 +1,79 @@
+package restgate_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/restgate"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ = Describe("HMAC signed requests", func() {
+	var (
+		gate    *restgate.RESTGate
+		subject string
+		body    string
+	)
+
+	signedRequest := func(secret string, signedAt time.Time, nonce string) *http.Request {
+		req, _ := http.NewRequest("POST", "/api/report/email?b=2&a=1", strings.NewReader("{}"))
+		timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+		req.Header.Set("X-Auth-Key", "ci")
+		req.Header.Set(restgate.TimestampHeader, timestamp)
+		req.Header.Set(restgate.NonceHeader, nonce)
+		req.Header.Set(restgate.SignatureHeader, restgate.Sign(secret, "POST", "/api/report/email", req.URL.Query(), timestamp, nonce, restgate.HashBody([]byte("{}"))))
+		return req
+	}
+
+	serve := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		gate.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			body = string(data)
+			w.WriteHeader(http.StatusOK)
+		})
+		return w.Code
+	}
+
+	BeforeEach(func() {
+		subject = ""
+		body = ""
+		credentials := restgate.NewCredentialStore([]restgate.Credential{{Name: "ci-pipeline", Key: "ci", SigningSecret: "s3cret"}})
+		gate = restgate.New("X-Auth-Key", "", restgate.Signed, restgate.Config{
+			SignatureVerifier:  restgate.NewSignatureVerifier(credentials, 5*time.Minute),
+			HTTPSProtectionOff: true,
+			Context:            func(r *http.Request, authenticatedKey string) { subject = authenticatedKey },
+		})
+		Expect(gate).ToNot(BeNil())
+	})
+
+	It("accepts a correctly signed request and leaves the body readable", func() {
+		Expect(serve(signedRequest("s3cret", time.Now(), "n1"))).To(Equal(http.StatusOK))
+		Expect(subject).To(Equal("key:ci-pipeline"))
+		Expect(body).To(Equal("{}"))
+	})
+
+	It("rejects a replayed nonce", func() {
+		Expect(serve(signedRequest("s3cret", time.Now(), "n1"))).To(Equal(http.StatusOK))
+		Expect(serve(signedRequest("s3cret", time.Now(), "n1"))).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("rejects requests signed outside the clock skew window", func() {
+		Expect(serve(signedRequest("s3cret", time.Now().Add(-10*time.Minute), "n2"))).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("rejects requests signed with the wrong secret", func() {
+		Expect(serve(signedRequest("guess", time.Now(), "n3"))).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("rejects requests whose query was tampered with", func() {
+		req := signedRequest("s3cret", time.Now(), "n4")
+		req.URL.RawQuery = "a=1&b=3"
+		Expect(serve(req)).To(Equal(http.StatusUnauthorized))
+	})
+})
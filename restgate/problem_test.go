@@ -0,0 +1,55 @@
+package restgate_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/jsonerror"
+	"app-metrics-nozzle/restgate"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Error responses", func() {
+	var gate *restgate.RESTGate
+
+	BeforeEach(func() {
+		gate = restgate.New("X-Auth-Key", "X-Auth-Secret", restgate.Static, restgate.Config{
+			Key:                []string{"key"},
+			Secret:             []string{"secret"},
+			HTTPSProtectionOff: true,
+		})
+		Expect(gate).ToNot(BeNil())
+	})
+
+	reject := func(key string) (*httptest.ResponseRecorder, jsonerror.Problem) {
+		req, _ := http.NewRequest("GET", "/api/apps?x=1", nil)
+		req.Header.Set("X-Auth-Key", key)
+		req.Header.Set("X-Auth-Secret", "wrong")
+		w := httptest.NewRecorder()
+		gate.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {})
+
+		var problem jsonerror.Problem
+		Expect(json.Unmarshal(w.Body.Bytes(), &problem)).To(Succeed())
+		return w, problem
+	}
+
+	It("renders problem details for missing credentials", func() {
+		w, problem := reject("")
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+		Expect(w.Header().Get("Content-Type")).To(Equal(jsonerror.ProblemContentType))
+		Expect(problem.Type).To(Equal(restgate.ProblemTypeBase + "no-key-or-secret"))
+		Expect(problem.Title).To(Equal("No Key Or Secret"))
+		Expect(problem.Status).To(Equal(http.StatusUnauthorized))
+		Expect(problem.Instance).To(Equal("/api/apps"))
+		Expect(problem.Extensions).To(HaveKeyWithValue("code", BeNumerically("==", 1)))
+	})
+
+	It("renders problem details for wrong credentials", func() {
+		w, problem := reject("key")
+		Expect(w.Code).To(Equal(http.StatusUnauthorized))
+		Expect(problem.Type).To(Equal(restgate.ProblemTypeBase + "unauthorized"))
+		Expect(problem.Extensions).To(HaveKeyWithValue("domain", "com.github.pjebs.restgate"))
+	})
+})
@@ -0,0 +1,137 @@
+package restgate
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//How often idle buckets are swept out of a RateLimiter.
+const sweepInterval = time.Minute
+
+//RateLimiter is a set of token buckets, one per key, each holding up to Burst tokens and refilling at Rate tokens per second.
+//It can safely be used from concurrent goroutines.
+type RateLimiter struct {
+	Rate  float64
+	Burst int
+
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//Decision is the outcome of a RateLimiter check, with the values for the RateLimit-* and Retry-After headers.
+type Decision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration //Until the bucket is full again
+	RetryAfter time.Duration //Until the next token is available, when not Allowed
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{Rate: rate, Burst: burst, buckets: make(map[string]*bucket)}
+}
+
+//Take consumes a token from key's bucket if one is available.
+func (l *RateLimiter) Take(key string, now time.Time) Decision {
+	return l.check(key, now, true)
+}
+
+//Peek reports whether key's bucket has a token without consuming it.
+func (l *RateLimiter) Peek(key string, now time.Time) Decision {
+	return l.check(key, now, false)
+}
+
+func (l *RateLimiter) check(key string, now time.Time, consume bool) Decision {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.sweep(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+
+	d := Decision{Limit: l.Burst}
+	if b.tokens >= 1 {
+		d.Allowed = true
+		if consume {
+			b.tokens--
+		}
+	} else {
+		d.RetryAfter = l.duration(1 - b.tokens)
+	}
+	d.Remaining = int(b.tokens)
+	d.Reset = l.duration(float64(l.Burst) - b.tokens)
+	return d
+}
+
+//sweep forgets buckets that have been idle long enough to be full again.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.Rate >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+//duration returns how long it takes to refill the given number of tokens.
+func (l *RateLimiter) duration(tokens float64) time.Duration {
+	if l.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / l.Rate * float64(time.Second))
+}
+
+//setRateLimitHeaders writes the RateLimit-* headers and, for rejected requests, Retry-After.
+func setRateLimitHeaders(w http.ResponseWriter, d Decision) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(d.Reset)))
+	if !d.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(d.RetryAfter)))
+	}
+}
+
+//ClientIP returns the address of the caller behind trustedProxies proxies. Each proxy appends the address it received
+//the request from to X-Forwarded-For, so the entry trustedProxies places from the end is the right-most one a client
+//could not have forged; anything before it is supplied by the client. With no trusted proxies the connection's own
+//peer is the caller.
+func ClientIP(req *http.Request, trustedProxies int) string {
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" && trustedProxies > 0 {
+		parts := strings.Split(forwarded, ",")
+		if trustedProxies > len(parts) {
+			//Every entry was added by a trusted proxy, so the first is the caller
+			return strings.TrimSpace(parts[0])
+		}
+		return strings.TrimSpace(parts[len(parts)-trustedProxies])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
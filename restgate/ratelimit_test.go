@@ -0,0 +1,116 @@
+package restgate_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/restgate"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Rate limiting", func() {
+	var (
+		gate *restgate.RESTGate
+		hash string
+	)
+
+	serve := func(key string, secret string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/api/apps", nil)
+		req.RemoteAddr = "10.0.0.1:50000"
+		req.Header.Set("X-Auth-Key", key)
+		req.Header.Set("X-Auth-Secret", secret)
+		w := httptest.NewRecorder()
+		gate.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		return w
+	}
+
+	BeforeEach(func() {
+		var err error
+		hash, err = restgate.HashSecret("secret")
+		Expect(err).ToNot(HaveOccurred())
+		credentials := restgate.NewCredentialStore([]restgate.Credential{
+			{Name: "dashboard", Key: "dashboard", SecretHash: hash},
+			{Name: "reports", Key: "reports", SecretHash: hash},
+		})
+		gate = restgate.New("X-Auth-Key", "X-Auth-Secret", restgate.Hashed, restgate.Config{
+			Credentials:        credentials,
+			RateLimiter:        restgate.NewRateLimiter(0.001, 2),
+			FailureLimiter:     restgate.NewRateLimiter(0.001, 1),
+			HTTPSProtectionOff: true,
+		})
+		Expect(gate).ToNot(BeNil())
+	})
+
+	It("throttles each key once its burst is spent", func() {
+		first := serve("dashboard", "secret")
+		Expect(first.Code).To(Equal(http.StatusOK))
+		Expect(first.Header().Get("RateLimit-Limit")).To(Equal("2"))
+		Expect(first.Header().Get("RateLimit-Remaining")).To(Equal("1"))
+
+		Expect(serve("dashboard", "secret").Code).To(Equal(http.StatusOK))
+
+		throttled := serve("dashboard", "secret")
+		Expect(throttled.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(throttled.Header().Get("Retry-After")).ToNot(BeEmpty())
+		Expect(throttled.Body.String()).To(ContainSubstring("Too Many Requests"))
+
+		Expect(serve("reports", "secret").Code).To(Equal(http.StatusOK))
+	})
+
+	It("turns away clients that keep failing authentication", func() {
+		Expect(serve("dashboard", "wrong").Code).To(Equal(http.StatusUnauthorized))
+
+		throttled := serve("dashboard", "secret")
+		Expect(throttled.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(throttled.Header().Get("Retry-After")).ToNot(BeEmpty())
+	})
+
+	It("limits clients behind the same proxy separately", func() {
+		gate = restgate.New("X-Auth-Key", "X-Auth-Secret", restgate.Hashed, restgate.Config{
+			Credentials:        restgate.NewCredentialStore([]restgate.Credential{{Name: "dashboard", Key: "dashboard", SecretHash: hash}}),
+			FailureLimiter:     restgate.NewRateLimiter(0.001, 1),
+			TrustedProxies:     1,
+			HTTPSProtectionOff: true,
+		})
+		from := func(clientIP string, secret string) int {
+			req, _ := http.NewRequest("GET", "/api/apps", nil)
+			req.RemoteAddr = "10.0.0.1:50000"
+			req.Header.Set("X-Forwarded-For", clientIP)
+			req.Header.Set("X-Auth-Key", "dashboard")
+			req.Header.Set("X-Auth-Secret", secret)
+			w := httptest.NewRecorder()
+			gate.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			return w.Code
+		}
+
+		Expect(from("6.6.6.6", "wrong")).To(Equal(http.StatusUnauthorized))
+		Expect(from("6.6.6.6", "secret")).To(Equal(http.StatusTooManyRequests))
+		Expect(from("203.0.113.7", "secret")).To(Equal(http.StatusOK))
+	})
+
+	It("finds the client behind the trusted proxies", func() {
+		req, _ := http.NewRequest("GET", "/api/apps", nil)
+		req.RemoteAddr = "10.0.0.1:50000"
+		Expect(restgate.ClientIP(req, 1)).To(Equal("10.0.0.1"))
+
+		req.Header.Set("X-Forwarded-For", "6.6.6.6, 203.0.113.7, 10.0.0.2")
+		Expect(restgate.ClientIP(req, 0)).To(Equal("10.0.0.1"))
+		Expect(restgate.ClientIP(req, 1)).To(Equal("10.0.0.2"))
+		Expect(restgate.ClientIP(req, 2)).To(Equal("203.0.113.7"))
+		Expect(restgate.ClientIP(req, 5)).To(Equal("6.6.6.6"))
+	})
+
+	It("refills buckets over time", func() {
+		limiter := restgate.NewRateLimiter(1, 1)
+		now := time.Now()
+		Expect(limiter.Take("key", now).Allowed).To(BeTrue())
+		Expect(limiter.Take("key", now).Allowed).To(BeFalse())
+		Expect(limiter.Take("key", now.Add(time.Second)).Allowed).To(BeTrue())
+	})
+})
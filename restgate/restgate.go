@@ -24,31 +24,55 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	// TODO: this import needs to point to github. fix using glide.yaml file 
 	e "app-metrics-nozzle/jsonerror"
 	//e "github.com/pjebs/jsonerror"
-	
-	// TODO: this import needs to point to gopkg. fix using glide.yaml file
-	//"gopkg.in/unrolled/render"
-	"github.com/unrolled/render"
-)
+	)
 
 type AuthenticationSource int
 
+//ProblemTypeBase prefixes the type URIs of the problems RestGate responds with.
+const ProblemTypeBase = "urn:restgate:problem:"
+
+const (
+	Static     AuthenticationSource = 0
+	Database                        = 1
+	Hashed     AuthenticationSource = 2
+	UAA        AuthenticationSource = 3
+	Signed     AuthenticationSource = 4
+	ClientCert AuthenticationSource = 5
+)
+
+//Identities passed to the Context callback start with the kind of caller, so a key, a UAA user, a UAA client and a
+//client certificate that share a name are never mistaken for one another.
 const (
-	Static   AuthenticationSource = 0
-	Database                      = 1
+	KeyIdentityPrefix       = "key:"
+	UAAUserIdentityPrefix   = "uaa-user:"
+	UAAClientIdentityPrefix = "uaa-client:"
+	CertIdentityPrefix      = "cert:"
 )
 
 //When AuthenticationSource=Static, Key(s)=Actual Key and Secret(s)=Actual Secret.
 //When AuthenticationSource=Database, Key[0]=Key_Column and Secret[0]=Secret_Column.
+//When AuthenticationSource=Hashed, Credentials holds the named keys and bcrypt hashed secrets. Key and Secret are ignored.
+//When AuthenticationSource=Signed, SignatureVerifier checks the HMAC signature of the request made with the key in headerKeyLabel. Key and Secret are ignored.
+//When AuthenticationSource=ClientCert, CertificateMapper maps the subject of the verified TLS client certificate to an identity. Headers, Key and Secret are ignored.
+//When AuthenticationSource=UAA, headerKeyLabel is normally "Authorization" and TokenVerifier validates the bearer token. Key and Secret are ignored.
 type Config struct {
 	*sql.DB
 	Key                     []string
 	Secret                  []string //Can be "" but not recommended
+	Credentials             *CredentialStore
+	TokenVerifier           *TokenVerifier
+	SignatureVerifier       *SignatureVerifier
+	CertificateMapper       *CertificateMapper
+	RateLimiter             *RateLimiter //Optional. Throttles each authenticated key separately
+	FailureLimiter          *RateLimiter //Optional. Throttles failed authentication attempts per client IP
+	TrustedProxies          int          //Proxies in front of the gate that append to X-Forwarded-For, used to find the client IP
 	TableName               string
-	ErrorMessages           map[int]map[string]string
+	ErrorMessages           map[int]e.Problem //Rendered as application/problem+json. Status is set per response
 	Context                 func(r *http.Request, authenticatedKey string)
 	Debug                   bool
 	Postgres                bool
@@ -78,7 +102,35 @@ func New(headerKeyLabel string, headerSecretLabel string, as AuthenticationSourc
 	numberKeys := len(t.config.Key)
 	numberSecrets := len(t.config.Secret)
 
-	if numberKeys == 0 { //Key is not set
+	if as == Hashed {
+		if t.config.Credentials == nil || t.config.Credentials.Len() == 0 { //No credentials configured
+			if t.config.Debug == true {
+				t.config.Logger.Printf("RestGate: For Hashed mode, at least one credential is required")
+			}
+			return nil
+		}
+	} else if as == UAA {
+		if t.config.TokenVerifier == nil { //No verifier configured
+			if t.config.Debug == true {
+				t.config.Logger.Printf("RestGate: For UAA mode, a TokenVerifier is required")
+			}
+			return nil
+		}
+	} else if as == Signed {
+		if t.config.SignatureVerifier == nil { //No verifier configured
+			if t.config.Debug == true {
+				t.config.Logger.Printf("RestGate: For Signed mode, a SignatureVerifier is required")
+			}
+			return nil
+		}
+	} else if as == ClientCert {
+		if t.config.CertificateMapper == nil { //No mapping configured
+			if t.config.Debug == true {
+				t.config.Logger.Printf("RestGate: For ClientCert mode, a CertificateMapper is required")
+			}
+			return nil
+		}
+	} else if numberKeys == 0 { //Key is not set
 		if t.config.Debug == true {
 			t.config.Logger.Printf("RestGate: Key is not set")
 		}
@@ -92,7 +144,7 @@ func New(headerKeyLabel string, headerSecretLabel string, as AuthenticationSourc
 		return nil
 	}
 
-	if headerKeyLabel == "" { //headerKeyLabel must be defined
+	if headerKeyLabel == "" && as != ClientCert { //headerKeyLabel must be defined
 		if t.config.Debug == true {
 			t.config.Logger.Printf("RestGate: headerKeyLabel is not defined.")
 		}
@@ -100,28 +152,21 @@ func New(headerKeyLabel string, headerSecretLabel string, as AuthenticationSourc
 	}
 
 	//Default Error Messages
+	defaultErrorMessages := map[int]e.Problem{
+		1:  e.New(1, "No Key Or Secret", "", "com.github.pjebs.restgate").Problem(ProblemTypeBase+"no-key-or-secret", http.StatusUnauthorized),
+		2:  e.New(2, "Unauthorized Access", "", "com.github.pjebs.restgate").Problem(ProblemTypeBase+"unauthorized", http.StatusUnauthorized),
+		3:  e.New(3, "Please use HTTPS connection", "", "com.github.pjebs.restgate").Problem(ProblemTypeBase+"https-required", http.StatusUnauthorized),
+		4:  e.New(4, "Insufficient Scope", "", "com.github.pjebs.restgate").Problem(ProblemTypeBase+"insufficient-scope", http.StatusForbidden),
+		5:  e.New(5, "Too Many Requests", "", "com.github.pjebs.restgate").Problem(ProblemTypeBase+"too-many-requests", http.StatusTooManyRequests),
+		99: e.New(99, "Software Developers have not setup authentication correctly", "", "com.github.pjebs.restgate").Problem(ProblemTypeBase+"misconfigured", http.StatusUnauthorized),
+	}
 	if t.config.ErrorMessages == nil {
-		t.config.ErrorMessages = map[int]map[string]string{
-			1:  e.New(1, "No Key Or Secret", "", "com.github.pjebs.restgate").Render(),
-			2:  e.New(2, "Unauthorized Access", "", "com.github.pjebs.restgate").Render(),
-			3:  e.New(3, "Please use HTTPS connection", "", "com.github.pjebs.restgate").Render(),
-			99: e.New(99, "Software Developers have not setup authentication correctly", "", "com.github.pjebs.restgate").Render(),
-		}
+		t.config.ErrorMessages = defaultErrorMessages
 	} else {
-		if _, ok := t.config.ErrorMessages[1]; !ok {
-			t.config.ErrorMessages[1] = e.New(1, "No Key Or Secret", "", "com.github.pjebs.restgate").Render()
-		}
-
-		if _, ok := t.config.ErrorMessages[2]; !ok {
-			t.config.ErrorMessages[2] = e.New(2, "Unauthorized Access", "", "com.github.pjebs.restgate").Render()
-		}
-
-		if _, ok := t.config.ErrorMessages[3]; !ok {
-			t.config.ErrorMessages[3] = e.New(3, "Please use HTTPS connection", "", "com.github.pjebs.restgate").Render()
-		}
-
-		if _, ok := t.config.ErrorMessages[99]; !ok {
-			t.config.ErrorMessages[99] = e.New(99, "Software Developers have not setup authentication correctly", "", "com.github.pjebs.restgate").Render()
+		for code, problem := range defaultErrorMessages {
+			if _, ok := t.config.ErrorMessages[code]; !ok {
+				t.config.ErrorMessages[code] = problem
+			}
 		}
 	}
 
@@ -169,33 +214,59 @@ func New(headerKeyLabel string, headerSecretLabel string, as AuthenticationSourc
 
 func (self *RESTGate) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
 
+	//Clients that keep failing authentication are turned away before their credentials are even checked,
+	//so guessing can't go faster than the failure limit
+	if self.config.FailureLimiter != nil {
+		if decision := self.config.FailureLimiter.Peek(ClientIP(req, self.config.TrustedProxies), time.Now()); !decision.Allowed {
+			setRateLimitHeaders(w, decision)
+			self.problem(w, req, http.StatusTooManyRequests, 5) //"Too Many Requests"
+			return
+		}
+	}
+
 	//Check if HTTPS Protection has been turned off
 	if !self.config.HTTPSProtectionOff {
 		//HTTPS Protection is on so we must check it
 
 		if self.config.GAE_FlexibleEnvironment == true {
 			if req.Header.Get("X-AppEngine-Https") != "on" {
-				r := render.New(render.Options{})
-				r.JSON(w, http.StatusUnauthorized, self.config.ErrorMessages[3]) //"Please use HTTPS connection"
+				self.reject(w, req, http.StatusUnauthorized, 3) //"Please use HTTPS connection"
 				return
 			}
 		} else {
 			if !(strings.EqualFold(req.URL.Scheme, "https") || req.TLS != nil) {
-				r := render.New(render.Options{})
-				r.JSON(w, http.StatusUnauthorized, self.config.ErrorMessages[3]) //"Please use HTTPS connection"
+				self.reject(w, req, http.StatusUnauthorized, 3) //"Please use HTTPS connection"
 				return
 			}
 		}
 	}
 
+	//Client certificates are verified by the TLS server, so there is no key in the headers to check
+	if self.source == ClientCert {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+			self.reject(w, req, http.StatusUnauthorized, 1) //"No Key Or Secret"
+			return
+		}
+
+		identity, authenticationPassed := self.config.CertificateMapper.Identity(req.TLS.VerifiedChains[0][0])
+		if authenticationPassed == false {
+			if self.config.Debug == true {
+				self.config.Logger.Printf("RestGate: No identity for client certificate %s", req.TLS.VerifiedChains[0][0].Subject)
+			}
+			self.reject(w, req, http.StatusUnauthorized, 2) //"Unauthorized Access"
+			return
+		}
+		self.pass(w, req, CertIdentityPrefix+identity, next)
+		return
+	}
+
 	//Check key in Header
 	key := req.Header.Get(self.headerKeyLabel)
 	secret := req.Header.Get(self.headerSecretLabel)
 
 	if key == "" {
 		//Authentication Information not included in request
-		r := render.New(render.Options{})
-		r.JSON(w, http.StatusUnauthorized, self.config.ErrorMessages[1]) //"No Key Or Secret"
+		self.reject(w, req, http.StatusUnauthorized, 1) //"No Key Or Secret"
 		return
 	}
 
@@ -234,14 +305,55 @@ func (self *RESTGate) ServeHTTP(w http.ResponseWriter, req *http.Request, next h
 
 		//Authentication FAILED - No Key's matched
 		if authenticationPassed == false {
-			r := render.New(render.Options{})
-			r.JSON(w, http.StatusUnauthorized, self.config.ErrorMessages[2]) //"Unauthorized Access"
+			self.reject(w, req, http.StatusUnauthorized, 2) //"Unauthorized Access"
 			return
 		} else { //Authentication PASSED
-			if self.config.Context != nil {
-				self.config.Context(req, key)
+			self.pass(w, req, KeyIdentityPrefix+key, next)
+		}
+
+	} else if self.source == Hashed {
+
+		credential, authenticationPassed := self.config.Credentials.Authenticate(key, secret, time.Now())
+
+		if authenticationPassed == false {
+			self.reject(w, req, http.StatusUnauthorized, 2) //"Unauthorized Access"
+			return
+		} else { //Authentication PASSED
+			self.pass(w, req, KeyIdentityPrefix+credential.Name, next) //Named credentials identify themselves by name rather than key
+		}
+
+	} else if self.source == UAA {
+
+		if !strings.HasPrefix(key, "Bearer ") {
+			self.reject(w, req, http.StatusUnauthorized, 1) //"No Key Or Secret"
+			return
+		}
+
+		claims, err := self.config.TokenVerifier.Verify(strings.TrimPrefix(key, "Bearer "), time.Now())
+		if err == ErrInsufficientScope {
+			self.reject(w, req, http.StatusForbidden, 4) //"Insufficient Scope"
+			return
+		} else if err != nil {
+			if self.config.Debug == true {
+				self.config.Logger.Printf("RestGate: Bearer token rejected: %v", err)
 			}
-			next(w, req)
+			self.reject(w, req, http.StatusUnauthorized, 2) //"Unauthorized Access"
+			return
+		} else { //Authentication PASSED
+			self.pass(w, req, claims.Identity(), next)
+		}
+
+	} else if self.source == Signed {
+
+		credential, err := self.config.SignatureVerifier.Verify(req, key, time.Now())
+		if err != nil {
+			if self.config.Debug == true {
+				self.config.Logger.Printf("RestGate: Signed request rejected: %v", err)
+			}
+			self.reject(w, req, http.StatusUnauthorized, 2) //"Unauthorized Access"
+			return
+		} else { //Authentication PASSED
+			self.pass(w, req, KeyIdentityPrefix+credential.Name, next)
 		}
 
 	} else if self.source == Database {
@@ -269,8 +381,7 @@ func (self *RESTGate) ServeHTTP(w http.ResponseWriter, req *http.Request, next h
 			if self.config.Debug == true {
 				self.config.Logger.Printf("RestGate: Run time database error: %+v", err)
 			}
-			r := render.New(render.Options{})
-			r.JSON(w, http.StatusUnauthorized, self.config.ErrorMessages[99]) //"Software Developers have not setup authentication correctly"
+			self.reject(w, req, http.StatusUnauthorized, 99) //"Software Developers have not setup authentication correctly"
 			return
 		}
 		defer stmt.Close()
@@ -287,28 +398,56 @@ func (self *RESTGate) ServeHTTP(w http.ResponseWriter, req *http.Request, next h
 
 		if err == nil && count == 1 {
 			//Authentication PASSED
-			if self.config.Context != nil {
-				self.config.Context(req, key)
-			}
-			next(w, req)
+			self.pass(w, req, KeyIdentityPrefix+key, next)
 		} else { //==sql.ErrNoRows or count == 0
 			//Something went wrong
 			if self.config.Debug == true && count > 1 {
 				self.config.Logger.Printf("RestGate: Database query returned more than 1 identical Key. Make sure the KEY field in the table is set to UNIQUE")
 			}
-			r := render.New(render.Options{})
-			r.JSON(w, http.StatusUnauthorized, self.config.ErrorMessages[2]) //"Unauthorized Access"
+			self.reject(w, req, http.StatusUnauthorized, 2) //"Unauthorized Access"
 			return
 		}
 
 	} else {
-		r := render.New(render.Options{})
-		r.JSON(w, http.StatusUnauthorized, self.config.ErrorMessages[99]) //"Software Developers have not setup authentication correctly"
+		self.reject(w, req, http.StatusUnauthorized, 99) //"Software Developers have not setup authentication correctly"
 		return
 	}
 
 }
 
+// pass lets an authenticated request through to next, subject to the per-key rate limit.
+func (self *RESTGate) pass(w http.ResponseWriter, req *http.Request, authenticatedKey string, next http.HandlerFunc) {
+	if self.config.RateLimiter != nil {
+		decision := self.config.RateLimiter.Take(authenticatedKey, time.Now())
+		setRateLimitHeaders(w, decision)
+		if !decision.Allowed {
+			self.problem(w, req, http.StatusTooManyRequests, 5) //"Too Many Requests"
+			return
+		}
+	}
+
+	if self.config.Context != nil {
+		self.config.Context(req, authenticatedKey)
+	}
+	next(w, req)
+}
+
+// reject renders one of the configured error messages and counts the attempt against the client's failure limit.
+// Clients are told apart by ClientIP, so callers behind the same proxies are limited separately.
+func (self *RESTGate) reject(w http.ResponseWriter, req *http.Request, status int, message int) {
+	if self.config.FailureLimiter != nil {
+		self.config.FailureLimiter.Take(ClientIP(req, self.config.TrustedProxies), time.Now())
+	}
+	self.problem(w, req, status, message)
+}
+
+// problem renders one of the configured error messages as problem details for this request.
+func (self *RESTGate) problem(w http.ResponseWriter, req *http.Request, status int, message int) {
+	problem := self.config.ErrorMessages[message]
+	problem.Status = status
+	problem.WithInstance(req.URL.Path).Write(w)
+}
+
 // secureCompare performs a constant time compare of two strings to limit timing attacks.
 func secureCompare(given string, actual string) bool {
 	if subtle.ConstantTimeEq(int32(len(given)), int32(len(actual))) == 1 {
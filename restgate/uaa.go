@@ -0,0 +1,274 @@
+package restgate
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Leeway allowed between the token issuer's clock and ours when checking exp and nbf.
+const clockLeeway = 30 * time.Second
+
+//Minimum time between two fetches of the token keys, so tokens with unknown key ids can't hammer UAA.
+const minKeysRefresh = time.Minute
+
+//Claims are the parts of a UAA access token RestGate cares about.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	UserName  string   `json:"user_name"`
+	ClientID  string   `json:"client_id"`
+	Scope     []string `json:"scope"`
+	Audience  audience `json:"aud"`
+	Expires   int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+//Identity is the name passed to the Context callback: "uaa-user:<user name>" for user tokens, otherwise
+//"uaa-client:<client id>".
+func (c Claims) Identity() string {
+	if c.UserName != "" {
+		return UAAUserIdentityPrefix + c.UserName
+	}
+	if c.ClientID != "" {
+		return UAAClientIdentityPrefix + c.ClientID
+	}
+	return UAAUserIdentityPrefix + c.Subject
+}
+
+//aud may be a single string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = audience(many)
+	return nil
+}
+
+var (
+	ErrMalformedToken    = errors.New("malformed token")
+	ErrUnsupportedAlg    = errors.New("unsupported signing algorithm")
+	ErrUnknownKey        = errors.New("unknown signing key")
+	ErrInvalidSignature  = errors.New("invalid signature")
+	ErrTokenExpired      = errors.New("token expired")
+	ErrTokenNotYetValid  = errors.New("token not yet valid")
+	ErrWrongAudience     = errors.New("token audience not accepted")
+	ErrInsufficientScope = errors.New("token lacks a required scope")
+)
+
+//TokenVerifier validates RS256 signed UAA access tokens against the keys published at UAA's /token_keys endpoint.
+//Keys are cached for CacheTTL and refetched early when a token names a key id we don't know (key rotation).
+type TokenVerifier struct {
+	KeysURL  string
+	Audience string   //If set, the token's aud must contain it
+	Scopes   []string //If set, the token must carry at least one of them
+	CacheTTL time.Duration
+	Client   *http.Client
+
+	keys      map[string]*rsa.PublicKey
+	fetched   time.Time     //Last successful fetch
+	attempted time.Time     //Last fetch, successful or not
+	fetching  chan struct{} //Closed when the fetch in flight finishes. Nil when none is
+	lock      sync.Mutex
+}
+
+func NewTokenVerifier(keysURL string, audience string, scopes []string, client *http.Client) *TokenVerifier {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &TokenVerifier{KeysURL: keysURL, Audience: audience, Scopes: scopes, CacheTTL: time.Hour, Client: client}
+}
+
+//Verify checks the token's signature, validity window, audience and scopes and returns its claims.
+func (v *TokenVerifier) Verify(token string, now time.Time) (Claims, error) {
+	var claims Claims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, ErrMalformedToken
+	}
+	if header.Alg != "RS256" {
+		return claims, ErrUnsupportedAlg
+	}
+
+	key, err := v.key(header.Kid, now)
+	if err != nil {
+		return claims, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrMalformedToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+		return claims, ErrInvalidSignature
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, ErrMalformedToken
+	}
+
+	if claims.Expires == 0 || now.After(time.Unix(claims.Expires, 0).Add(clockLeeway)) {
+		return claims, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(clockLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return claims, ErrTokenNotYetValid
+	}
+	if v.Audience != "" && !contains(claims.Audience, v.Audience) {
+		return claims, ErrWrongAudience
+	}
+	if len(v.Scopes) > 0 {
+		granted := false
+		for _, scope := range v.Scopes {
+			if contains(claims.Scope, scope) {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			return claims, ErrInsufficientScope
+		}
+	}
+
+	return claims, nil
+}
+
+//key returns the public key for kid, fetching the key set when the cache is stale or the kid is new.
+//Fetches are at least minKeysRefresh apart, failed ones included, so known keys keep being used while UAA is
+//unreachable. Requests arriving during a fetch wait for it instead of starting their own, and no request holds
+//the lock while UAA answers.
+func (v *TokenVerifier) key(kid string, now time.Time) (*rsa.PublicKey, error) {
+	v.lock.Lock()
+	for {
+		key, known := v.keys[kid]
+		if known && now.Sub(v.fetched) <= v.CacheTTL {
+			v.lock.Unlock()
+			return key, nil
+		}
+
+		if v.fetching != nil {
+			fetching := v.fetching
+			v.lock.Unlock()
+			<-fetching
+			v.lock.Lock()
+			continue
+		}
+
+		if !v.attempted.IsZero() && now.Sub(v.attempted) <= minKeysRefresh {
+			v.lock.Unlock()
+			if known { //Keep using what we have until the next refresh is due
+				return key, nil
+			}
+			return nil, ErrUnknownKey
+		}
+
+		fetching := make(chan struct{})
+		v.fetching = fetching
+		v.attempted = now
+		v.lock.Unlock()
+
+		keys, err := v.fetchKeys()
+
+		v.lock.Lock()
+		v.fetching = nil
+		close(fetching)
+		if err == nil {
+			v.keys = keys
+			v.fetched = now
+		}
+		key, known = v.keys[kid]
+		v.lock.Unlock()
+
+		switch {
+		case known: //Stale keys are still better than none while UAA is unreachable
+			return key, nil
+		case err != nil:
+			return nil, err
+		default:
+			return nil, ErrUnknownKey
+		}
+	}
+}
+
+func (v *TokenVerifier) fetchKeys() (map[string]*rsa.PublicKey, error) {
+	resp, err := v.Client.Get(v.KeysURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching token keys: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decoding token keys: %v", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.N, "="))
+		if err != nil {
+			return nil, fmt.Errorf("decoding modulus of key %s: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.E, "="))
+		if err != nil {
+			return nil, fmt.Errorf("decoding exponent of key %s: %v", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
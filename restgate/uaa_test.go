@@ -0,0 +1,200 @@
+package restgate_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/restgate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("UAA bearer tokens", func() {
+	var (
+		signingKey  *rsa.PrivateKey
+		keysServer  *httptest.Server
+		keysFetched int32
+		keysDown    bool
+		keysRelease chan struct{}
+		verifier    *restgate.TokenVerifier
+		gate        *restgate.RESTGate
+		now         time.Time
+		subject     string
+	)
+
+	sign := func(kid string, key *rsa.PrivateKey, claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		Expect(err).ToNot(HaveOccurred())
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub":       "f6a1c9",
+			"user_name": "ops-user",
+			"scope":     []string{"openid", "nozzle.read"},
+			"aud":       []string{"nozzle", "openid"},
+			"exp":       now.Add(time.Hour).Unix(),
+		}
+	}
+
+	serve := func(token string) int {
+		req, _ := http.NewRequest("GET", "/api/apps", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		gate.ServeHTTP(w, req, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		return w.Code
+	}
+
+	BeforeEach(func() {
+		var err error
+		signingKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		keysFetched = 0
+		keysDown = false
+		keysRelease = nil
+		now = time.Now()
+		subject = ""
+
+		keysServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&keysFetched, 1)
+			if keysRelease != nil {
+				<-keysRelease
+			}
+			if keysDown {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kid": "key-1",
+					"kty": "RSA",
+					"alg": "RS256",
+					"n":   base64.RawURLEncoding.EncodeToString(signingKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(signingKey.E)).Bytes()),
+				}},
+			})
+		}))
+
+		verifier = restgate.NewTokenVerifier(keysServer.URL, "nozzle", []string{"cloud_controller.admin", "nozzle.read"}, nil)
+		gate = restgate.New("Authorization", "", restgate.UAA, restgate.Config{
+			TokenVerifier:      verifier,
+			HTTPSProtectionOff: true,
+			Context:            func(r *http.Request, authenticatedKey string) { subject = authenticatedKey },
+		})
+		Expect(gate).ToNot(BeNil())
+	})
+
+	AfterEach(func() {
+		keysServer.Close()
+	})
+
+	It("accepts a valid token and passes the user through the context callback", func() {
+		Expect(serve(sign("key-1", signingKey, validClaims()))).To(Equal(http.StatusOK))
+		Expect(subject).To(Equal("uaa-user:ops-user"))
+	})
+
+	It("tells clients apart from users of the same name", func() {
+		claims := validClaims()
+		delete(claims, "user_name")
+		claims["client_id"] = "ops-user"
+		Expect(serve(sign("key-1", signingKey, claims))).To(Equal(http.StatusOK))
+		Expect(subject).To(Equal("uaa-client:ops-user"))
+	})
+
+	It("caches the token keys between requests", func() {
+		serve(sign("key-1", signingKey, validClaims()))
+		serve(sign("key-1", signingKey, validClaims()))
+		Expect(atomic.LoadInt32(&keysFetched)).To(Equal(int32(1)))
+	})
+
+	It("keeps using stale keys while UAA is down without asking it on every request", func() {
+		claims := validClaims()
+		claims["exp"] = now.Add(24 * time.Hour).Unix()
+		token := sign("key-1", signingKey, claims)
+		_, err := verifier.Verify(token, now)
+		Expect(err).ToNot(HaveOccurred())
+
+		keysDown = true
+		stale := now.Add(verifier.CacheTTL + time.Second)
+		_, err = verifier.Verify(token, stale)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = verifier.Verify(token, stale.Add(time.Second))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(atomic.LoadInt32(&keysFetched)).To(Equal(int32(2)))
+
+		_, err = verifier.Verify(token, stale.Add(2*time.Minute))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(atomic.LoadInt32(&keysFetched)).To(Equal(int32(3)))
+	})
+
+	It("fetches the keys once for requests arriving together", func() {
+		token := sign("key-1", signingKey, validClaims())
+		keysRelease = make(chan struct{})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer GinkgoRecover()
+				_, err := verifier.Verify(token, now)
+				Expect(err).ToNot(HaveOccurred())
+			}()
+		}
+		Eventually(func() int32 { return atomic.LoadInt32(&keysFetched) }).Should(Equal(int32(1)))
+		close(keysRelease)
+		wg.Wait()
+		Expect(atomic.LoadInt32(&keysFetched)).To(Equal(int32(1)))
+	})
+
+	It("rejects requests without a bearer token", func() {
+		Expect(serve("")).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("rejects expired tokens", func() {
+		claims := validClaims()
+		claims["exp"] = now.Add(-time.Hour).Unix()
+		Expect(serve(sign("key-1", signingKey, claims))).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("rejects tokens for another audience", func() {
+		claims := validClaims()
+		claims["aud"] = "cloud_controller"
+		Expect(serve(sign("key-1", signingKey, claims))).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("forbids tokens without a required scope", func() {
+		claims := validClaims()
+		claims["scope"] = []string{"openid"}
+		Expect(serve(sign("key-1", signingKey, claims))).To(Equal(http.StatusForbidden))
+	})
+
+	It("rejects tokens signed by another key", func() {
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(serve(sign("key-1", otherKey, validClaims()))).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("rejects tokens naming an unknown key", func() {
+		Expect(serve(sign("key-2", signingKey, validClaims()))).To(Equal(http.StatusUnauthorized))
+	})
+})
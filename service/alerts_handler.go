@@ -0,0 +1,56 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"net/http"
+	"strings"
+
+	"app-metrics-nozzle/alerting"
+	"github.com/unrolled/render"
+)
+
+// AlertEngine is set by main when alert rules are configured.
+var AlertEngine *alerting.Engine
+
+func alertsHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		w.Header().Add("Access-Control-Allow-Methods", "GET")
+
+		if AlertEngine == nil {
+			writeProblem(w, req, problemNotConfigured, "Alerting is not configured")
+			return
+		}
+
+		grant := grantFor(req)
+		state := req.URL.Query().Get("state")
+		alerts := make([]alerting.Alert, 0)
+		for _, alert := range AlertEngine.Alerts() {
+			if state != "" && string(alert.State) != state {
+				continue
+			}
+			parts := strings.SplitN(alert.App, "/", 3)
+			if len(parts) < 2 || !grant.AllowsSpace(parts[0], parts[1]) {
+				continue
+			}
+			alerts = append(alerts, alert)
+		}
+
+		formatter.JSON(w, http.StatusOK, alerts)
+	}
+}
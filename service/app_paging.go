@@ -0,0 +1,194 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"app-metrics-nozzle/domain"
+)
+
+// LegacyAppMap makes /api/apps answer with the whole org/space/app keyed map, as it did before paging.
+var LegacyAppMap bool
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// appSortFields are the numeric fields /api/apps can be sorted by.
+var appSortFields = map[string]func(domain.App) float64{
+	"event_count":              func(app domain.App) float64 { return float64(app.EventCount) },
+	"last_event_time":          func(app domain.App) float64 { return float64(app.LastEventTime) },
+	"requests_per_second":      func(app domain.App) float64 { return app.RequestsPerSecond },
+	"server_error_count":       func(app domain.App) float64 { return float64(app.ServerErrorCount) },
+	"elapsed_since_last_event": func(app domain.App) float64 { return float64(app.ElapsedSinceLastEvent) },
+}
+
+// appFields are the members fields= can select.
+var appFields = map[string]bool{
+	"guid": true, "name": true, "organization": true, "space": true, "state": true,
+	"event_count": true, "last_event_time": true, "requests_per_second": true,
+	"server_error_count": true, "elapsed_since_last_event": true, "deleted_at": true, "sources": true,
+}
+
+// appPage is one page of /api/apps. NextCursor is empty on the last page.
+type appPage struct {
+	Total      int           `json:"total"`
+	Apps       []interface{} `json:"apps"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// appCursor marks the last app of a page. It carries the sort so a cursor can't be reused with a different one.
+type appCursor struct {
+	Sort  string  `json:"s"`
+	Value float64 `json:"v"`
+	Key   string  `json:"k"`
+}
+
+// invalidParameter names the query parameter that could not be used.
+type invalidParameter struct {
+	name   string
+	detail string
+}
+
+type keyedApp struct {
+	key string
+	app domain.App
+}
+
+// pageApps orders apps by the requested field, ties broken by their org/space/app key so the order is stable
+// across requests, and returns the page after the cursor.
+func pageApps(apps map[string]domain.App, query url.Values) (appPage, *invalidParameter) {
+	sortParam := query.Get("sort")
+	field := strings.TrimPrefix(sortParam, "-")
+	descending := strings.HasPrefix(sortParam, "-")
+	value, sortable := appSortFields[field]
+	if sortParam != "" && !sortable {
+		return appPage{}, &invalidParameter{"sort", fmt.Sprintf("sort must be one of %s, optionally prefixed with -", strings.Join(sortedNames(appSortFields), ", "))}
+	}
+	if !sortable {
+		value = func(domain.App) float64 { return 0 }
+	}
+
+	limit := defaultPageSize
+	if param := query.Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit <= 0 || limit > maxPageSize {
+			return appPage{}, &invalidParameter{"limit", fmt.Sprintf("limit must be between 1 and %d", maxPageSize)}
+		}
+	}
+
+	var fields []string
+	if param := query.Get("fields"); param != "" {
+		for _, name := range strings.Split(param, ",") {
+			name = strings.TrimSpace(name)
+			if !appFields[name] {
+				return appPage{}, &invalidParameter{"fields", fmt.Sprintf("unknown field %s", name)}
+			}
+			fields = append(fields, name)
+		}
+	}
+
+	ordered := make([]keyedApp, 0, len(apps))
+	for key, app := range apps {
+		ordered = append(ordered, keyedApp{key, app})
+	}
+	before := func(a keyedApp, aValue float64, b keyedApp, bValue float64) bool {
+		if aValue != bValue {
+			return (aValue < bValue) != descending
+		}
+		return a.key < b.key
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return before(ordered[i], value(ordered[i].app), ordered[j], value(ordered[j].app))
+	})
+
+	start := 0
+	if param := query.Get("cursor"); param != "" {
+		cursor, err := decodeAppCursor(param)
+		if err != nil || cursor.Sort != sortParam {
+			return appPage{}, &invalidParameter{"cursor", "cursor is malformed or belongs to a different sort"}
+		}
+		last := keyedApp{key: cursor.Key}
+		start = sort.Search(len(ordered), func(i int) bool {
+			return before(last, cursor.Value, ordered[i], value(ordered[i].app))
+		})
+	}
+
+	end := start + limit
+	if end > len(ordered) {
+		end = len(ordered)
+	}
+
+	page := appPage{Total: len(ordered), Apps: make([]interface{}, 0, end-start)}
+	for _, entry := range ordered[start:end] {
+		page.Apps = append(page.Apps, project(entry.app, fields))
+	}
+	if end < len(ordered) {
+		last := ordered[end-1]
+		page.NextCursor = encodeAppCursor(appCursor{Sort: sortParam, Value: value(last.app), Key: last.key})
+	}
+	return page, nil
+}
+
+// project keeps only the selected members of app. Without a selection the app is returned whole.
+func project(app domain.App, fields []string) interface{} {
+	if len(fields) == 0 {
+		return app
+	}
+
+	data, _ := json.Marshal(app)
+	var members map[string]json.RawMessage
+	json.Unmarshal(data, &members)
+
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, name := range fields {
+		selected[name] = members[name]
+	}
+	return selected
+}
+
+func encodeAppCursor(cursor appCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeAppCursor(param string) (appCursor, error) {
+	var cursor appCursor
+	data, err := base64.RawURLEncoding.DecodeString(param)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
+
+func sortedNames(fields map[string]func(domain.App) float64) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
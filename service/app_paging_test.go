@@ -0,0 +1,127 @@
+package service_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/service"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+type testPage struct {
+	Total int `json:"total"`
+	Apps  []struct {
+		Name string `json:"name"`
+	} `json:"apps"`
+	NextCursor string `json:"next_cursor"`
+}
+
+var _ = Describe("App paging", func() {
+	var (
+		server http.Handler
+		org    string
+		orgSeq int
+	)
+
+	// addApps makes name known in the spec's org with count requests.
+	addApps := func(counts map[string]int) {
+		for name, count := range counts {
+			for i := 0; i < count; i++ {
+				addApp(org+"-"+name, org, "space", name)
+			}
+		}
+	}
+
+	page := func(query string) testPage {
+		response := get(server, "/api/apps?fields=name&filter="+url.QueryEscape(fmt.Sprintf(`org == "%s"`, org))+query)
+		Expect(response.Code).To(Equal(http.StatusOK), response.Body.String())
+
+		var result testPage
+		Expect(json.Unmarshal(response.Body.Bytes(), &result)).To(Succeed())
+		return result
+	}
+
+	names := func(result testPage) []string {
+		var names []string
+		for _, app := range result.Apps {
+			names = append(names, app.Name)
+		}
+		return names
+	}
+
+	BeforeEach(func() {
+		server = newTestServer(service.AuthConfig{})
+
+		// Every spec pages its own org, so counts added by earlier specs don't leak in
+		orgSeq++
+		org = fmt.Sprintf("paging-%d", orgSeq)
+		addApps(map[string]int{"a": 2, "b": 1, "c": 1, "d": 1, "e": 3})
+	})
+
+	table.DescribeTable("orders the apps the same way on every page",
+		func(sort string, expected []string) {
+			whole := page("&sort=" + sort)
+			Expect(whole.Total).To(Equal(5))
+			Expect(names(whole)).To(Equal(expected))
+			Expect(whole.NextCursor).To(BeEmpty())
+
+			var paged []string
+			next := page("&limit=2&sort=" + sort)
+			paged = append(paged, names(next)...)
+			for next.NextCursor != "" {
+				next = page("&limit=2&sort=" + sort + "&cursor=" + next.NextCursor)
+				paged = append(paged, names(next)...)
+			}
+			Expect(paged).To(Equal(expected))
+		},
+		table.Entry("by key without a sort", "", []string{"a", "b", "c", "d", "e"}),
+		table.Entry("ascending, ties broken by key", "event_count", []string{"b", "c", "d", "a", "e"}),
+		table.Entry("descending, ties still broken by key", "-event_count", []string{"e", "a", "b", "c", "d"}),
+	)
+
+	It("continues a cursor after an app is added before and after it", func() {
+		first := page("&limit=2&sort=event_count")
+		Expect(names(first)).To(Equal([]string{"b", "c"}))
+
+		addApps(map[string]int{"bb": 1, "cc": 1})
+
+		second := page("&limit=2&sort=event_count&cursor=" + first.NextCursor)
+		Expect(second.Total).To(Equal(7))
+		Expect(names(second)).To(Equal([]string{"cc", "d"}))
+	})
+
+	It("continues a cursor after the app it points at is removed", func() {
+		first := page("&limit=2&sort=event_count")
+		Expect(names(first)).To(Equal([]string{"b", "c"}))
+
+		without := url.QueryEscape(` and name != "c"`)
+		second := page(without + "&limit=2&sort=event_count&cursor=" + first.NextCursor)
+		Expect(second.Total).To(Equal(4))
+		Expect(names(second)).To(Equal([]string{"d", "a"}))
+	})
+
+	table.DescribeTable("rejects parameters it can't page with",
+		func(query func(cursor string) string, parameter string) {
+			cursor := page("&limit=1&sort=event_count").NextCursor
+
+			response := get(server, "/api/apps?"+query(cursor))
+			Expect(response.Code).To(Equal(http.StatusBadRequest))
+
+			var problem map[string]interface{}
+			Expect(json.Unmarshal(response.Body.Bytes(), &problem)).To(Succeed())
+			Expect(problem["type"]).To(ContainSubstring("invalid-parameter"))
+			Expect(problem["parameter"]).To(Equal(parameter))
+		},
+		table.Entry("an unknown sort field", func(string) string { return "sort=name" }, "sort"),
+		table.Entry("a zero limit", func(string) string { return "limit=0" }, "limit"),
+		table.Entry("a limit over the maximum", func(string) string { return "limit=1001" }, "limit"),
+		table.Entry("a limit that isn't a number", func(string) string { return "limit=ten" }, "limit"),
+		table.Entry("an unknown field", func(string) string { return "fields=name,secret" }, "fields"),
+		table.Entry("a cursor that doesn't decode", func(string) string { return "cursor=not*a*cursor" }, "cursor"),
+		table.Entry("a cursor from a different sort", func(cursor string) string { return "sort=-event_count&cursor=" + cursor }, "cursor"),
+	)
+})
@@ -22,11 +22,15 @@ import (
 	"github.com/gorilla/mux"
 	"app-metrics-nozzle/usageevents"
 	"github.com/unrolled/render"
+	"sort"
 	"strings"
+	"strconv"
 	"app-metrics-nozzle/domain"
+	"app-metrics-nozzle/filter"
 	
 	"log"
 	"os"
+	"sync/atomic"
 	"time"
 	"net/smtp"
 	"net/mail"
@@ -35,20 +39,26 @@ import (
 	// TODO: this import needs to point to github. fix using glide.yaml file
 	"app-metrics-nozzle/email"
 	//github.com/scorredoira/email
-	"gopkg.in/alecthomas/kingpin.v2"
 )
 
+// ReportSettings configure the report and notification emails. Main sets them at start-up and again when
+// the configuration is reloaded.
+type ReportSettings struct {
+	Subject        string
+	Body           string
+	AttachmentName string
+	TimeZone       string
+	Filter         string
+	Sender         string
+	Receiver       string
+	ServerHost     string
+	ServerPort     string
+	UserName       string
+	UserPassword   string
+}
+
 var(
-	emailSubject = kingpin.Flag("email-subject", "Report email's subject.").Default("Report").OverrideDefaultFromEnvar("EMAIL_SUBJECT").String()
-	emailBody = kingpin.Flag("email-body", "Report email's body.").Default("Please find attachment for the report.").OverrideDefaultFromEnvar("EMAIL_BODY").String()
-	emailSender = kingpin.Flag("email-sender", "Report sender name.").Default("Admin").OverrideDefaultFromEnvar("EMAIL_SENDER").String()
-	emailReceiver = kingpin.Flag("email-receiver", "Report receiver email address.").Default("user@email.com").OverrideDefaultFromEnvar("EMAIL_RECEIVER").String()
-	emailServerHost = kingpin.Flag("email-server-host", "SMTP server address.").Default("localhost").OverrideDefaultFromEnvar("EMAIL_SERVER_HOST").String()
-	emailServerPort = kingpin.Flag("email-server-port", "SMTP server port.").Default("25").OverrideDefaultFromEnvar("EMAIL_SERVER_PORT").String()
-	emailAttachmentName = kingpin.Flag("email-attachment-name", "Report name.").Default("Report.csv").OverrideDefaultFromEnvar("EMAIL_ATTACHMENT_NAME").String()
-	emailUserName = kingpin.Flag("email-user-name", "Report sender's email address.").Default("admin@email.com").OverrideDefaultFromEnvar("EMAIL_USER_NAME").String()
-	emailUserPassword = kingpin.Flag("email-user-password", "Report sender's email account password.").Default("password").OverrideDefaultFromEnvar("EMAIL_USER_PASSWORD").String()
-	reportTimeZone = kingpin.Flag("report-time-zone", "Time zone of the report").Default("Australia/Sydney").OverrideDefaultFromEnvar("REPORT_TIME_ZONE").String()
+	reportSettings atomic.Value
 	
 	timeZoneLocation time.Location
 )
@@ -59,7 +69,38 @@ func appAllHandler(formatter *render.Render) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
 		w.Header().Add("Access-Control-Allow-Methods", "GET")
-		formatter.JSON(w, http.StatusOK, usageevents.AppDetails)
+
+		appFilter, err := filter.Parse(req.URL.Query().Get("filter"))
+		if err != nil {
+			writeProblem(w, req, problemInvalidParameter.With("parameter", "filter"), err.Error())
+			return
+		}
+
+		allApps := usageevents.AppDetailsSnapshot
+		if includeDeleted, _ := strconv.ParseBool(req.URL.Query().Get("include_deleted")); includeDeleted {
+			allApps = usageevents.AllAppDetailsSnapshot
+		}
+
+		grant := grantFor(req)
+		now := usageevents.Now()
+		visibleApps := make(map[string]domain.App)
+		for idx, appDetail := range allApps() {
+			if grant.AllowsSpace(appDetail.Organization.Name, appDetail.Space.Name) && appFilter.Match(appDetail, now) {
+				visibleApps[idx] = appDetail
+			}
+		}
+
+		if LegacyAppMap {
+			formatter.JSON(w, http.StatusOK, visibleApps)
+			return
+		}
+
+		page, invalid := pageApps(visibleApps, req.URL.Query())
+		if invalid != nil {
+			writeProblem(w, req, problemInvalidParameter.With("parameter", invalid.name), invalid.detail)
+			return
+		}
+		formatter.JSON(w, http.StatusOK, page)
 	}
 }
 
@@ -72,7 +113,13 @@ func appOrgHandler(formatter *render.Render) http.HandlerFunc {
 		org := vars["org"]
 		searchKey := fmt.Sprintf("%s/", org)
 
-		searchApps(searchKey, w, formatter)
+		grant := grantFor(req)
+		if !grant.TouchesOrg(org) {
+			writeProblem(w, req, problemForbidden, fmt.Sprintf("Not authorized for org %s", org))
+			return
+		}
+
+		searchApps(searchKey, grant, w, req, formatter)
 	}
 }
 
@@ -86,16 +133,29 @@ func appSpaceHandler(formatter *render.Render) http.HandlerFunc {
 		space := vars["space"]
 		searchKey := fmt.Sprintf("%s/%s/", org, space)
 
-		searchApps(searchKey, w, formatter)
+		grant := grantFor(req)
+		if !grant.AllowsSpace(org, space) {
+			writeProblem(w, req, problemForbidden, fmt.Sprintf("Not authorized for space %s/%s", org, space))
+			return
+		}
+
+		searchApps(searchKey, grant, w, req, formatter)
 	}
 }
 
-func searchApps(searchKey string, w http.ResponseWriter, formatter *render.Render) {
-	allAppDetails := usageevents.AppDetails
+func searchApps(searchKey string, grant Grant, w http.ResponseWriter, req *http.Request, formatter *render.Render) {
+	appFilter, err := filter.Parse(req.URL.Query().Get("filter"))
+	if err != nil {
+		writeProblem(w, req, problemInvalidParameter.With("parameter", "filter"), err.Error())
+		return
+	}
+
+	allAppDetails := usageevents.AppDetailsSnapshot()
 	foundApps := make(map[string]domain.App)
+	now := usageevents.Now()
 
 	for idx, appDetail := range allAppDetails {
-		if strings.HasPrefix(idx, searchKey) {
+		if strings.HasPrefix(idx, searchKey) && grant.AllowsSpace(appDetail.Organization.Name, appDetail.Space.Name) && appFilter.Match(appDetail, now) {
 			foundApps[idx] = appDetail
 		}
 	}
@@ -103,7 +163,7 @@ func searchApps(searchKey string, w http.ResponseWriter, formatter *render.Rende
 	if 0 < len(foundApps) {
 		formatter.JSON(w, http.StatusOK, foundApps)
 	} else {
-		formatter.JSON(w, http.StatusNotFound, "No such app")
+		writeProblem(w, req, problemAppNotFound, fmt.Sprintf("No apps found under %s", req.URL.Path))
 	}
 }
 
@@ -117,49 +177,102 @@ func appHandler(formatter *render.Render) http.HandlerFunc {
 		app := vars["app"]
 		org := vars["org"]
 		space := vars["space"]
+
+		if !grantFor(req).AllowsSpace(org, space) {
+			writeProblem(w, req, problemForbidden, fmt.Sprintf("Not authorized for space %s/%s", org, space))
+			return
+		}
+
 		key := usageevents.GetMapKeyFromAppData(org, space, app)
-		stat, exists := usageevents.AppDetails[key]
+		stat, exists := usageevents.AppDetailsSnapshot()[key]
 
 		if exists {
 			//todo calc needed statistics before serving
 			formatter.JSON(w, http.StatusOK, stat)
 		} else {
-			formatter.JSON(w, http.StatusNotFound, "No such app")
+			writeProblem(w, req, problemAppNotFound, fmt.Sprintf("No apps found under %s", req.URL.Path))
 		}
 	}	
 }
 
+// appGUIDHandler looks an app up by GUID, which keeps working across renames and moves between spaces.
+func appGUIDHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		w.Header().Add("Access-Control-Allow-Methods", "GET")
+
+		guid := mux.Vars(req)["guid"]
+		stat, exists := usageevents.AppByGUID(guid)
+		if !exists {
+			writeProblem(w, req, problemAppNotFound, fmt.Sprintf("No app with guid %s", guid))
+			return
+		}
+
+		if !grantFor(req).AllowsSpace(stat.Organization.Name, stat.Space.Name) {
+			writeProblem(w, req, problemForbidden, fmt.Sprintf("Not authorized for space %s/%s", stat.Organization.Name, stat.Space.Name))
+			return
+		}
+		formatter.JSON(w, http.StatusOK, stat)
+	}
+}
+
 func generateReportHandler(formatter *render.Render) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
 		w.Header().Add("Access-Control-Allow-Methods", "GET")
+
+		if !grantFor(req).Admin {
+			writeProblem(w, req, problemForbidden, "Sending reports requires admin access")
+			return
+		}
 		
-		reportData := GenerateReport()
-		err := SendReport(reportData)
+		appFilter, err := ReportFilter()
+		if expression := req.URL.Query().Get("filter"); expression != "" {
+			appFilter, err = filter.Parse(expression)
+		}
 		if err != nil {
-			logger.Println(err)
+			writeProblem(w, req, problemInvalidParameter.With("parameter", "filter"), err.Error())
+			return
+		}
+
+		reportData := GenerateReport(appFilter)
+		if err := SendReport(reportData); err != nil {
+			logger.Println("Error sending report:", err)
+			writeProblem(w, req, problemInternal, fmt.Sprintf("Sending the report failed: %s", err))
+			return
 		}
 		
 		formatter.JSON(w, http.StatusOK, "Report is sent to admin email account. Kindly check.")
 	}
 }
 
+// SetReportSettings replaces the settings of the emails sent from now on.
+func SetReportSettings(settings ReportSettings) {
+	reportSettings.Store(settings)
+}
+
+func currentReportSettings() ReportSettings {
+	settings, _ := reportSettings.Load().(ReportSettings)
+	return settings
+}
+
 // Emails the report
 func SendReport(reportData []byte) error {
-	m := email.NewMessage(*emailSubject, *emailBody)
+	settings := currentReportSettings()
+	m := email.NewMessage(settings.Subject, settings.Body)
 	m.From = mail.Address{
-		Name: *emailSender,
-		Address: *emailUserName,
+		Name: settings.Sender,
+		Address: settings.UserName,
 	}
-	m.To = []string{*emailReceiver}
+	m.To = []string{settings.Receiver}
 		
-	m.Attachments[*emailAttachmentName] = &email.Attachment{
-		Filename: *emailAttachmentName,
+	m.Attachments[settings.AttachmentName] = &email.Attachment{
+		Filename: settings.AttachmentName,
 		Data:     reportData,
 		Inline:   false,
 	}
 	
-	err := email.Send(*emailServerHost + ":" + *emailServerPort, smtp.PlainAuth("", *emailUserName, *emailUserPassword, *emailServerHost), m)
+	err := email.Send(settings.ServerHost + ":" + settings.ServerPort, smtp.PlainAuth("", settings.UserName, settings.UserPassword, settings.ServerHost), m)
 	if err != nil {
 		log.Println(err)
 	}
@@ -167,38 +280,108 @@ func SendReport(reportData []byte) error {
 	return err;
 }
 
-// generateReport returns the report with cache data
-func GenerateReport() []byte {
+// SendNotification emails a plain text notification to the report receiver.
+func SendNotification(subject string, body string) error {
+	settings := currentReportSettings()
+	m := email.NewMessage(subject, body)
+	m.From = mail.Address{
+		Name: settings.Sender,
+		Address: settings.UserName,
+	}
+	m.To = []string{settings.Receiver}
+
+	return email.Send(settings.ServerHost + ":" + settings.ServerPort, smtp.PlainAuth("", settings.UserName, settings.UserPassword, settings.ServerHost), m)
+}
+
+// ReportFilter parses the configured report filter. A nil filter selects every app.
+func ReportFilter() (*filter.Filter, error) {
+	return filter.Parse(currentReportSettings().Filter)
+}
+
+// deletionStatus describes when a deleted app went away and how long it had been idle by then, e.g.
+// "deleted 3 days ago after 90 days idle". It is empty for apps that still exist.
+func deletionStatus(app domain.App, now time.Time) string {
+	if app.DeletedAt == 0 {
+		return ""
+	}
+	deletedAt := time.Unix(0, app.DeletedAt)
+	if app.LastEventTime == 0 {
+		return fmt.Sprintf("deleted %s ago, unused since the nozzle started", days(now.Sub(deletedAt)))
+	}
+	return fmt.Sprintf("deleted %s ago after %s idle", days(now.Sub(deletedAt)), days(deletedAt.Sub(time.Unix(0, app.LastEventTime))))
+}
+
+func days(d time.Duration) string {
+	count := int(d.Hours() / 24)
+	switch {
+	case count < 1:
+		return "less than a day"
+	case count == 1:
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", count)
+}
+
+// reportTime formats a time of the report in its time zone, e.g. "19/10/2016, 12:00:00".
+func reportTime(unixNano int64, timeZone string) string {
+	// TODO: move this timezone declaration to global.
+	timeZoneLocation, err := time.LoadLocation(timeZone)
+	if err != nil {
+		logger.Println("Error loading timezone. Falling back to server time zone:", err)
+		return time.Unix(0, unixNano).Format("02/01/2006, 15:04:05")
+	}
+	return time.Unix(0, unixNano).In(timeZoneLocation).Format("02/01/2006, 15:04:05")
+}
+
+// sourcesSummary lists when each source type was last seen for the app and how many of its log messages
+// there were, e.g. "APP/PROC 19/10/2016, 12:00:00 (30); RTR 18/10/2016, 09:30:00 (120)".
+func sourcesSummary(app domain.App, timeZone string) string {
+	sources := make([]string, 0, len(app.Sources))
+	for source := range app.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	parts := make([]string, 0, len(sources))
+	for _, source := range sources {
+		usage := app.Sources[source]
+		parts = append(parts, fmt.Sprintf("%s %s (%d)", source, reportTime(usage.LastEventTime, timeZone), usage.EventCount))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// GenerateReport returns the CSV report of the apps appFilter selects, with cache data.
+func GenerateReport(appFilter *filter.Filter) []byte {
+	return ReportFor(usageevents.AllAppDetailsSnapshot(), appFilter)
+}
+
+// ReportFor returns the report of the given apps, such as app usage saved in the state file.
+func ReportFor(apps map[string]domain.App, appFilter *filter.Filter) []byte {
 	var rows [][]string
-	colhdrs := []string{"Org", "Space", "App Name", "Last accessed time"}
+	colhdrs := []string{"Org", "Space", "App Name", "Last accessed time", "Status", "Last seen by source"}
 	rows = append(rows, colhdrs)
 	
 	// get the data from each struct
-	for _, v := range usageevents.AppDetails {
-		if v.Name == "" {
+	now := usageevents.Now()
+	timeZone := currentReportSettings().TimeZone
+	for _, v := range apps {
+		if v.Name == "" || !appFilter.Match(v, now) {
 			continue;
 		}
 		
-        row := make([]string, 0, 4)
+        row := make([]string, 0, 6)
 
 		row = append(row, v.Organization.Name)
 		row = append(row, v.Space.Name)
 		row = append(row, v.Name)
 		
 		if v.LastEventTime > 0 {
-			// time zone for the report generation 
-			// TODO: move this timezone declaration to global.
-			timeZoneLocation, err := time.LoadLocation(*reportTimeZone)
-			if err != nil {
-				logger.Println("Error loading timezone. Falling back to server time zone:", err)
-		        row = append(row, time.Unix(0, v.LastEventTime).Format("02/01/2006, 15:04:05"))
-		    } else{
-		    	zoneSpecificTime := time.Unix(0, v.LastEventTime).In(timeZoneLocation)
-			    row = append(row, zoneSpecificTime.Format("02/01/2006, 15:04:05"))
-		    }
+			row = append(row, reportTime(v.LastEventTime, timeZone))
 		} else {
 			row = append(row, "NEVER")
 		}
+		row = append(row, deletionStatus(v, now))
+		row = append(row, sourcesSummary(v, timeZone))
         rows = append(rows, row)
 	}
 
@@ -0,0 +1,138 @@
+package service_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/domain"
+	"app-metrics-nozzle/restgate"
+	"app-metrics-nozzle/service"
+	"app-metrics-nozzle/usageevents"
+	"app-metrics-nozzle/usageevents/usageeventsfakes"
+	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
+	"github.com/cloudfoundry/sonde-go/events"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("App collection handlers", func() {
+	var server http.Handler
+
+	BeforeEach(func() {
+		server = newTestServer(service.AuthConfig{})
+		addApp("listing-guid-1", "Pivotal", "ashumilov", "listing")
+	})
+
+	for _, path := range []string{"/api/apps", "/api/apps/Pivotal", "/api/apps/Pivotal/ashumilov"} {
+		path := path
+
+		It("lists "+path+" without a filter", func() {
+			Expect(get(server, path).Code).To(Equal(http.StatusOK))
+			Expect(get(server, path+"?filter=").Code).To(Equal(http.StatusOK))
+			Expect(get(server, path+"?filter=%20%20").Code).To(Equal(http.StatusOK))
+		})
+
+		It("rejects an invalid filter on "+path, func() {
+			Expect(get(server, path+`?filter=state%20==`).Code).To(Equal(http.StatusBadRequest))
+		})
+	}
+
+	It("looks an app up by GUID", func() {
+		response := get(server, "/api/apps/guid/listing-guid-1")
+		Expect(response.Code).To(Equal(http.StatusOK))
+
+		var app domain.App
+		Expect(json.Unmarshal(response.Body.Bytes(), &app)).To(Succeed())
+		Expect(app.GUID).To(Equal("listing-guid-1"))
+		Expect(app.Name).To(Equal("listing"))
+
+		Expect(get(server, "/api/apps/guid/no-such-guid").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("forbids looking up an app by GUID outside the grant", func() {
+		server = newTestServer(service.AuthConfig{Authorization: service.NewAuthorizer(map[string]service.Grant{
+			"key:" + testKey: {Orgs: []string{"team-a"}},
+		})})
+		defer newTestServer(service.AuthConfig{})
+
+		Expect(get(server, "/api/apps/guid/listing-guid-1").Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("evaluates relative filters against the nozzle's clock", func() {
+		recorded := time.Date(2016, 10, 19, 12, 0, 0, 0, time.UTC)
+		usageevents.SetClock(func() time.Time { return recorded })
+		defer usageevents.SetClock(time.Now)
+		addApp("clocked-guid-1", "clocked", "space", "clocked")
+
+		usageevents.SetClock(func() time.Time { return recorded.Add(10 * 24 * time.Hour) })
+		for _, path := range []string{"/api/apps", "/api/apps/clocked", "/api/apps/clocked/space"} {
+			response := get(server, path+`?filter=name%20==%20"clocked"%20and%20last_event_time%20>%20now-30d`)
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Body.String()).To(ContainSubstring("clocked-guid-1"))
+		}
+	})
+
+	It("reports a failure to send the report", func() {
+		// Nothing listens on the port of a closed listener
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		host, port, _ := net.SplitHostPort(listener.Addr().String())
+		listener.Close()
+
+		service.SetReportSettings(service.ReportSettings{ServerHost: host, ServerPort: port, Receiver: "ops@example.com", AttachmentName: "report.csv"})
+		defer service.SetReportSettings(service.ReportSettings{})
+
+		response := get(server, "/api/report/email")
+		Expect(response.Code).To(Equal(http.StatusInternalServerError))
+		Expect(response.Body.String()).To(ContainSubstring("internal-error"))
+	})
+})
+
+const (
+	testKey    = "test-key"
+	testSecret = "test-secret"
+)
+
+var testSecretHash string
+
+// newTestServer returns the API with auth's credentials replaced by the test key.
+func newTestServer(auth service.AuthConfig) http.Handler {
+	if testSecretHash == "" {
+		hash, err := restgate.HashSecret(testSecret)
+		Expect(err).ToNot(HaveOccurred())
+		testSecretHash = hash
+	}
+	auth.Credentials = restgate.NewCredentialStore([]restgate.Credential{{Name: testKey, Key: testKey, SecretHash: testSecretHash}})
+	return service.NewServer(auth)
+}
+
+// get requests path with the test key.
+func get(server http.Handler, path string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", path, nil)
+	Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("X-Auth-Key", testKey)
+	req.Header.Set("X-Auth-Secret", testSecret)
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// addApp records a request to an app, which makes it known under org/space/name.
+func addApp(guid string, org string, space string, name string) {
+	savedCache := usageevents.AppDbCache
+	defer func() { usageevents.AppDbCache = savedCache }()
+
+	fakeCaching := new(usageeventsfakes.FakeCachedApp)
+	fakeCaching.GetAppInfoReturns(caching.App{Guid: guid, Name: name, SpaceName: space, SpaceGuid: space + "-guid", OrgName: org, OrgGuid: org + "-guid"})
+	usageevents.AppDbCache = fakeCaching
+
+	sourceType := "RTR"
+	message := `app.example.com - [19/10/2016:12:00:00 +0000] "GET / HTTP/1.1" 200 0 12 "-" "curl"`
+	usageevents.ProcessEvent(&events.Envelope{
+		EventType:  events.Envelope_LogMessage.Enum(),
+		LogMessage: &events.LogMessage{AppId: &guid, SourceType: &sourceType, Message: []byte(message)},
+	})
+}
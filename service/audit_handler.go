@@ -0,0 +1,121 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"app-metrics-nozzle/audit"
+	"app-metrics-nozzle/restgate"
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+)
+
+// AuditLog is set by main when auditing is enabled.
+var AuditLog *audit.Log
+
+// auditEventKey holds the request's pending audit event in the gorilla context, so C can fill in the identity.
+const auditEventKey = "audit-event"
+
+// auditor records every request to the secured API, including the ones RestGate turns away.
+// The client IP is the right-most X-Forwarded-For entry not appended by one of the trustedProxies, as for the failure limit.
+func auditor(router *mux.Router, trustedProxies int) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		if AuditLog == nil {
+			next(w, req)
+			return
+		}
+
+		start := time.Now()
+		event := &audit.Event{Time: start, Method: req.Method, Path: req.URL.Path, ClientIP: restgate.ClientIP(req, trustedProxies)}
+
+		var match mux.RouteMatch
+		if router.Match(req, &match) {
+			event.Route, _ = match.Route.GetPathTemplate()
+			event.Org = match.Vars["org"]
+			event.Space = match.Vars["space"]
+		}
+
+		context.Set(req, auditEventKey, event)
+		next(w, req)
+
+		event.Status = http.StatusOK
+		if rw, ok := w.(negroni.ResponseWriter); ok && rw.Status() != 0 {
+			event.Status = rw.Status()
+		}
+		event.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+		AuditLog.Record(*event)
+	}
+}
+
+func auditHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		w.Header().Add("Access-Control-Allow-Methods", "GET")
+
+		if !grantFor(req).Admin {
+			writeProblem(w, req, problemForbidden, "Reading the audit log requires admin access")
+			return
+		}
+
+		if !AuditLog.Queryable() {
+			writeProblem(w, req, problemNotConfigured, "Audit log is not configured")
+			return
+		}
+
+		query := req.URL.Query()
+		to := time.Now()
+		from := to.Add(-24 * time.Hour)
+		limit := 1000
+		var err error
+
+		if value := query.Get("from"); value != "" {
+			if from, err = time.Parse(time.RFC3339, value); err != nil {
+				writeProblem(w, req, problemInvalidParameter.With("parameter", "from"), fmt.Sprintf("from must be an RFC3339 time: %v", err))
+				return
+			}
+		}
+		if value := query.Get("to"); value != "" {
+			if to, err = time.Parse(time.RFC3339, value); err != nil {
+				writeProblem(w, req, problemInvalidParameter.With("parameter", "to"), fmt.Sprintf("to must be an RFC3339 time: %v", err))
+				return
+			}
+		}
+		if value := query.Get("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+				writeProblem(w, req, problemInvalidParameter.With("parameter", "limit"), "limit must be a positive integer")
+				return
+			}
+		}
+
+		events, err := AuditLog.Query(from, to, limit)
+		if err != nil {
+			logger.Println("Error querying audit log:", err)
+			writeProblem(w, req, problemInternal, "Error reading the audit log")
+			return
+		}
+		if events == nil {
+			events = []audit.Event{}
+		}
+		formatter.JSON(w, http.StatusOK, events)
+	}
+}
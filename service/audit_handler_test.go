@@ -0,0 +1,54 @@
+package service_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/audit"
+	"app-metrics-nozzle/service"
+	"net/http"
+	"net/http/httptest"
+)
+
+// recordingSink keeps the audit events written to it.
+type recordingSink struct {
+	events []audit.Event
+}
+
+func (s *recordingSink) Write(event audit.Event) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+var _ = Describe("Audit handler", func() {
+	var (
+		sink     *recordingSink
+		savedLog *audit.Log
+	)
+
+	BeforeEach(func() {
+		sink = &recordingSink{}
+		savedLog = service.AuditLog
+		service.AuditLog = audit.NewLog(sink)
+	})
+
+	AfterEach(func() {
+		service.AuditLog = savedLog
+	})
+
+	It("records the client IP behind the trusted proxies, not the one a client claims", func() {
+		server := newTestServer(service.AuthConfig{TrustedProxies: 2})
+
+		req, err := http.NewRequest("GET", "/api/apps", nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.RemoteAddr = "10.0.0.1:50000"
+		req.Header.Set("X-Forwarded-For", "6.6.6.6, 203.0.113.7, 10.0.0.2")
+		req.Header.Set("X-Auth-Key", testKey)
+		req.Header.Set("X-Auth-Secret", testSecret)
+		server.ServeHTTP(httptest.NewRecorder(), req)
+
+		Expect(sink.events).To(HaveLen(1))
+		Expect(sink.events[0].ClientIP).To(Equal("203.0.113.7"))
+		Expect(sink.events[0].Identity).To(Equal("key:" + testKey))
+	})
+})
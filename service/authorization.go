@@ -0,0 +1,161 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"app-metrics-nozzle/restgate"
+	"github.com/gorilla/context"
+)
+
+// Grant lists what an authenticated key or token may see. Spaces are written as "org/space".
+type Grant struct {
+	Admin  bool     `json:"admin"`
+	Orgs   []string `json:"orgs"`
+	Spaces []string `json:"spaces"`
+}
+
+var adminGrant = Grant{Admin: true}
+
+// AllowsOrg reports whether the grant covers every space of an org.
+func (g Grant) AllowsOrg(org string) bool {
+	if g.Admin {
+		return true
+	}
+	for _, allowed := range g.Orgs {
+		if allowed == org {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsSpace reports whether the grant covers a space, either directly or through its org.
+func (g Grant) AllowsSpace(org string, space string) bool {
+	if g.AllowsOrg(org) {
+		return true
+	}
+	key := fmt.Sprintf("%s/%s", org, space)
+	for _, allowed := range g.Spaces {
+		if allowed == key {
+			return true
+		}
+	}
+	return false
+}
+
+// TouchesOrg reports whether the grant covers the org or at least one of its spaces.
+func (g Grant) TouchesOrg(org string) bool {
+	if g.AllowsOrg(org) {
+		return true
+	}
+	for _, allowed := range g.Spaces {
+		if strings.HasPrefix(allowed, org+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// identityPrefixes are the kinds of identities RestGate authenticates. Grants are keyed by the full identity,
+// e.g. "key:ops-dashboard" or "uaa-user:alice".
+var identityPrefixes = []string{restgate.KeyIdentityPrefix, restgate.UAAUserIdentityPrefix, restgate.UAAClientIdentityPrefix, restgate.CertIdentityPrefix}
+
+// Authorizer maps authenticated identities (credential names, UAA users or clients, client certificates) to grants.
+type Authorizer struct {
+	grants map[string]Grant
+	lock   sync.RWMutex
+}
+
+func NewAuthorizer(grants map[string]Grant) *Authorizer {
+	a := &Authorizer{}
+	a.Replace(grants)
+	return a
+}
+
+// Replace swaps all grants atomically.
+func (a *Authorizer) Replace(grants map[string]Grant) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.grants = grants
+}
+
+// Grant returns the identity's grant. Unknown identities get an empty grant that allows nothing.
+func (a *Authorizer) Grant(identity string) Grant {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.grants[identity]
+}
+
+// LoadAuthorizationFile reads a JSON object mapping identities to grants. Identities must name their kind, as in
+// "key:<credential name>", "uaa-user:<user name>", "uaa-client:<client id>" or "cert:<certificate identity>".
+func LoadAuthorizationFile(path string) (map[string]Grant, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var grants map[string]Grant
+	if err := json.Unmarshal(data, &grants); err != nil {
+		return nil, fmt.Errorf("parsing authorization file %s: %v", path, err)
+	}
+
+	for identity, grant := range grants {
+		if !hasIdentityPrefix(identity) {
+			return nil, fmt.Errorf("grant for %s: identity must start with one of %s", identity, strings.Join(identityPrefixes, ", "))
+		}
+		for _, space := range grant.Spaces {
+			if strings.Count(space, "/") != 1 {
+				return nil, fmt.Errorf("grant for %s: space %q must be written as org/space", identity, space)
+			}
+		}
+	}
+	return grants, nil
+}
+
+func hasIdentityPrefix(identity string) bool {
+	for _, prefix := range identityPrefixes {
+		if strings.HasPrefix(identity, prefix) && len(identity) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizer is nil when no authorization is configured, in which case every authenticated caller is an admin.
+var authorizer *Authorizer
+
+// identityKey holds the identity RestGate authenticated in the request's context.
+type identityKey struct{}
+
+// grantFor returns the grant of the identity RestGate authenticated for this request.
+func grantFor(req *http.Request) Grant {
+	if authorizer == nil {
+		return adminGrant
+	}
+	identity, ok := req.Context().Value(identityKey{}).(string)
+	if !ok {
+		identity, _ = context.Get(req, 0).(string)
+	}
+	return authorizer.Grant(identity)
+}
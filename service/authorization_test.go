@@ -0,0 +1,119 @@
+package service_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/service"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Authorization", func() {
+	Describe("Grant", func() {
+		grant := service.Grant{Orgs: []string{"team-a"}, Spaces: []string{"team-b/dev"}}
+
+		It("allows the spaces of its orgs and its own spaces", func() {
+			Expect(grant.AllowsSpace("team-a", "prod")).To(BeTrue())
+			Expect(grant.AllowsSpace("team-b", "dev")).To(BeTrue())
+			Expect(grant.AllowsSpace("team-b", "prod")).To(BeFalse())
+			Expect(grant.AllowsSpace("team-c", "dev")).To(BeFalse())
+			Expect(service.Grant{Admin: true}.AllowsSpace("team-c", "dev")).To(BeTrue())
+		})
+
+		It("touches the orgs it has a space in", func() {
+			Expect(grant.TouchesOrg("team-a")).To(BeTrue())
+			Expect(grant.TouchesOrg("team-b")).To(BeTrue())
+			Expect(grant.TouchesOrg("team")).To(BeFalse())
+			Expect(service.Grant{}.TouchesOrg("team-a")).To(BeFalse())
+		})
+	})
+
+	Describe("LoadAuthorizationFile", func() {
+		var dir string
+
+		load := func(content string) (map[string]service.Grant, error) {
+			path := filepath.Join(dir, "authorization.json")
+			Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(Succeed())
+			return service.LoadAuthorizationFile(path)
+		}
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "authorization")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("reads grants keyed by identity kind and name", func() {
+			grants, err := load(`{"key:ops": {"admin": true}, "uaa-user:ops": {"spaces": ["team-b/dev"]}, "uaa-client:ci": {"orgs": ["team-a"]}, "cert:billing": {}}`)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(grants).To(HaveLen(4))
+			Expect(grants["key:ops"].Admin).To(BeTrue())
+			Expect(grants["uaa-user:ops"].Admin).To(BeFalse())
+		})
+
+		It("refuses identities without a kind", func() {
+			_, err := load(`{"ops": {"admin": true}}`)
+			Expect(err).To(MatchError(ContainSubstring("identity must start with one of")))
+			_, err = load(`{"key:": {"admin": true}}`)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("refuses spaces not written as org/space", func() {
+			_, err := load(`{"key:ops": {"spaces": ["dev"]}}`)
+			Expect(err).To(MatchError(ContainSubstring("must be written as org/space")))
+		})
+	})
+
+	Describe("API", func() {
+		var server http.Handler
+
+		BeforeEach(func() {
+			addApp("authorized-guid-1", "team-b", "dev", "allowed")
+			addApp("authorized-guid-2", "team-b", "prod", "hidden")
+			server = newTestServer(service.AuthConfig{Authorization: service.NewAuthorizer(map[string]service.Grant{
+				"key:" + testKey:      {Spaces: []string{"team-b/dev"}},
+				"uaa-user:" + testKey: {Admin: true},
+				"cert:" + testKey:     {Admin: true},
+			})})
+		})
+
+		AfterEach(func() {
+			// Leave the other specs with a server that lets every caller see everything
+			newTestServer(service.AuthConfig{})
+		})
+
+		It("does not hand a key the grant of a UAA user or certificate with the same name", func() {
+			Expect(get(server, "/api/report/email").Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("forbids orgs and spaces outside the grant", func() {
+			Expect(get(server, "/api/apps/team-a").Code).To(Equal(http.StatusForbidden))
+			Expect(get(server, "/api/apps/team-b/prod").Code).To(Equal(http.StatusForbidden))
+			Expect(get(server, "/api/apps/team-b/prod/hidden").Code).To(Equal(http.StatusForbidden))
+			Expect(get(server, "/api/apps/team-b/dev/allowed").Code).To(Equal(http.StatusOK))
+		})
+
+		It("lists only the granted spaces", func() {
+			response := get(server, "/api/apps/team-b")
+			Expect(response.Code).To(Equal(http.StatusOK))
+
+			var apps map[string]interface{}
+			Expect(json.Unmarshal(response.Body.Bytes(), &apps)).To(Succeed())
+			Expect(apps).To(HaveKey("team-b/dev/allowed"))
+			Expect(apps).ToNot(HaveKey("team-b/prod/hidden"))
+		})
+
+		It("sees nothing without a grant", func() {
+			server = newTestServer(service.AuthConfig{Authorization: service.NewAuthorizer(map[string]service.Grant{"uaa-user:" + testKey: {Admin: true}})})
+			Expect(get(server, "/api/apps/team-b/dev").Code).To(Equal(http.StatusForbidden))
+		})
+	})
+})
@@ -0,0 +1,60 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"app-metrics-nozzle/cluster"
+	"app-metrics-nozzle/usageevents"
+	"github.com/unrolled/render"
+)
+
+// maxClusterPush bounds the body of a push; a full push carries one small entry per app.
+const maxClusterPush = 32 << 20
+
+// clusterHandler receives the counts another instance pushes. Instances authenticate with the shared
+// cluster secret rather than API credentials, so the route is not behind RestGate.
+func clusterHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if usageevents.Peers == nil {
+			writeProblem(w, req, problemNotConfigured, "Clustering is not configured")
+			return
+		}
+
+		secret := req.Header.Get(cluster.SecretHeader)
+		if secret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(usageevents.Peers.Secret)) != 1 {
+			writeProblem(w, req, problemForbidden, "Invalid cluster secret")
+			return
+		}
+
+		var state cluster.State
+		if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxClusterPush)).Decode(&state); err != nil {
+			writeProblem(w, req, problemInvalidBody, err.Error())
+			return
+		}
+		if state.Instance == "" {
+			writeProblem(w, req, problemInvalidBody, "Missing instance")
+			return
+		}
+
+		formatter.JSON(w, http.StatusOK, usageevents.Peers.Receive(state, time.Now()))
+	}
+}
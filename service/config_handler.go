@@ -0,0 +1,46 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"net/http"
+
+	"app-metrics-nozzle/config"
+	"github.com/unrolled/render"
+)
+
+// Config is set by main to the merged configuration of flags, environment variables and configuration file.
+var Config *config.Store
+
+// configHandler shows admins the effective configuration with secrets redacted.
+func configHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		w.Header().Add("Access-Control-Allow-Methods", "GET")
+
+		if !grantFor(req).Admin {
+			writeProblem(w, req, problemForbidden, "Reading the configuration requires admin access")
+			return
+		}
+		if Config == nil {
+			writeProblem(w, req, problemNotConfigured, "Configuration is not available")
+			return
+		}
+
+		formatter.JSON(w, http.StatusOK, Config.Dump())
+	}
+}
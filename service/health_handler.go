@@ -0,0 +1,81 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+
+	"app-metrics-nozzle/cluster"
+	"app-metrics-nozzle/usageevents"
+	"github.com/unrolled/render"
+)
+
+// Leader is set by main when instances elect one of them for scheduled reports and alert notifications.
+var Leader *cluster.Elector
+
+type sinkHealth struct {
+	Sink    string `json:"sink"`
+	Dropped uint64 `json:"dropped"`
+}
+
+type health struct {
+	Status   string                    `json:"status"`
+	Pipeline usageevents.PipelineStats `json:"pipeline"`
+	Resolver usageevents.ResolverStats `json:"resolver"`
+	Sinks    []sinkHealth              `json:"sinks"`
+	Cluster  *clusterHealth            `json:"cluster,omitempty"`
+	Leader   *cluster.LeaderStatus     `json:"leader,omitempty"`
+}
+
+type clusterHealth struct {
+	Instance  string               `json:"instance"`
+	Instances []string             `json:"instances"`
+	Peers     []cluster.PeerStatus `json:"peers"`
+}
+
+// healthHandler reports how the nozzle keeps up with the firehose: pipeline queue depth and drops, apps
+// waiting for a name, events dropped by each sink and, when clustered, the other instances heard from and
+// the leader.
+func healthHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		w.Header().Add("Access-Control-Allow-Methods", "GET")
+
+		status := health{
+			Status:   "ok",
+			Pipeline: usageevents.FirehosePipeline.Stats(),
+			Resolver: usageevents.AppResolver.Stats(),
+			Sinks:    make([]sinkHealth, 0, len(usageevents.Sinks)),
+		}
+		if status.Pipeline.QueueCapacity > 0 && status.Pipeline.QueueDepth == status.Pipeline.QueueCapacity {
+			status.Status = "backlogged"
+		}
+		for _, sink := range usageevents.Sinks {
+			status.Sinks = append(status.Sinks, sinkHealth{fmt.Sprint(sink), sink.Dropped()})
+		}
+		if usageevents.Peers != nil {
+			status.Cluster = &clusterHealth{Instance: usageevents.Peers.ID, Instances: usageevents.Peers.Instances(), Peers: usageevents.Peers.Peers()}
+		}
+		if Leader != nil {
+			leader := Leader.Status()
+			status.Leader = &leader
+		}
+
+		formatter.JSON(w, http.StatusOK, status)
+	}
+}
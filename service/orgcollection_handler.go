@@ -23,6 +23,9 @@ import (
 
 	"github.com/gorilla/mux"
 	"strings"
+	"fmt"
+	"path"
+	"github.com/cloudfoundry-community/go-cfclient"
 )
 
 
@@ -35,15 +38,27 @@ func spaceDetailsHandler(formatter *render.Render) http.HandlerFunc {
 		vars := mux.Vars(req)
 		space := vars["space"]
 
+		// Spaces of different orgs can share a name; answer with the first one the caller may see.
+		// /api/spaces/guid/{guid} selects a specific one.
+		grant := grantFor(req)
+		spaceOrgs := spaceOrgNames()
 		found := false
+		var allowed []cfclient.Space
 		for idx := range usageevents.Spaces {
 			if 0 == strings.Compare(space, usageevents.Spaces[idx].Name) {
 				found = true
-				formatter.JSON(w, http.StatusOK, usageevents.Spaces[idx])
+				if grant.AllowsSpace(spaceOrgs[usageevents.Spaces[idx].Guid], space) {
+					allowed = append(allowed, usageevents.Spaces[idx])
+				}
 			}
 		}
+
 		if !found {
-			formatter.JSON(w, http.StatusNotFound, "Space not found.")
+			writeProblem(w, req, problemSpaceNotFound, fmt.Sprintf("Space %s not found", space))
+		} else if len(allowed) == 0 {
+			writeProblem(w, req, problemForbidden, fmt.Sprintf("Not authorized for space %s", space))
+		} else {
+			formatter.JSON(w, http.StatusOK, allowed[0])
 		}
 	}
 }
@@ -53,10 +68,22 @@ func spaceHandler(formatter *render.Render) http.HandlerFunc {
 		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
 		w.Header().Add("Access-Control-Allow-Methods", "GET")
 
-		if 0 < len(usageevents.Spaces) {
-			formatter.JSON(w, http.StatusOK, usageevents.Spaces)
+		spaces := usageevents.Spaces
+		grant := grantFor(req)
+		if !grant.Admin {
+			spaceOrgs := spaceOrgNames()
+			spaces = make([]cfclient.Space, 0, len(usageevents.Spaces))
+			for _, space := range usageevents.Spaces {
+				if grant.AllowsSpace(spaceOrgs[space.Guid], space.Name) {
+					spaces = append(spaces, space)
+				}
+			}
+		}
+
+		if 0 < len(spaces) {
+			formatter.JSON(w, http.StatusOK, spaces)
 		} else {
-			formatter.JSON(w, http.StatusNotFound, "No spaces found.")
+			writeProblem(w, req, problemNoSpaces, "No spaces found")
 		}
 
 	}
@@ -70,6 +97,11 @@ func orgDetailsHandler(formatter *render.Render) http.HandlerFunc {
 		vars := mux.Vars(req)
 		org := vars["org"]
 
+		if !grantFor(req).TouchesOrg(org) {
+			writeProblem(w, req, problemForbidden, fmt.Sprintf("Not authorized for org %s", org))
+			return
+		}
+
 		found := false
 		for idx := range usageevents.Orgs {
 			if 0 == strings.Compare(org, usageevents.Orgs[idx].Name) {
@@ -78,8 +110,49 @@ func orgDetailsHandler(formatter *render.Render) http.HandlerFunc {
 			}
 		}
 		if !found {
-			formatter.JSON(w, http.StatusNotFound, "Org not found.")
+			writeProblem(w, req, problemOrgNotFound, fmt.Sprintf("Org %s not found", org))
+		}
+	}
+}
+
+func orgGUIDHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		w.Header().Add("Access-Control-Allow-Methods", "GET")
+
+		guid := mux.Vars(req)["guid"]
+		for idx := range usageevents.Orgs {
+			if usageevents.Orgs[idx].Guid == guid {
+				if !grantFor(req).TouchesOrg(usageevents.Orgs[idx].Name) {
+					writeProblem(w, req, problemForbidden, fmt.Sprintf("Not authorized for org %s", usageevents.Orgs[idx].Name))
+					return
+				}
+				formatter.JSON(w, http.StatusOK, usageevents.Orgs[idx])
+				return
+			}
+		}
+		writeProblem(w, req, problemOrgNotFound, fmt.Sprintf("No org with guid %s", guid))
+	}
+}
+
+func spaceGUIDHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		w.Header().Add("Access-Control-Allow-Methods", "GET")
+
+		guid := mux.Vars(req)["guid"]
+		for idx := range usageevents.Spaces {
+			if usageevents.Spaces[idx].Guid == guid {
+				space := usageevents.Spaces[idx].Name
+				if !grantFor(req).AllowsSpace(spaceOrgNames()[guid], space) {
+					writeProblem(w, req, problemForbidden, fmt.Sprintf("Not authorized for space %s", space))
+					return
+				}
+				formatter.JSON(w, http.StatusOK, usageevents.Spaces[idx])
+				return
+			}
 		}
+		writeProblem(w, req, problemSpaceNotFound, fmt.Sprintf("No space with guid %s", guid))
 	}
 }
 
@@ -88,11 +161,40 @@ func orgsHandler(formatter *render.Render) http.HandlerFunc {
 		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
 		w.Header().Add("Access-Control-Allow-Methods", "GET")
 
-		if 0 < len(usageevents.Orgs) {
-			formatter.JSON(w, http.StatusOK, usageevents.Orgs)
+		orgs := usageevents.Orgs
+		grant := grantFor(req)
+		if !grant.Admin {
+			orgs = make([]cfclient.Org, 0, len(usageevents.Orgs))
+			for _, org := range usageevents.Orgs {
+				if grant.TouchesOrg(org.Name) {
+					orgs = append(orgs, org)
+				}
+			}
+		}
+
+		if 0 < len(orgs) {
+			formatter.JSON(w, http.StatusOK, orgs)
 		} else {
-			formatter.JSON(w, http.StatusNotFound, "No organizations found.")
+			writeProblem(w, req, problemNoOrgs, "No organizations found")
 		}
 
 	}
-}
\ No newline at end of file
+}
+
+// spaceOrgNames maps space GUIDs to the name of their org, following the organization URL
+// (/v2/organizations/<guid>) the Cloud Controller lists each space with. Spaces whose org is unknown
+// map to no name, which only admins are allowed.
+func spaceOrgNames() map[string]string {
+	orgNames := make(map[string]string, len(usageevents.Orgs))
+	for _, org := range usageevents.Orgs {
+		orgNames[org.Guid] = org.Name
+	}
+
+	spaceOrgs := make(map[string]string, len(usageevents.Spaces))
+	for _, space := range usageevents.Spaces {
+		if space.OrgURL != "" {
+			spaceOrgs[space.Guid] = orgNames[path.Base(space.OrgURL)]
+		}
+	}
+	return spaceOrgs
+}
@@ -0,0 +1,66 @@
+package service_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/service"
+	"app-metrics-nozzle/usageevents"
+	"encoding/json"
+	"github.com/cloudfoundry-community/go-cfclient"
+	"net/http"
+)
+
+var _ = Describe("Space handlers", func() {
+	var (
+		server      http.Handler
+		savedOrgs   []cfclient.Org
+		savedSpaces []cfclient.Space
+	)
+
+	BeforeEach(func() {
+		savedOrgs, savedSpaces = usageevents.Orgs, usageevents.Spaces
+		// No apps are deployed in these spaces, so their orgs can only come from the Cloud Controller
+		usageevents.Orgs = []cfclient.Org{{Guid: "org-a-guid", Name: "team-a"}, {Guid: "org-b-guid", Name: "team-b"}}
+		usageevents.Spaces = []cfclient.Space{
+			{Guid: "space-a-dev", Name: "dev", OrgURL: "/v2/organizations/org-a-guid"},
+			{Guid: "space-b-dev", Name: "dev", OrgURL: "/v2/organizations/org-b-guid"},
+			{Guid: "space-b-prod", Name: "prod", OrgURL: "/v2/organizations/org-b-guid"},
+		}
+
+		server = newTestServer(service.AuthConfig{Authorization: service.NewAuthorizer(map[string]service.Grant{
+			"key:" + testKey: {Spaces: []string{"team-b/dev"}},
+		})})
+	})
+
+	AfterEach(func() {
+		usageevents.Orgs, usageevents.Spaces = savedOrgs, savedSpaces
+		newTestServer(service.AuthConfig{})
+	})
+
+	It("answers once with the space of that name the caller may see", func() {
+		response := get(server, "/api/spaces/dev")
+		Expect(response.Code).To(Equal(http.StatusOK))
+
+		var space cfclient.Space
+		Expect(json.Unmarshal(response.Body.Bytes(), &space)).To(Succeed())
+		Expect(space.Guid).To(Equal("space-b-dev"))
+	})
+
+	It("forbids spaces outside the grant and reports unknown ones", func() {
+		Expect(get(server, "/api/spaces/prod").Code).To(Equal(http.StatusForbidden))
+		Expect(get(server, "/api/spaces/guid/space-a-dev").Code).To(Equal(http.StatusForbidden))
+		Expect(get(server, "/api/spaces/guid/space-b-dev").Code).To(Equal(http.StatusOK))
+		Expect(get(server, "/api/spaces/staging").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("lists only the granted spaces", func() {
+		response := get(server, "/api/spaces")
+		Expect(response.Code).To(Equal(http.StatusOK))
+
+		var spaces []cfclient.Space
+		Expect(json.Unmarshal(response.Body.Bytes(), &spaces)).To(Succeed())
+		Expect(spaces).To(HaveLen(1))
+		Expect(spaces[0].Guid).To(Equal("space-b-dev"))
+	})
+})
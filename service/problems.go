@@ -0,0 +1,52 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"net/http"
+
+	"app-metrics-nozzle/jsonerror"
+)
+
+// problemTypeBase prefixes the type URIs of the problems in the catalog below.
+const problemTypeBase = "urn:app-metrics-nozzle:problem:"
+
+// Catalog of the errors the API responds with. The code extension member repeats the last part of
+// the type URI so clients can switch on it without parsing URIs.
+var (
+	problemForbidden        = newProblem("forbidden", "Forbidden", http.StatusForbidden)
+	problemAppNotFound      = newProblem("app-not-found", "No Such App", http.StatusNotFound)
+	problemSpaceNotFound    = newProblem("space-not-found", "Space Not Found", http.StatusNotFound)
+	problemOrgNotFound      = newProblem("org-not-found", "Org Not Found", http.StatusNotFound)
+	problemNoSpaces         = newProblem("no-spaces", "No Spaces Found", http.StatusNotFound)
+	problemNoOrgs           = newProblem("no-orgs", "No Organizations Found", http.StatusNotFound)
+	problemNotConfigured    = newProblem("not-configured", "Feature Not Configured", http.StatusNotFound)
+	problemInvalidParameter = newProblem("invalid-parameter", "Invalid Parameter", http.StatusBadRequest)
+	problemInvalidBody      = newProblem("invalid-body", "Invalid Request Body", http.StatusBadRequest)
+	problemInternal         = newProblem("internal-error", "Internal Server Error", http.StatusInternalServerError)
+)
+
+func newProblem(code string, title string, status int) jsonerror.Problem {
+	return jsonerror.NewProblem(problemTypeBase+code, title, status).With("code", code)
+}
+
+// writeProblem responds with a problem from the catalog, explained by detail, for the request's path.
+func writeProblem(w http.ResponseWriter, req *http.Request, problem jsonerror.Problem, detail string) {
+	if err := problem.WithDetail(detail).WithInstance(req.URL.Path).Write(w); err != nil {
+		logger.Println("Error writing problem response:", err)
+	}
+}
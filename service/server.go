@@ -24,29 +24,59 @@ import (
 	"app-metrics-nozzle/restgate"
 	//"github.com/pjebs/restgate"
 	
+	stdcontext "context"
 	"github.com/gorilla/context"
 	"net/http"
+	"strings"
+	"app-metrics-nozzle/audit"
 )
 
-// NewServer configures and returns a Server.
-func NewServer() *negroni.Negroni {
+// AuthConfig selects how API requests are authenticated.
+type AuthConfig struct {
+	// Credentials are the named keys accepted in the X-Auth-Key/X-Auth-Secret headers.
+	Credentials *restgate.CredentialStore
+	// TokenVerifier, if set, also accepts UAA bearer tokens in the Authorization header.
+	TokenVerifier *restgate.TokenVerifier
+	// SignatureVerifier, if set, also accepts requests HMAC signed with a credential's signing secret.
+	SignatureVerifier *restgate.SignatureVerifier
+	// CertificateMapper, if set, also accepts verified TLS client certificates whose subject it maps to an identity.
+	CertificateMapper *restgate.CertificateMapper
+	// Authorization limits identities to their orgs and spaces. When nil every authenticated caller is an admin.
+	Authorization *Authorizer
+	// RateLimiter throttles each authenticated identity, FailureLimiter failed attempts per client IP. Both are optional.
+	RateLimiter    *restgate.RateLimiter
+	FailureLimiter *restgate.RateLimiter
+	// TrustedProxies is how many proxies in front of the nozzle append to X-Forwarded-For, which tells the client IP.
+	TrustedProxies int
+	RequireHTTPS   bool
+}
+
+// NewServer configures and returns a Server whose API is protected according to auth.
+func NewServer(auth AuthConfig) *negroni.Negroni {
 
 	formatter := render.New(render.Options{
 		IndentJSON: true,
 	})
 
+	authorizer = auth.Authorization
+
 	n := negroni.Classic()
 	mx := mux.NewRouter()
 
-	initRoutes(mx, formatter)
+	initRoutes(mx, formatter, auth)
 
 	n.UseHandler(mx)
 	return n
 }
 
-func initRoutes(mx *mux.Router, formatter *render.Render) {
+func initRoutes(mx *mux.Router, formatter *render.Render, auth AuthConfig) {
 	//Create subrouters
 	secureRouter := mux.NewRouter()
+	// GUID routes go first: /api/apps/guid/{guid} would otherwise match /api/apps/{org}/{space}
+	secureRouter.HandleFunc("/api/apps/guid/{guid}", appGUIDHandler(formatter)).Methods("GET")
+	secureRouter.HandleFunc("/api/orgs/guid/{guid}", orgGUIDHandler(formatter)).Methods("GET")
+	secureRouter.HandleFunc("/api/spaces/guid/{guid}", spaceGUIDHandler(formatter)).Methods("GET")
+	secureRouter.HandleFunc("/api/apps/{org}/{space}/{app}/tail", tailHandler(formatter)).Methods("GET")
 	secureRouter.HandleFunc("/api/apps/{org}/{space}/{app}", appHandler(formatter)).Methods("GET")
 	secureRouter.HandleFunc("/api/apps/{org}/{space}", appSpaceHandler(formatter)).Methods("GET")
 	secureRouter.HandleFunc("/api/apps/{org}", appOrgHandler(formatter)).Methods("GET")
@@ -56,14 +86,24 @@ func initRoutes(mx *mux.Router, formatter *render.Render) {
 	secureRouter.HandleFunc("/api/spaces/{space}", spaceDetailsHandler(formatter)).Methods("GET")
 	secureRouter.HandleFunc("/api/spaces", spaceHandler(formatter)).Methods("GET")
 	secureRouter.HandleFunc("/api/report/email", generateReportHandler(formatter)).Methods("GET")
+	secureRouter.HandleFunc("/api/alerts", alertsHandler(formatter)).Methods("GET")
+	secureRouter.HandleFunc("/api/audit", auditHandler(formatter)).Methods("GET")
+	secureRouter.HandleFunc("/api/stream", streamHandler(formatter)).Methods("GET")
+	secureRouter.HandleFunc("/api/health", healthHandler(formatter)).Methods("GET")
+	secureRouter.HandleFunc("/api/config", configHandler(formatter)).Methods("GET")
 	
 	//Secure the endpoints
 	negRest := negroni.New()
-	negRest.Use(restgate.New("X-Auth-Key", "X-Auth-Secret", restgate.Static, restgate.Config{Context: C, Key: []string{"12345"}, Secret: []string{"secret"}, HTTPSProtectionOff: true}))
+	negRest.Use(auditor(secureRouter, auth.TrustedProxies))
+	negRest.Use(authenticator(auth))
 	negRest.UseHandler(secureRouter)
 
 	// Add subrouter to main route
-	// These endpoints are protected by RestGate via hardcoded KEYs
+	// These endpoints are protected by RestGate via the configured credentials
+	mx.Handle("/api/apps/guid/{guid}", negRest)
+	mx.Handle("/api/orgs/guid/{guid}", negRest)
+	mx.Handle("/api/spaces/guid/{guid}", negRest)
+	mx.Handle("/api/apps/{org}/{space}/{app}/tail", negRest)
 	mx.Handle("/api/apps/{org}/{space}/{app}", negRest)
 	mx.Handle("/api/apps/{org}/{space}", negRest)
 	mx.Handle("/api/apps/{org}", negRest)
@@ -73,10 +113,78 @@ func initRoutes(mx *mux.Router, formatter *render.Render) {
 	mx.Handle("/api/spaces/{space}", negRest)
 	mx.Handle("/api/spaces", negRest)
 	mx.Handle("/api/report/email", negRest)
+	mx.Handle("/api/alerts", negRest)
+	mx.Handle("/api/audit", negRest)
+	mx.Handle("/api/stream", negRest)
+	mx.Handle("/api/health", negRest)
+	mx.Handle("/api/config", negRest)
+
+	// Instances of a cluster authenticate with the shared cluster secret instead
+	mx.HandleFunc("/api/cluster", clusterHandler(formatter)).Methods("POST")
+}
+
+// authenticator sends requests carrying a bearer token to the UAA gate, signed requests to the signature gate,
+// requests with only a client certificate to the certificate gate and everything else to the key gate.
+func authenticator(auth AuthConfig) negroni.Handler {
+	keyGate := restgate.New("X-Auth-Key", "X-Auth-Secret", restgate.Hashed, restgate.Config{Context: C, Credentials: auth.Credentials, RateLimiter: auth.RateLimiter, FailureLimiter: auth.FailureLimiter, TrustedProxies: auth.TrustedProxies, HTTPSProtectionOff: !auth.RequireHTTPS})
+	if auth.TokenVerifier == nil && auth.SignatureVerifier == nil && auth.CertificateMapper == nil {
+		return negroni.HandlerFunc(func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+			keyGate.ServeHTTP(w, req, carryIdentity(next))
+		})
+	}
+
+	var tokenGate, signedGate, certGate *restgate.RESTGate
+	if auth.TokenVerifier != nil {
+		tokenGate = restgate.New("Authorization", "", restgate.UAA, restgate.Config{Context: C, TokenVerifier: auth.TokenVerifier, RateLimiter: auth.RateLimiter, FailureLimiter: auth.FailureLimiter, TrustedProxies: auth.TrustedProxies, HTTPSProtectionOff: !auth.RequireHTTPS})
+	}
+	if auth.SignatureVerifier != nil {
+		// Nonces are remembered per instance, so a captured request could be replayed once against each of the
+		// others within the skew window. Signed requests are held to HTTPS like any other.
+		signedGate = restgate.New("X-Auth-Key", "", restgate.Signed, restgate.Config{Context: C, SignatureVerifier: auth.SignatureVerifier, RateLimiter: auth.RateLimiter, FailureLimiter: auth.FailureLimiter, TrustedProxies: auth.TrustedProxies, HTTPSProtectionOff: !auth.RequireHTTPS})
+	}
+
+	if auth.CertificateMapper != nil {
+		certGate = restgate.New("", "", restgate.ClientCert, restgate.Config{Context: C, CertificateMapper: auth.CertificateMapper, RateLimiter: auth.RateLimiter, FailureLimiter: auth.FailureLimiter, TrustedProxies: auth.TrustedProxies})
+	}
+
+	return negroni.HandlerFunc(func(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		next = carryIdentity(next)
+		if certGate != nil && hasClientCertificate(req) && req.Header.Get("Authorization") == "" && req.Header.Get("X-Auth-Key") == "" {
+			certGate.ServeHTTP(w, req, next)
+		} else if tokenGate != nil && (keyGate == nil || strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ")) {
+			tokenGate.ServeHTTP(w, req, next)
+		} else if signedGate != nil && req.Header.Get(restgate.SignatureHeader) != "" {
+			signedGate.ServeHTTP(w, req, next)
+		} else if keyGate != nil {
+			keyGate.ServeHTTP(w, req, next)
+		} else if signedGate != nil {
+			signedGate.ServeHTTP(w, req, next)
+		} else {
+			certGate.ServeHTTP(w, req, next)
+		}
+	})
+}
+
+// carryIdentity passes the identity C recorded on to next in the request's own context. Routers that hand
+// their handlers a copy of the request lose what was set in the gorilla context for the original.
+func carryIdentity(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if identity, ok := context.Get(req, 0).(string); ok {
+			req = req.WithContext(stdcontext.WithValue(req.Context(), identityKey{}, identity))
+		}
+		next(w, req)
+	}
+}
+
+func hasClientCertificate(req *http.Request) bool {
+	return req.TLS != nil && len(req.TLS.VerifiedChains) > 0
 }
 
 //Optional Context - If not required, remove 'Context: C' or alternatively pass nil (see above)
 //NB: Endpoint handler can determine the key used to authenticate via: context.Get(r, 0).(string)
 func C(r *http.Request, authenticatedKey string) {
 	context.Set(r, 0, authenticatedKey) // Read http://www.gorillatoolkit.org/pkg/context about setting arbitary context key
+	if event, ok := context.Get(r, auditEventKey).(*audit.Event); ok {
+		event.Identity = authenticatedKey
+	}
 }
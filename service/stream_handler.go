@@ -0,0 +1,137 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"app-metrics-nozzle/domain"
+	"app-metrics-nozzle/filter"
+	"app-metrics-nozzle/stream"
+	"app-metrics-nozzle/usageevents"
+	"github.com/unrolled/render"
+)
+
+// StreamHeartbeat is how often an idle stream sends a comment line to keep proxies from closing it.
+var StreamHeartbeat = 15 * time.Second
+
+// streamHandler serves app updates as Server-Sent Events. Each event is an "app" event carrying the
+// app's JSON with the update ID as event ID, so EventSource reconnects resume through Last-Event-ID.
+func streamHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		w.Header().Add("Access-Control-Allow-Methods", "GET")
+
+		if usageevents.Stream == nil {
+			writeProblem(w, req, problemNotConfigured, "Streaming is not configured")
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeProblem(w, req, problemInternal, "Streaming is not supported by this server")
+			return
+		}
+
+		match, invalid := streamMatcher(req)
+		if invalid != nil {
+			writeProblem(w, req, problemInvalidParameter.With("parameter", invalid.name), invalid.detail)
+			return
+		}
+
+		lastID := req.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = req.URL.Query().Get("last_event_id")
+		}
+		resumeFrom, _ := strconv.ParseUint(lastID, 10, 64)
+
+		subscription := usageevents.Stream.Subscribe(resumeFrom, match)
+		defer subscription.Close()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+
+		if subscription.Gap {
+			// Some updates are gone; tell the client to reload /api/apps before applying what follows
+			fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+		}
+		for _, update := range subscription.Replay {
+			writeStreamUpdate(w, update)
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(StreamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case update, open := <-subscription.Updates:
+				if !open {
+					return
+				}
+				writeStreamUpdate(w, update)
+				flusher.Flush()
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+				flusher.Flush()
+			case <-req.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// streamMatcher selects the apps of a stream from the org, space, app and filter parameters,
+// limited to what the caller is granted.
+func streamMatcher(req *http.Request) (func(domain.App) bool, *invalidParameter) {
+	query := req.URL.Query()
+	org, space, name := query.Get("org"), query.Get("space"), query.Get("app")
+
+	appFilter, err := filter.Parse(query.Get("filter"))
+	if err != nil {
+		return nil, &invalidParameter{"filter", err.Error()}
+	}
+
+	grant := grantFor(req)
+	return func(app domain.App) bool {
+		if org != "" && app.Organization.Name != org {
+			return false
+		}
+		if space != "" && app.Space.Name != space {
+			return false
+		}
+		if name != "" && app.Name != name {
+			return false
+		}
+		return grant.AllowsSpace(app.Organization.Name, app.Space.Name) && appFilter.Match(app, usageevents.Now())
+	}, nil
+}
+
+func writeStreamUpdate(w http.ResponseWriter, update stream.Update) {
+	data, err := json.Marshal(update.App)
+	if err != nil {
+		logger.Println("Error encoding stream update:", err)
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: app\ndata: %s\n\n", update.ID, data)
+}
@@ -0,0 +1,89 @@
+package service_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/domain"
+	"app-metrics-nozzle/service"
+	"app-metrics-nozzle/stream"
+	"app-metrics-nozzle/usageevents"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Stream handler", func() {
+	var (
+		server      http.Handler
+		savedStream *stream.Broker
+	)
+
+	// replay requests the stream resuming after the first update, and returns once the replay is written
+	replay := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("X-Auth-Key", testKey)
+		req.Header.Set("X-Auth-Secret", testSecret)
+		req.Header.Set("Last-Event-ID", "1")
+		ctx, cancel := context.WithCancel(req.Context())
+		cancel()
+
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req.WithContext(ctx))
+		return recorder
+	}
+
+	BeforeEach(func() {
+		server = newTestServer(service.AuthConfig{})
+		savedStream = usageevents.Stream
+		usageevents.Stream = stream.NewBroker(0, 10)
+
+		now := time.Now()
+		lastEvents := map[string]time.Time{
+			"billing": time.Date(2016, 10, 19, 12, 0, 0, 0, time.UTC),
+			"catalog": time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC),
+		}
+		for _, name := range []string{"first", "billing", "catalog"} {
+			app := domain.App{GUID: name + "-guid", Name: name, LastEventTime: lastEvents[name].UnixNano()}
+			app.Organization.Name = "Pivotal"
+			app.Space.Name = "ashumilov"
+			usageevents.Stream.Publish(app, now)
+		}
+	})
+
+	AfterEach(func() {
+		usageevents.Stream = savedStream
+		usageevents.SetClock(time.Now)
+	})
+
+	It("streams every app without a filter", func() {
+		for _, path := range []string{"/api/stream", "/api/stream?filter=", "/api/stream?filter=%20%20"} {
+			response := replay(path)
+			Expect(response.Code).To(Equal(http.StatusOK))
+			Expect(response.Body.String()).To(ContainSubstring(`"billing"`))
+			Expect(response.Body.String()).To(ContainSubstring(`"catalog"`))
+		}
+	})
+
+	It("streams the apps the filter selects", func() {
+		response := replay(`/api/stream?filter=name%20==%20"billing"`)
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Body.String()).To(ContainSubstring(`"billing"`))
+		Expect(response.Body.String()).ToNot(ContainSubstring(`"catalog"`))
+	})
+
+	It("evaluates relative filters against the nozzle's clock", func() {
+		usageevents.SetClock(func() time.Time { return time.Date(2016, 10, 20, 12, 0, 0, 0, time.UTC) })
+
+		response := replay(`/api/stream?filter=last_event_time%20>%20now-30d`)
+		Expect(response.Code).To(Equal(http.StatusOK))
+		Expect(response.Body.String()).To(ContainSubstring(`"billing"`))
+		Expect(response.Body.String()).ToNot(ContainSubstring(`"catalog"`))
+	})
+
+	It("rejects an invalid filter", func() {
+		Expect(replay(`/api/stream?filter=state%20==`).Code).To(Equal(http.StatusBadRequest))
+	})
+})
@@ -0,0 +1,149 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"app-metrics-nozzle/usageevents"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/unrolled/render"
+)
+
+// TailBuffer is how many events a tail client may lag behind before further events are dropped.
+var TailBuffer = 256
+
+// TailAllowedOrigins are the origins, besides the nozzle's own, whose pages may open a tail.
+var TailAllowedOrigins []string
+
+const (
+	tailWriteTimeout = 10 * time.Second
+	tailPingInterval = 30 * time.Second
+)
+
+// tailDropped tells a tail client how many events it missed because it read too slowly.
+type tailDropped struct {
+	Type    string `json:"event_type"`
+	Dropped uint64 `json:"dropped"`
+}
+
+var tailUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	CheckOrigin:     tailOriginAllowed,
+}
+
+// tailOriginAllowed keeps foreign pages from opening a tail. Browsers present client certificates on their own,
+// so without this check any page could read an app's logs as the user.
+func tailOriginAllowed(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		// Only browsers send an origin; other clients can't be made to connect by a page
+		return true
+	}
+	for _, allowed := range TailAllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+// tailHandler upgrades to a WebSocket and sends the decorated firehose events of one app as JSON messages
+// until the client goes away.
+func tailHandler(formatter *render.Render) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		org, space, name := vars["org"], vars["space"], vars["app"]
+
+		if usageevents.Tail == nil {
+			writeProblem(w, req, problemNotConfigured, "Tailing is not configured")
+			return
+		}
+		if !grantFor(req).AllowsSpace(org, space) {
+			writeProblem(w, req, problemForbidden, fmt.Sprintf("Not authorized for space %s/%s", org, space))
+			return
+		}
+
+		app, exists := usageevents.AppDetailsSnapshot()[usageevents.GetMapKeyFromAppData(org, space, name)]
+		if !exists {
+			writeProblem(w, req, problemAppNotFound, fmt.Sprintf("No apps found under %s/%s/%s", org, space, name))
+			return
+		}
+
+		if !tailOriginAllowed(req) {
+			writeProblem(w, req, problemForbidden, fmt.Sprintf("Pages from %s may not open a tail", req.Header.Get("Origin")))
+			return
+		}
+
+		conn, err := tailUpgrader.Upgrade(w, req, nil)
+		if err != nil {
+			// Upgrade has already answered the client
+			logger.Println("Error upgrading tail connection:", err)
+			return
+		}
+		defer conn.Close()
+
+		tap := usageevents.Tail.Open(app.GUID, TailBuffer)
+		defer tap.Close()
+
+		// Clients only ever send control frames; reading is needed to process them and to notice the close
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ping := time.NewTicker(tailPingInterval)
+		defer ping.Stop()
+
+		for {
+			select {
+			case event := <-tap.Events:
+				if dropped := tap.Dropped(); dropped > 0 {
+					if err := writeTail(conn, tailDropped{"Dropped", dropped}); err != nil {
+						return
+					}
+				}
+				if err := writeTail(conn, event); err != nil {
+					return
+				}
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(tailWriteTimeout)); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}
+}
+
+func writeTail(conn *websocket.Conn, message interface{}) error {
+	conn.SetWriteDeadline(time.Now().Add(tailWriteTimeout))
+	return conn.WriteJSON(message)
+}
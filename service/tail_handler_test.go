@@ -0,0 +1,62 @@
+package service_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/service"
+	"app-metrics-nozzle/stream"
+	"app-metrics-nozzle/usageevents"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Tail handler", func() {
+	var (
+		server    http.Handler
+		savedTail *stream.Tail
+	)
+
+	// handshake starts a tail of the test app from a page at origin; an empty origin sends none.
+	handshake := func(origin string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/api/apps/Pivotal/ashumilov/tailed/tail", nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Host = "nozzle.example.com"
+		req.Header.Set("X-Auth-Key", testKey)
+		req.Header.Set("X-Auth-Secret", testSecret)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	BeforeEach(func() {
+		savedTail = usageevents.Tail
+		usageevents.Tail = stream.NewTail()
+		server = newTestServer(service.AuthConfig{})
+		addApp("tailed-guid", "Pivotal", "ashumilov", "tailed")
+	})
+
+	AfterEach(func() {
+		usageevents.Tail = savedTail
+		service.TailAllowedOrigins = nil
+	})
+
+	It("refuses pages from other origins", func() {
+		response := handshake("https://evil.example.org")
+		Expect(response.Code).To(Equal(http.StatusForbidden))
+		Expect(response.Body.String()).To(ContainSubstring("forbidden"))
+	})
+
+	It("lets through clients without an origin, the nozzle's own pages and allowed origins", func() {
+		service.TailAllowedOrigins = []string{"https://dashboard.example.com"}
+
+		// The requests aren't real WebSocket handshakes, so getting past the origin check ends in a 400
+		Expect(handshake("").Code).To(Equal(http.StatusBadRequest))
+		Expect(handshake("https://nozzle.example.com").Code).To(Equal(http.StatusBadRequest))
+		Expect(handshake("https://dashboard.example.com").Code).To(Equal(http.StatusBadRequest))
+		Expect(handshake("https://evil.example.org").Code).To(Equal(http.StatusForbidden))
+	})
+})
@@ -0,0 +1,162 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSOptions configures native HTTPS serving. CertFile and KeyFile are required; ClientCAFile enables
+// client certificate verification, and RequireClientCert turns connections without one away.
+type TLSOptions struct {
+	CertFile          string
+	KeyFile           string
+	ClientCAFile      string
+	RequireClientCert bool
+}
+
+// CertificateReloader serves the current certificate and client CAs, picking up changes to the files
+// without a restart so renewed certificates can simply be written over the old ones.
+type CertificateReloader struct {
+	options   TLSOptions
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  []time.Time
+	mutex     sync.RWMutex
+}
+
+func NewCertificateReloader(options TLSOptions) (*CertificateReloader, error) {
+	r := &CertificateReloader{options: options}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. On error the previous certificate stays in use.
+func (r *CertificateReloader) Reload() error {
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.options.CertFile, r.options.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if len(r.options.ClientCAFile) > 0 {
+		data, err := ioutil.ReadFile(r.options.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in client CA file %s", r.options.ClientCAFile)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+// Watch reloads the files whenever their modification time changes, checking every interval.
+func (r *CertificateReloader) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		modTimes, err := r.fileModTimes()
+		if err != nil {
+			logger.Println("Error checking TLS certificate files:", err)
+			continue
+		}
+
+		r.mutex.RLock()
+		changed := false
+		for idx := range modTimes {
+			changed = changed || !modTimes[idx].Equal(r.modTimes[idx])
+		}
+		r.mutex.RUnlock()
+
+		if changed {
+			if err := r.Reload(); err != nil {
+				logger.Println("Error reloading TLS certificate, keeping the current one:", err)
+			} else {
+				logger.Println("Reloaded TLS certificate from", r.options.CertFile)
+			}
+		}
+	}
+}
+
+func (r *CertificateReloader) fileModTimes() ([]time.Time, error) {
+	files := []string{r.options.CertFile, r.options.KeyFile}
+	if len(r.options.ClientCAFile) > 0 {
+		files = append(files, r.options.ClientCAFile)
+	}
+
+	modTimes := make([]time.Time, len(files))
+	for idx, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[idx] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// TLSConfig returns a server configuration that asks the reloader for the certificate and client CAs on every handshake.
+func (r *CertificateReloader) TLSConfig() *tls.Config {
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	base.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		r.mutex.RLock()
+		defer r.mutex.RUnlock()
+		return r.cert, nil
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mutex.RLock()
+		defer r.mutex.RUnlock()
+
+		config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{*r.cert}}
+		if r.clientCAs != nil {
+			config.ClientCAs = r.clientCAs
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+			if r.options.RequireClientCert {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		return config, nil
+	}
+	return base
+}
+
+// ListenAndServeTLS serves handler over HTTPS on addr using the reloader's certificates.
+func ListenAndServeTLS(addr string, handler http.Handler, reloader *CertificateReloader) error {
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: reloader.TLSConfig()}
+	logger.Println(fmt.Sprintf("listening on %s (HTTPS)", addr))
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package state keeps the app usage counted by a running nozzle in its bolt database, so it can be
+// reported on and exported later without a live firehose.
+package state
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"app-metrics-nozzle/domain"
+	"github.com/boltdb/bolt"
+)
+
+// SchemaVersion is the layout of the usage bucket written by this version.
+const SchemaVersion = 1
+
+var (
+	usageBucket = []byte("AppUsage")
+	metaBucket  = []byte("AppUsageMeta")
+
+	schemaVersionKey = []byte("schema_version")
+	savedAtKey       = []byte("saved_at")
+)
+
+// Info describes a state file.
+type Info struct {
+	SchemaVersion int       `json:"schema_version"`
+	SavedAt       time.Time `json:"saved_at"`
+	Apps          int       `json:"apps"`
+	DeletedApps   int       `json:"deleted_apps"`
+	NeverUsedApps int       `json:"never_used_apps"`
+	OldestEvent   time.Time `json:"oldest_event,omitempty"`
+	NewestEvent   time.Time `json:"newest_event,omitempty"`
+	// Records counts the keys of every bucket in the file, including those of the app cache, audit log and alerts.
+	Records map[string]int `json:"records"`
+}
+
+// Save replaces the saved usage with apps, keyed like the app details snapshots.
+func Save(db *bolt.DB, apps map[string]domain.App, now time.Time) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(usageBucket) != nil {
+			if err := tx.DeleteBucket(usageBucket); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket(usageBucket)
+		if err != nil {
+			return err
+		}
+		for key, app := range apps {
+			data, err := json.Marshal(app)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		if err := meta.Put(schemaVersionKey, []byte(strconv.Itoa(SchemaVersion))); err != nil {
+			return err
+		}
+		return meta.Put(savedAtKey, []byte(now.UTC().Format(time.RFC3339Nano)))
+	})
+}
+
+// Load returns the saved usage and when it was saved.
+func Load(db *bolt.DB) (map[string]domain.App, time.Time, error) {
+	apps := make(map[string]domain.App)
+	var savedAt time.Time
+	err := db.View(func(tx *bolt.Tx) error {
+		version, at, err := readMeta(tx)
+		if err != nil {
+			return err
+		}
+		if version > SchemaVersion {
+			return fmt.Errorf("app usage has schema version %d, this version reads up to %d", version, SchemaVersion)
+		}
+		savedAt = at
+
+		return tx.Bucket(usageBucket).ForEach(func(k, v []byte) error {
+			var app domain.App
+			if err := json.Unmarshal(v, &app); err != nil {
+				return fmt.Errorf("app usage %s: %s", k, err)
+			}
+			apps[string(k)] = app
+			return nil
+		})
+	})
+	return apps, savedAt, err
+}
+
+// Inspect describes the file without requiring saved usage in it.
+func Inspect(db *bolt.DB) (Info, error) {
+	info := Info{Records: make(map[string]int)}
+	err := db.View(func(tx *bolt.Tx) error {
+		err := tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			info.Records[string(name)] = bucket.Stats().KeyN
+			return nil
+		})
+		if err != nil || tx.Bucket(usageBucket) == nil {
+			return err
+		}
+
+		info.SchemaVersion, info.SavedAt, err = readMeta(tx)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(usageBucket).ForEach(func(k, v []byte) error {
+			var app domain.App
+			if err := json.Unmarshal(v, &app); err != nil {
+				return fmt.Errorf("app usage %s: %s", k, err)
+			}
+			info.Apps++
+			if app.DeletedAt > 0 {
+				info.DeletedApps++
+			}
+			if app.LastEventTime == 0 {
+				info.NeverUsedApps++
+				return nil
+			}
+			last := time.Unix(0, app.LastEventTime).UTC()
+			if info.OldestEvent.IsZero() || last.Before(info.OldestEvent) {
+				info.OldestEvent = last
+			}
+			if last.After(info.NewestEvent) {
+				info.NewestEvent = last
+			}
+			return nil
+		})
+	})
+	return info, err
+}
+
+func readMeta(tx *bolt.Tx) (int, time.Time, error) {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil || tx.Bucket(usageBucket) == nil {
+		return 0, time.Time{}, fmt.Errorf("no app usage saved; it is saved while the nozzle serves")
+	}
+	version, err := strconv.Atoi(string(meta.Get(schemaVersionKey)))
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid schema version: %s", err)
+	}
+	savedAt, err := time.Parse(time.RFC3339Nano, string(meta.Get(savedAtKey)))
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid save time: %s", err)
+	}
+	return version, savedAt, nil
+}
+
+// WriteCSV writes one row per app, sorted by org/space/name.
+func WriteCSV(w io.Writer, apps map[string]domain.App) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"Org", "Space", "App Name", "App GUID", "Event Count", "Server Error Count", "Last Event Time", "Deleted At", "Sources"})
+	for _, key := range sortedKeys(apps) {
+		app := apps[key]
+		out.Write([]string{
+			app.Organization.Name,
+			app.Space.Name,
+			app.Name,
+			app.GUID,
+			strconv.FormatInt(app.EventCount, 10),
+			strconv.FormatInt(app.ServerErrorCount, 10),
+			formatTime(app.LastEventTime),
+			formatTime(app.DeletedAt),
+			formatSources(app.Sources),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// WriteJSON writes the apps as an array, sorted by org/space/name.
+func WriteJSON(w io.Writer, apps map[string]domain.App) error {
+	list := make([]domain.App, 0, len(apps))
+	for _, key := range sortedKeys(apps) {
+		list = append(list, apps[key])
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(list)
+}
+
+func sortedKeys(apps map[string]domain.App) []string {
+	keys := make([]string, 0, len(apps))
+	for key := range apps {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatSources lists the log messages of each source type, e.g. "APP/PROC=30 RTR=120".
+func formatSources(sources map[string]domain.SourceUsage) string {
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%d", name, sources[name].EventCount))
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatTime(unixNano int64) string {
+	if unixNano == 0 {
+		return ""
+	}
+	return time.Unix(0, unixNano).UTC().Format(time.RFC3339)
+}
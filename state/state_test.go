@@ -0,0 +1,127 @@
+package state_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"app-metrics-nozzle/domain"
+	"app-metrics-nozzle/state"
+	"github.com/boltdb/bolt"
+)
+
+var _ = Describe("State", func() {
+	var (
+		dir  string
+		db   *bolt.DB
+		apps map[string]domain.App
+		now  time.Time
+	)
+
+	app := func(org string, name string, lastEvent time.Time, deleted bool) domain.App {
+		var a domain.App
+		a.GUID = name + "-guid"
+		a.Name = name
+		a.Organization.Name = org
+		a.Space.Name = "dev"
+		a.EventCount = 7
+		if !lastEvent.IsZero() {
+			a.LastEventTime = lastEvent.UnixNano()
+		}
+		if deleted {
+			a.DeletedAt = lastEvent.Add(time.Hour).UnixNano()
+		}
+		return a
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "state")
+		Expect(err).NotTo(HaveOccurred())
+		db, err = bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		now = time.Date(2016, 10, 19, 12, 0, 0, 0, time.UTC)
+		apps = map[string]domain.App{
+			"acme/dev/web":    app("acme", "web", now.Add(-time.Hour), false),
+			"acme/dev/worker": app("acme", "worker", time.Time{}, false),
+			"beta/dev/old":    app("beta", "old", now.Add(-48*time.Hour), true),
+		}
+	})
+
+	AfterEach(func() {
+		db.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("loads what was saved", func() {
+		Expect(state.Save(db, apps, now)).To(Succeed())
+		delete(apps, "beta/dev/old")
+		Expect(state.Save(db, apps, now.Add(time.Minute))).To(Succeed())
+
+		loaded, savedAt, err := state.Load(db)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(Equal(apps))
+		Expect(savedAt).To(Equal(now.Add(time.Minute)))
+	})
+
+	It("explains when nothing was saved", func() {
+		_, _, err := state.Load(db)
+		Expect(err).To(MatchError(ContainSubstring("no app usage saved")))
+
+		info, err := state.Inspect(db)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.SchemaVersion).To(BeZero())
+	})
+
+	It("describes the saved usage", func() {
+		Expect(state.Save(db, apps, now)).To(Succeed())
+
+		info, err := state.Inspect(db)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.SchemaVersion).To(Equal(state.SchemaVersion))
+		Expect(info.SavedAt).To(Equal(now))
+		Expect(info.Apps).To(Equal(3))
+		Expect(info.DeletedApps).To(Equal(1))
+		Expect(info.NeverUsedApps).To(Equal(1))
+		Expect(info.OldestEvent).To(Equal(now.Add(-48 * time.Hour)))
+		Expect(info.NewestEvent).To(Equal(now.Add(-time.Hour)))
+		Expect(info.Records).To(HaveKeyWithValue("AppUsage", 3))
+	})
+
+	It("refuses usage saved by a newer version", func() {
+		Expect(state.Save(db, apps, now)).To(Succeed())
+		Expect(db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("AppUsageMeta")).Put([]byte("schema_version"), []byte("99"))
+		})).To(Succeed())
+
+		_, _, err := state.Load(db)
+		Expect(err).To(MatchError(ContainSubstring("schema version 99")))
+	})
+
+	It("exports sorted CSV and JSON", func() {
+		web, worker := apps["acme/dev/web"], apps["acme/dev/worker"]
+		web.Sources = map[string]domain.SourceUsage{"RTR": {EventCount: 7, LastEventTime: web.LastEventTime}}
+		worker.Sources = map[string]domain.SourceUsage{"TASK": {EventCount: 2}, "APP/PROC": {EventCount: 12}}
+		apps["acme/dev/web"], apps["acme/dev/worker"] = web, worker
+
+		var out bytes.Buffer
+		Expect(state.WriteCSV(&out, apps)).To(Succeed())
+		Expect(out.String()).To(Equal("Org,Space,App Name,App GUID,Event Count,Server Error Count,Last Event Time,Deleted At,Sources\n" +
+			"acme,dev,web,web-guid,7,0,2016-10-19T11:00:00Z,,RTR=7\n" +
+			"acme,dev,worker,worker-guid,7,0,,,APP/PROC=12 TASK=2\n" +
+			"beta,dev,old,old-guid,7,0,2016-10-17T12:00:00Z,2016-10-17T13:00:00Z,\n"))
+
+		out.Reset()
+		Expect(state.WriteJSON(&out, apps)).To(Succeed())
+		var exported []domain.App
+		Expect(json.Unmarshal(out.Bytes(), &exported)).To(Succeed())
+		Expect(exported).To(Equal([]domain.App{apps["acme/dev/web"], apps["acme/dev/worker"], apps["beta/dev/old"]}))
+	})
+})
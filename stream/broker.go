@@ -0,0 +1,180 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package stream fans app usage updates out to live subscribers such as the /api/stream endpoint.
+package stream
+
+import (
+	"sync"
+	"time"
+
+	"app-metrics-nozzle/domain"
+)
+
+// Update is one published change of an app. IDs increase by one per update.
+type Update struct {
+	ID  uint64
+	App domain.App
+}
+
+// Subscription receives updates until it is closed. Updates is closed when the subscriber falls too far
+// behind, in which case it should reconnect and resume from the last ID it saw.
+type Subscription struct {
+	Updates <-chan Update
+	// Replay holds the backlogged updates after the requested ID, oldest first.
+	Replay []Update
+	// Gap is set when updates after the requested ID have already left the backlog.
+	Gap bool
+
+	updates chan Update
+	match   func(domain.App) bool
+	broker  *Broker
+}
+
+// Close stops delivery to the subscription.
+func (s *Subscription) Close() {
+	s.broker.unsubscribe(s)
+}
+
+// Broker publishes app updates, at most one per app per Throttle, to its subscribers and keeps the last
+// Backlog updates so reconnecting clients can resume.
+type Broker struct {
+	Throttle time.Duration
+	Backlog  int
+
+	nextID      uint64
+	backlog     []Update
+	lastSent    map[string]time.Time
+	pending     map[string]domain.App
+	subscribers map[*Subscription]bool
+	mutex       sync.Mutex
+}
+
+// subscriberBuffer is how many updates a subscriber may lag behind before it is dropped.
+const subscriberBuffer = 256
+
+func NewBroker(throttle time.Duration, backlog int) *Broker {
+	return &Broker{
+		Throttle:    throttle,
+		Backlog:     backlog,
+		nextID:      1,
+		lastSent:    make(map[string]time.Time),
+		pending:     make(map[string]domain.App),
+		subscribers: make(map[*Subscription]bool),
+	}
+}
+
+// Publish announces a change of app. Changes arriving within Throttle of the app's previous update are
+// held back, and only the latest of them is sent by Flush once the throttle has passed.
+func (b *Broker) Publish(app domain.App, now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if last, ok := b.lastSent[app.GUID]; ok && now.Sub(last) < b.Throttle {
+		b.pending[app.GUID] = app
+		return
+	}
+	b.send(app, now)
+}
+
+// Flush sends held back updates whose throttle has passed.
+func (b *Broker) Flush(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for guid, app := range b.pending {
+		if now.Sub(b.lastSent[guid]) >= b.Throttle {
+			delete(b.pending, guid)
+			b.send(app, now)
+		}
+	}
+
+	// Forget apps that have been quiet for a while so the map doesn't grow with every app ever seen
+	for guid, last := range b.lastSent {
+		if _, waiting := b.pending[guid]; !waiting && now.Sub(last) > 10*b.Throttle {
+			delete(b.lastSent, guid)
+		}
+	}
+}
+
+// Run flushes held back updates every interval.
+func (b *Broker) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		b.Flush(now)
+	}
+}
+
+func (b *Broker) send(app domain.App, now time.Time) {
+	update := Update{ID: b.nextID, App: app}
+	b.nextID++
+	b.lastSent[app.GUID] = now
+
+	b.backlog = append(b.backlog, update)
+	if len(b.backlog) > b.Backlog {
+		b.backlog = b.backlog[len(b.backlog)-b.Backlog:]
+	}
+
+	for subscription := range b.subscribers {
+		if !subscription.match(app) {
+			continue
+		}
+		select {
+		case subscription.updates <- update:
+		default:
+			// Too slow; drop it rather than block every other subscriber
+			delete(b.subscribers, subscription)
+			close(subscription.updates)
+		}
+	}
+}
+
+// Subscribe registers for updates of the apps match accepts. With a non-zero lastID the backlogged
+// updates after it are returned in Replay.
+func (b *Broker) Subscribe(lastID uint64, match func(domain.App) bool) *Subscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	updates := make(chan Update, subscriberBuffer)
+	subscription := &Subscription{Updates: updates, updates: updates, match: match, broker: b}
+
+	if lastID > 0 {
+		// IDs restart with the nozzle, so an ID from the future means the client missed everything since the restart
+		missing := lastID+1 < b.nextID && (len(b.backlog) == 0 || b.backlog[0].ID > lastID+1)
+		subscription.Gap = missing || lastID >= b.nextID
+		for _, update := range b.backlog {
+			if update.ID > lastID && match(update.App) {
+				subscription.Replay = append(subscription.Replay, update)
+			}
+		}
+	}
+
+	b.subscribers[subscription] = true
+	return subscription
+}
+
+func (b *Broker) unsubscribe(subscription *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.subscribers[subscription] {
+		delete(b.subscribers, subscription)
+		close(subscription.updates)
+	}
+}
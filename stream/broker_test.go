@@ -0,0 +1,111 @@
+package stream_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/domain"
+	"app-metrics-nozzle/stream"
+	"time"
+)
+
+var _ = Describe("Broker", func() {
+	var (
+		broker *stream.Broker
+		start  time.Time
+	)
+
+	app := func(guid string, events int64) domain.App {
+		return domain.App{GUID: guid, Name: guid, EventCount: events}
+	}
+	all := func(domain.App) bool { return true }
+
+	received := func(subscription *stream.Subscription) []stream.Update {
+		var updates []stream.Update
+		for {
+			select {
+			case update, open := <-subscription.Updates:
+				if !open {
+					return updates
+				}
+				updates = append(updates, update)
+			default:
+				return updates
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		broker = stream.NewBroker(time.Second, 3)
+		start = time.Unix(1500000000, 0)
+	})
+
+	It("throttles each app and sends the latest held back change on flush", func() {
+		subscription := broker.Subscribe(0, all)
+		broker.Publish(app("a", 1), start)
+		broker.Publish(app("a", 2), start.Add(100*time.Millisecond))
+		broker.Publish(app("a", 3), start.Add(200*time.Millisecond))
+		broker.Publish(app("b", 1), start.Add(300*time.Millisecond))
+
+		updates := received(subscription)
+		Expect(updates).To(HaveLen(2))
+		Expect(updates[0].App.GUID).To(Equal("a"))
+		Expect(updates[1].App.GUID).To(Equal("b"))
+
+		broker.Flush(start.Add(500 * time.Millisecond))
+		Expect(received(subscription)).To(BeEmpty())
+
+		broker.Flush(start.Add(time.Second))
+		updates = received(subscription)
+		Expect(updates).To(HaveLen(1))
+		Expect(updates[0].App.EventCount).To(BeNumerically("==", 3))
+		Expect(updates[0].ID).To(BeNumerically("==", 3))
+	})
+
+	It("only delivers the apps a subscription matches", func() {
+		subscription := broker.Subscribe(0, func(app domain.App) bool { return app.GUID == "b" })
+		broker.Publish(app("a", 1), start)
+		broker.Publish(app("b", 1), start)
+		updates := received(subscription)
+		Expect(updates).To(HaveLen(1))
+		Expect(updates[0].App.GUID).To(Equal("b"))
+	})
+
+	It("replays the backlog after the last seen ID and reports gaps", func() {
+		for i, guid := range []string{"a", "b", "c", "d", "e"} {
+			broker.Publish(app(guid, 1), start.Add(time.Duration(i)*time.Second))
+		}
+
+		resumed := broker.Subscribe(3, all)
+		Expect(resumed.Gap).To(BeFalse())
+		Expect(resumed.Replay).To(HaveLen(2))
+		Expect(resumed.Replay[0].ID).To(BeNumerically("==", 4))
+
+		lost := broker.Subscribe(1, all)
+		Expect(lost.Gap).To(BeTrue())
+		Expect(lost.Replay).To(HaveLen(3))
+
+		restarted := broker.Subscribe(42, all)
+		Expect(restarted.Gap).To(BeTrue())
+		Expect(restarted.Replay).To(BeEmpty())
+
+		fresh := broker.Subscribe(0, all)
+		Expect(fresh.Gap).To(BeFalse())
+		Expect(fresh.Replay).To(BeEmpty())
+	})
+
+	It("closes subscriptions when they are closed or fall too far behind", func() {
+		closed := broker.Subscribe(0, all)
+		closed.Close()
+		_, open := <-closed.Updates
+		Expect(open).To(BeFalse())
+
+		slow := broker.Subscribe(0, all)
+		for i := 0; i < 300; i++ {
+			broker.Publish(app(string(rune('A'+i%26))+string(rune('a'+i/26)), 1), start)
+		}
+		Expect(received(slow)).To(HaveLen(256))
+		_, open = <-slow.Updates
+		Expect(open).To(BeFalse())
+	})
+})
@@ -0,0 +1,100 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package stream
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Tail hands raw events of individual apps to the clients tailing them. Publishing never blocks: a tap
+// whose buffer is full loses the event and counts it as dropped.
+type Tail struct {
+	taps  map[string]map[*Tap]bool
+	mutex sync.RWMutex
+}
+
+// Tap receives the events of one app.
+type Tap struct {
+	Events <-chan interface{}
+
+	events  chan interface{}
+	dropped uint64
+	guid    string
+	tail    *Tail
+}
+
+func NewTail() *Tail {
+	return &Tail{taps: make(map[string]map[*Tap]bool)}
+}
+
+// Watching reports whether anyone is tailing the app, so callers can skip preparing events nobody reads.
+func (t *Tail) Watching(guid string) bool {
+	if t == nil {
+		return false
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return len(t.taps[guid]) > 0
+}
+
+// Publish offers an event of the app to every tap.
+func (t *Tail) Publish(guid string, event interface{}) {
+	if t == nil {
+		return
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	for tap := range t.taps[guid] {
+		select {
+		case tap.events <- event:
+		default:
+			atomic.AddUint64(&tap.dropped, 1)
+		}
+	}
+}
+
+// Open starts tailing an app with room for buffer undelivered events.
+func (t *Tail) Open(guid string, buffer int) *Tap {
+	events := make(chan interface{}, buffer)
+	tap := &Tap{Events: events, events: events, guid: guid, tail: t}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.taps[guid] == nil {
+		t.taps[guid] = make(map[*Tap]bool)
+	}
+	t.taps[guid][tap] = true
+	return tap
+}
+
+// Close stops the tap. Events may not be read after closing.
+func (tap *Tap) Close() {
+	tap.tail.mutex.Lock()
+	defer tap.tail.mutex.Unlock()
+
+	delete(tap.tail.taps[tap.guid], tap)
+	if len(tap.tail.taps[tap.guid]) == 0 {
+		delete(tap.tail.taps, tap.guid)
+	}
+}
+
+// Dropped returns and resets the number of events lost since the previous call.
+func (tap *Tap) Dropped() uint64 {
+	return atomic.SwapUint64(&tap.dropped, 0)
+}
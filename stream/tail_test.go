@@ -0,0 +1,58 @@
+package stream_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"app-metrics-nozzle/stream"
+)
+
+var _ = Describe("Tail", func() {
+	var tail *stream.Tail
+
+	BeforeEach(func() {
+		tail = stream.NewTail()
+	})
+
+	It("delivers events only to taps of the same app", func() {
+		tap := tail.Open("guid-1", 4)
+		other := tail.Open("guid-2", 4)
+
+		tail.Publish("guid-1", "event")
+
+		Expect(tap.Events).To(Receive(Equal("event")))
+		Expect(other.Events).NotTo(Receive())
+	})
+
+	It("drops events for a full tap instead of blocking", func() {
+		tap := tail.Open("guid-1", 2)
+
+		for i := 0; i < 5; i++ {
+			tail.Publish("guid-1", i)
+		}
+
+		Expect(tap.Events).To(Receive(Equal(0)))
+		Expect(tap.Events).To(Receive(Equal(1)))
+		Expect(tap.Events).NotTo(Receive())
+		Expect(tap.Dropped()).To(Equal(uint64(3)))
+		Expect(tap.Dropped()).To(BeZero())
+	})
+
+	It("knows which apps are watched", func() {
+		Expect(tail.Watching("guid-1")).To(BeFalse())
+
+		tap := tail.Open("guid-1", 1)
+		Expect(tail.Watching("guid-1")).To(BeTrue())
+
+		tap.Close()
+		Expect(tail.Watching("guid-1")).To(BeFalse())
+		tail.Publish("guid-1", "event")
+		Expect(tap.Events).NotTo(Receive())
+	})
+
+	It("ignores publishing when tailing is disabled", func() {
+		var disabled *stream.Tail
+		Expect(disabled.Watching("guid-1")).To(BeFalse())
+		disabled.Publish("guid-1", "event")
+	})
+})
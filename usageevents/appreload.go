@@ -2,13 +2,19 @@ package usageevents
 
 import (
 	"fmt"
+	"time"
 	"app-metrics-nozzle/domain"
 	"app-metrics-nozzle/api"
 	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
 )
 
+// DeletedAppRetention is how long apps that disappeared from the Cloud Controller are kept, marked as deleted,
+// before they are purged. Set by main.
+var DeletedAppRetention = 7 * 24 * time.Hour
+
 func ReloadApps(cachedApps []caching.App) {
 	logger.Println("Start filling app/space/org cache.")
+	present := make(map[string]bool, len(cachedApps))
 	for idx := range cachedApps {
 
 		org := cachedApps[idx].OrgName
@@ -18,15 +24,54 @@ func ReloadApps(cachedApps []caching.App) {
 
 		appId := cachedApps[idx].Guid
 		name := cachedApps[idx].Name
+		present[appId] = true
 
 		appDetail := domain.App{GUID:appId, Name:name}
 		api.AnnotateWithCloudControllerData(&appDetail)
 		
-		appDetail.LastEventTime = AppDetails[key].LastEventTime
+		// Usage history follows the GUID, so it survives renames and moves between spaces
+		mutex.Lock()
+		previous := AppDetails[appId]
+		appDetail.LastEventTime = previous.LastEventTime
+		appDetail.EventCount = previous.EventCount
+		appDetail.ServerErrorCount = previous.ServerErrorCount
+		appDetail.Sources = previous.Sources
 		
-		AppDetails[key] = appDetail
+		indexApp(appId, key)
+		AppDetails[appId] = appDetail
+		mutex.Unlock()
 		logger.Println(fmt.Sprintf("Registered [%s]", key))
 	}
 
+	if len(cachedApps) == 0 {
+		// An empty answer is far more likely a Cloud Controller hiccup than every app being deleted
+		logger.Println("No apps returned, skipping deleted app reconciliation")
+	} else {
+		reconcileDeletedApps(present, Now())
+	}
+
 	logger.Println(fmt.Sprintf("Done filling cache! Found [%d] Apps", len(cachedApps)))
 }
+
+// reconcileDeletedApps marks apps missing from the Cloud Controller as deleted and purges the ones
+// deleted longer than DeletedAppRetention ago.
+func reconcileDeletedApps(present map[string]bool, now time.Time) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for guid, app := range AppDetails {
+		if present[guid] {
+			continue
+		}
+
+		if app.DeletedAt == 0 {
+			app.DeletedAt = now.UnixNano()
+			AppDetails[guid] = app
+			logger.Println(fmt.Sprintf("Marked [%s] (%s) as deleted", keyOfApp[guid], guid))
+		} else if now.Sub(time.Unix(0, app.DeletedAt)) > DeletedAppRetention {
+			logger.Println(fmt.Sprintf("Purged deleted app [%s] (%s)", keyOfApp[guid], guid))
+			unindexApp(guid)
+			delete(AppDetails, guid)
+		}
+	}
+}
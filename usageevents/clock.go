@@ -0,0 +1,65 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usageevents
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+var clock atomic.Value
+
+func init() {
+	SetClock(time.Now)
+}
+
+// Now is the time of the clock events are counted against.
+func Now() time.Time {
+	return clock.Load().(func() time.Time)()
+}
+
+// SetClock replaces the wall clock events are counted against. Replaying a recording sets a clock that
+// follows the recorded envelopes, so the counts come out the same however fast they are replayed.
+func SetClock(now func() time.Time) {
+	clock.Store(now)
+}
+
+// MaxClockSkew is how far the timestamp of an event may be from Now before it is distrusted. main may
+// change it before the firehose starts.
+var MaxClockSkew = 5 * time.Minute
+
+// skewedTimestamps counts the events counted at Now because their own timestamp was too far off.
+var skewedTimestamps uint64
+
+// eventTime is when an event happened according to its timestamp. Events arrive out of order, and
+// late ones keep their time, but a component with a wrong clock must not make an app look idle for
+// hours or active in the future, so timestamps further than MaxClockSkew from now are replaced by now.
+func eventTime(event Event, now time.Time) int64 {
+	if event.Timestamp <= 0 {
+		return now.UnixNano()
+	}
+	if skew := time.Duration(event.Timestamp - now.UnixNano()); skew > MaxClockSkew || skew < -MaxClockSkew {
+		atomic.AddUint64(&skewedTimestamps, 1)
+		return now.UnixNano()
+	}
+	return event.Timestamp
+}
+
+// StartFeed marks the start of the feed that request rates are computed from.
+func StartFeed() {
+	feedStarted = Now().UnixNano()
+}
@@ -0,0 +1,119 @@
+package usageevents_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"sync/atomic"
+	"time"
+
+	. "app-metrics-nozzle/usageevents"
+	"app-metrics-nozzle/usageevents/usageeventsfakes"
+	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var _ = Describe("Event time", func() {
+	var (
+		now        time.Time
+		nowNanos   int64
+		savedCache CachedApp
+	)
+
+	// setNow moves the clock, which the resolver's goroutine reads too
+	setNow := func(t time.Time) {
+		now = t
+		atomic.StoreInt64(&nowNanos, t.UnixNano())
+	}
+
+	// rtr is a gorouter log line emitted at emitted, with the envelope stamped at stamped
+	rtr := func(guid string, emitted time.Time, stamped time.Time) *events.Envelope {
+		sourceType := "RTR"
+		message := `app.example.com - [19/10/2016:12:00:00 +0000] "GET / HTTP/1.1" 200 0 12 "-" "curl"`
+		logMessage := &events.LogMessage{AppId: &guid, SourceType: &sourceType, Message: []byte(message)}
+		if !emitted.IsZero() {
+			logMessage.Timestamp = new(int64)
+			*logMessage.Timestamp = emitted.UnixNano()
+		}
+		envelope := &events.Envelope{EventType: events.Envelope_LogMessage.Enum(), LogMessage: logMessage}
+		if !stamped.IsZero() {
+			envelope.Timestamp = new(int64)
+			*envelope.Timestamp = stamped.UnixNano()
+		}
+		return envelope
+	}
+
+	BeforeEach(func() {
+		setNow(time.Date(2016, 10, 19, 12, 0, 0, 0, time.UTC))
+		savedCache = AppDbCache
+		SetClock(func() time.Time { return time.Unix(0, atomic.LoadInt64(&nowNanos)) })
+
+		fakeCaching := new(usageeventsfakes.FakeCachedApp)
+		fakeCaching.GetAppInfoStub = func(guid string) caching.App {
+			return caching.App{Guid: guid, Name: guid, SpaceName: "dev", OrgName: "clock"}
+		}
+		AppDbCache = fakeCaching
+	})
+
+	AfterEach(func() {
+		SetClock(time.Now)
+		AppDbCache = savedCache
+	})
+
+	It("records the time the event was emitted, not when it arrived", func() {
+		ProcessEvent(rtr("time-guid-1", now.Add(-30*time.Second), time.Time{}))
+
+		app, ok := AppByGUID("time-guid-1")
+		Expect(ok).To(BeTrue())
+		Expect(app.LastEventTime).To(Equal(now.Add(-30 * time.Second).UnixNano()))
+		Expect(app.ElapsedSinceLastEvent).To(Equal(int64(30)))
+	})
+
+	It("falls back to the envelope's timestamp", func() {
+		ProcessEvent(rtr("time-guid-2", time.Time{}, now.Add(-10*time.Second)))
+
+		app, _ := AppByGUID("time-guid-2")
+		Expect(app.LastEventTime).To(Equal(now.Add(-10 * time.Second).UnixNano()))
+	})
+
+	It("counts late events without moving the last event time back", func() {
+		ProcessEvent(rtr("time-guid-3", now.Add(-5*time.Second), time.Time{}))
+		before, _ := AppByGUID("time-guid-3")
+		ProcessEvent(rtr("time-guid-3", now.Add(-time.Minute), time.Time{}))
+
+		app, _ := AppByGUID("time-guid-3")
+		Expect(app.EventCount - before.EventCount).To(Equal(int64(1)))
+		Expect(app.LastEventTime).To(Equal(now.Add(-5 * time.Second).UnixNano()))
+	})
+
+	It("computes the time since the last event when it is read", func() {
+		ProcessEvent(rtr("time-guid-4", now, time.Time{}))
+		setNow(now.Add(90 * time.Second))
+
+		app, _ := AppByGUID("time-guid-4")
+		Expect(app.ElapsedSinceLastEvent).To(Equal(int64(90)))
+		Expect(AppDetailsSnapshot()["clock/dev/time-guid-4"].ElapsedSinceLastEvent).To(Equal(int64(90)))
+	})
+
+	It("counts events with skewed timestamps at the time they arrive", func() {
+		skewedBefore := NewPipeline(PipelineOptions{}).Stats().SkewedTimestamps
+
+		ProcessEvent(rtr("time-guid-5", now.Add(3*time.Hour), time.Time{}))
+		app, _ := AppByGUID("time-guid-5")
+		Expect(app.LastEventTime).To(Equal(now.UnixNano()))
+
+		ProcessEvent(rtr("time-guid-6", now.Add(-3*time.Hour), time.Time{}))
+		app, _ = AppByGUID("time-guid-6")
+		Expect(app.LastEventTime).To(Equal(now.UnixNano()))
+
+		Expect(NewPipeline(PipelineOptions{}).Stats().SkewedTimestamps - skewedBefore).To(Equal(uint64(2)))
+	})
+
+	It("keeps timestamps within the allowed skew", func() {
+		ProcessEvent(rtr("time-guid-7", now.Add(2*time.Minute), time.Time{}))
+
+		app, _ := AppByGUID("time-guid-7")
+		Expect(app.LastEventTime).To(Equal(now.Add(2 * time.Minute).UnixNano()))
+		Expect(app.ElapsedSinceLastEvent).To(Equal(int64(0)))
+	})
+})
@@ -0,0 +1,234 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usageevents
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// kafkaProducer speaks just enough of the Kafka protocol to append batches to one partition: Produce v3
+// requests carrying v2 record batches, understood by Kafka 0.11 and later and by Kafka-compatible brokers.
+// It does not look up partition leaders, so the configured broker must lead the partition.
+type kafkaProducer struct {
+	conn          *tcpConn
+	topic         string
+	partition     int32
+	acks          int16
+	correlationID int32
+}
+
+const (
+	kafkaProduceKey     = 0
+	kafkaProduceVersion = 3
+	kafkaClientID       = "app-metrics-nozzle"
+)
+
+var kafkaCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// newKafkaProducer configures a producer from kafka://broker:9092/topic?partition=0&acks=1.
+func newKafkaProducer(sinkURL *url.URL, tlsConfig *tls.Config) (*kafkaProducer, error) {
+	producer := &kafkaProducer{
+		conn:  &tcpConn{addr: sinkURL.Host, tlsConfig: tlsConfig},
+		topic: strings.Trim(sinkURL.Path, "/"),
+		acks:  1,
+	}
+	if producer.topic == "" {
+		return nil, errors.New("missing topic")
+	}
+
+	query := sinkURL.Query()
+	if partition := query.Get("partition"); partition != "" {
+		value, err := strconv.ParseInt(partition, 10, 32)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid partition %q", partition)
+		}
+		producer.partition = int32(value)
+	}
+	if acks := query.Get("acks"); acks != "" {
+		value, err := strconv.ParseInt(acks, 10, 16)
+		if err != nil || value < -1 || value > 1 {
+			return nil, fmt.Errorf("invalid acks %q, use -1, 0 or 1", acks)
+		}
+		producer.acks = int16(value)
+	}
+	return producer, nil
+}
+
+// produce sends the batch keyed by app GUID, so each app's events stay in order, and waits for the
+// broker's acknowledgement unless acks is 0.
+func (p *kafkaProducer) produce(batch []Event) error {
+	records, err := kafkaRecordBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	p.correlationID++
+	var request bytes.Buffer
+	binary.Write(&request, binary.BigEndian, int16(kafkaProduceKey))
+	binary.Write(&request, binary.BigEndian, int16(kafkaProduceVersion))
+	binary.Write(&request, binary.BigEndian, p.correlationID)
+	kafkaString(&request, kafkaClientID)
+	binary.Write(&request, binary.BigEndian, int16(-1)) // no transactional ID
+	binary.Write(&request, binary.BigEndian, p.acks)
+	binary.Write(&request, binary.BigEndian, int32(sinkTimeout/time.Millisecond))
+	binary.Write(&request, binary.BigEndian, int32(1)) // topics
+	kafkaString(&request, p.topic)
+	binary.Write(&request, binary.BigEndian, int32(1)) // partitions
+	binary.Write(&request, binary.BigEndian, p.partition)
+	binary.Write(&request, binary.BigEndian, int32(len(records)))
+	request.Write(records)
+
+	framed := make([]byte, 4, 4+request.Len())
+	binary.BigEndian.PutUint32(framed, uint32(request.Len()))
+	if _, err := p.conn.Write(append(framed, request.Bytes()...)); err != nil {
+		return err
+	}
+	if p.acks == 0 {
+		return nil
+	}
+
+	if err := p.readResponse(); err != nil {
+		// The connection is out of step with the broker now
+		p.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// readResponse checks the Produce response for the partition's error code.
+func (p *kafkaProducer) readResponse() error {
+	conn, err := p.conn.dial()
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(sinkTimeout))
+
+	var size int32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size < 8 {
+		return fmt.Errorf("kafka response of %d bytes is too short", size)
+	}
+	response := make([]byte, size)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+
+	reader := bytes.NewReader(response)
+	var correlationID, topics, partitions, partition int32
+	var errorCode int16
+	binary.Read(reader, binary.BigEndian, &correlationID)
+	if correlationID != p.correlationID {
+		return fmt.Errorf("kafka response for request %d, expected %d", correlationID, p.correlationID)
+	}
+	binary.Read(reader, binary.BigEndian, &topics)
+	for ; topics > 0; topics-- {
+		var nameLength int16
+		binary.Read(reader, binary.BigEndian, &nameLength)
+		reader.Seek(int64(nameLength), io.SeekCurrent)
+		binary.Read(reader, binary.BigEndian, &partitions)
+		for ; partitions > 0; partitions-- {
+			binary.Read(reader, binary.BigEndian, &partition)
+			if err := binary.Read(reader, binary.BigEndian, &errorCode); err != nil {
+				return fmt.Errorf("malformed kafka response: %s", err)
+			}
+			if errorCode != 0 {
+				return fmt.Errorf("kafka error %d producing to %s/%d", errorCode, p.topic, partition)
+			}
+			reader.Seek(16, io.SeekCurrent) // base offset and log append time
+		}
+	}
+	return nil
+}
+
+func (p *kafkaProducer) Close() error {
+	return p.conn.Close()
+}
+
+// kafkaRecordBatch encodes events as an uncompressed v2 record batch with JSON values.
+func kafkaRecordBatch(batch []Event) ([]byte, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	var records bytes.Buffer
+	for i, event := range batch {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+
+		var record bytes.Buffer
+		record.WriteByte(0)     // attributes
+		kafkaVarint(&record, 0) // timestamp delta
+		kafkaVarint(&record, int64(i))
+		if event.AppID == "" {
+			kafkaVarint(&record, -1)
+		} else {
+			kafkaVarint(&record, int64(len(event.AppID)))
+			record.WriteString(event.AppID)
+		}
+		kafkaVarint(&record, int64(len(value)))
+		record.Write(value)
+		kafkaVarint(&record, 0) // headers
+
+		kafkaVarint(&records, int64(record.Len()))
+		records.Write(record.Bytes())
+	}
+
+	// Everything from attributes on is covered by the CRC
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, int16(0)) // attributes: no compression, create time
+	binary.Write(&body, binary.BigEndian, int32(len(batch)-1))
+	binary.Write(&body, binary.BigEndian, now)       // first timestamp
+	binary.Write(&body, binary.BigEndian, now)       // max timestamp
+	binary.Write(&body, binary.BigEndian, int64(-1)) // producer ID
+	binary.Write(&body, binary.BigEndian, int16(-1)) // producer epoch
+	binary.Write(&body, binary.BigEndian, int32(-1)) // base sequence
+	binary.Write(&body, binary.BigEndian, int32(len(batch)))
+	body.Write(records.Bytes())
+
+	var recordBatch bytes.Buffer
+	binary.Write(&recordBatch, binary.BigEndian, int64(0)) // base offset, assigned by the broker
+	binary.Write(&recordBatch, binary.BigEndian, int32(4+1+4+body.Len()))
+	binary.Write(&recordBatch, binary.BigEndian, int32(-1)) // partition leader epoch
+	recordBatch.WriteByte(2)                                // magic
+	binary.Write(&recordBatch, binary.BigEndian, crc32.Checksum(body.Bytes(), kafkaCRC))
+	recordBatch.Write(body.Bytes())
+	return recordBatch.Bytes(), nil
+}
+
+func kafkaString(buffer *bytes.Buffer, value string) {
+	binary.Write(buffer, binary.BigEndian, int16(len(value)))
+	buffer.WriteString(value)
+}
+
+// kafkaVarint writes the zig-zag varint used inside records.
+func kafkaVarint(buffer *bytes.Buffer, value int64) {
+	var encoded [binary.MaxVarintLen64]byte
+	buffer.Write(encoded[:binary.PutVarint(encoded[:], value)])
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usageevents
+
+import (
+	"app-metrics-nozzle/cluster"
+	"app-metrics-nozzle/domain"
+)
+
+// Peers, when set by main, holds the counts of the other nozzle instances sharing the subscription.
+// AppDetails keeps this instance's own counts; snapshots and lookups add the peers' counts to them.
+var Peers *cluster.Node
+
+// LocalCounts returns this instance's own counts by app GUID, which is what it shares with its peers.
+func LocalCounts() map[string]cluster.Counts {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	counts := make(map[string]cluster.Counts, len(AppDetails))
+	for guid, app := range AppDetails {
+		if app.EventCount > 0 || len(app.Sources) > 0 {
+			counts[guid] = cluster.Counts{EventCount: app.EventCount, ServerErrorCount: app.ServerErrorCount, LastEventTime: app.LastEventTime, Sources: app.Sources}
+		}
+	}
+	return counts
+}
+
+// withPeerCounts returns app with the counts of the other instances added.
+func withPeerCounts(app domain.App, counts cluster.Counts) domain.App {
+	app.EventCount += counts.EventCount
+	app.ServerErrorCount += counts.ServerErrorCount
+	if counts.LastEventTime > app.LastEventTime {
+		app.LastEventTime = counts.LastEventTime
+	}
+	app.Sources = domain.AddSources(app.Sources, counts.Sources)
+
+	now := Now().UnixNano()
+	if elapsedSeconds := (now - feedStarted) / 1000000000; elapsedSeconds > 0 {
+		app.RequestsPerSecond = float64(app.EventCount) / float64(elapsedSeconds)
+	}
+	return app
+}
+
+// publish announces a change of app on the stream with foundation-wide counts.
+func publish(app domain.App) {
+	if counts, ok := Peers.TotalFor(app.GUID); ok {
+		app = withPeerCounts(app, counts)
+	}
+	now := Now()
+	Stream.Publish(app.AsOf(now), now)
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usageevents
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// OverflowPolicy decides what happens to envelopes arriving while the pipeline queue is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the longest waiting envelope to make room, keeping the freshest data.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the arriving envelope.
+	DropNewest
+	// Block stops reading the firehose until there is room, at the risk of doppler dropping the nozzle
+	// as a slow consumer.
+	Block
+)
+
+var overflowPolicies = map[OverflowPolicy]string{DropOldest: "drop-oldest", DropNewest: "drop-newest", Block: "block"}
+
+func (p OverflowPolicy) String() string {
+	return overflowPolicies[p]
+}
+
+// ParseOverflowPolicy reads drop-oldest, drop-newest or block.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	for policy, policyName := range overflowPolicies {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q, use drop-oldest, drop-newest or block", name)
+}
+
+// PipelineOptions size the firehose pipeline.
+type PipelineOptions struct {
+	Workers   int
+	QueueSize int
+	Policy    OverflowPolicy
+	// Process handles each envelope, ProcessEvent unless set.
+	Process func(*events.Envelope)
+}
+
+// PipelineStats are the pipeline's counters since it started.
+type PipelineStats struct {
+	Received      uint64 `json:"received"`
+	Processed     uint64 `json:"processed"`
+	Dropped       uint64 `json:"dropped"`
+	QueueDepth    int    `json:"queue_depth"`
+	QueueCapacity int    `json:"queue_capacity"`
+	Workers       int    `json:"workers"`
+	Policy        string `json:"overflow_policy"`
+	// SkewedTimestamps counts events whose timestamp was off by more than MaxClockSkew
+	SkewedTimestamps uint64 `json:"skewed_timestamps"`
+}
+
+// Pipeline moves envelopes from the firehose to a pool of workers through bounded queues, so that slow
+// processing costs dropped envelopes instead of a stalled firehose connection. Envelopes of one app always
+// go to the same worker and are processed in order.
+type Pipeline struct {
+	options PipelineOptions
+	queues  []chan *events.Envelope
+
+	received  uint64
+	processed uint64
+	dropped   uint64
+}
+
+// FirehosePipeline, when set by main, is the pipeline reported on by the health endpoint.
+var FirehosePipeline *Pipeline
+
+func NewPipeline(options PipelineOptions) *Pipeline {
+	if options.Workers <= 0 {
+		options.Workers = 1
+	}
+	if options.Process == nil {
+		options.Process = ProcessEvent
+	}
+	if options.QueueSize < options.Workers {
+		options.QueueSize = options.Workers
+	}
+
+	pipeline := &Pipeline{options: options, queues: make([]chan *events.Envelope, options.Workers)}
+	for i := range pipeline.queues {
+		pipeline.queues[i] = make(chan *events.Envelope, options.QueueSize/options.Workers)
+	}
+	return pipeline
+}
+
+// Run feeds envelopes from in to the workers and returns once in is closed and everything queued is processed.
+func (p *Pipeline) Run(in <-chan *events.Envelope) {
+	StartFeed()
+
+	var workers sync.WaitGroup
+	for _, queue := range p.queues {
+		workers.Add(1)
+		go func(queue chan *events.Envelope) {
+			defer workers.Done()
+			for msg := range queue {
+				p.options.Process(msg)
+				atomic.AddUint64(&p.processed, 1)
+			}
+		}(queue)
+	}
+
+	done := make(chan struct{})
+	go p.reportDrops(done)
+
+	for msg := range in {
+		atomic.AddUint64(&p.received, 1)
+		p.enqueue(msg)
+	}
+
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	workers.Wait()
+	close(done)
+}
+
+func (p *Pipeline) enqueue(msg *events.Envelope) {
+	queue := p.queues[p.shard(msg)]
+
+	switch p.options.Policy {
+	case Block:
+		queue <- msg
+		return
+	case DropOldest:
+		for attempt := 0; attempt < 2; attempt++ {
+			select {
+			case queue <- msg:
+				return
+			default:
+			}
+			select {
+			case <-queue:
+				atomic.AddUint64(&p.dropped, 1)
+			default:
+			}
+		}
+	default:
+		select {
+		case queue <- msg:
+			return
+		default:
+		}
+	}
+	atomic.AddUint64(&p.dropped, 1)
+}
+
+// shard picks the worker of the envelope's app; envelopes without one are spread by type.
+func (p *Pipeline) shard(msg *events.Envelope) int {
+	if len(p.queues) == 1 {
+		return 0
+	}
+
+	var guid string
+	switch msg.GetEventType() {
+	case events.Envelope_LogMessage:
+		guid = msg.GetLogMessage().GetAppId()
+	case events.Envelope_ContainerMetric:
+		guid = msg.GetContainerMetric().GetApplicationId()
+	default:
+		guid = msg.GetEventType().String()
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(guid))
+	return int(hash.Sum32() % uint32(len(p.queues)))
+}
+
+// reportDrops logs the envelopes dropped every minute in which some were.
+func (p *Pipeline) reportDrops(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	var reported uint64
+	for {
+		select {
+		case <-ticker.C:
+			if dropped := atomic.LoadUint64(&p.dropped); dropped > reported {
+				logger.Println(fmt.Sprintf("Firehose pipeline dropped %d envelopes in the last minute, %d queued", dropped-reported, p.Stats().QueueDepth))
+				reported = dropped
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Stats returns the pipeline's counters. It is nil-safe so callers needn't check whether the firehose is up.
+func (p *Pipeline) Stats() PipelineStats {
+	if p == nil {
+		return PipelineStats{}
+	}
+
+	stats := PipelineStats{
+		Received:      atomic.LoadUint64(&p.received),
+		Processed:     atomic.LoadUint64(&p.processed),
+		Dropped:       atomic.LoadUint64(&p.dropped),
+		QueueCapacity: len(p.queues) * cap(p.queues[0]),
+		Workers:       len(p.queues),
+		Policy:        p.options.Policy.String(),
+
+		SkewedTimestamps: atomic.LoadUint64(&skewedTimestamps),
+	}
+	for _, queue := range p.queues {
+		stats.QueueDepth += len(queue)
+	}
+	return stats
+}
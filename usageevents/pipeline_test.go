@@ -0,0 +1,121 @@
+package usageevents_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/cloudfoundry/sonde-go/events"
+
+	. "app-metrics-nozzle/usageevents"
+)
+
+var _ = Describe("Pipeline", func() {
+	var (
+		in        chan *events.Envelope
+		envelopes []*events.Envelope
+		started   chan *events.Envelope
+		release   chan bool
+		processed chan *events.Envelope
+		finished  chan bool
+	)
+
+	// run starts a single worker pipeline whose worker holds every envelope until released
+	run := func(policy OverflowPolicy) *Pipeline {
+		// The goroutines outlive the spec, so they must not read variables the next BeforeEach assigns
+		in, started, release, processed, finished := in, started, release, processed, finished
+		pipeline := NewPipeline(PipelineOptions{Workers: 1, QueueSize: 2, Policy: policy, Process: func(msg *events.Envelope) {
+			started <- msg
+			<-release
+			processed <- msg
+		}})
+		go func() {
+			pipeline.Run(in)
+			close(finished)
+		}()
+		return pipeline
+	}
+
+	// fill occupies the worker with the first envelope and offers the others to the queue
+	fill := func() {
+		in <- envelopes[0]
+		Eventually(started).Should(Receive(Equal(envelopes[0])))
+		for _, msg := range envelopes[1:] {
+			in <- msg
+		}
+	}
+
+	drain := func() []*events.Envelope {
+		close(in)
+		close(release)
+		go func(started chan *events.Envelope) {
+			for range started {
+			}
+		}(started)
+		Eventually(finished).Should(BeClosed())
+		close(processed)
+
+		var all []*events.Envelope
+		for msg := range processed {
+			all = append(all, msg)
+		}
+		return all
+	}
+
+	BeforeEach(func() {
+		in = make(chan *events.Envelope)
+		envelopes = nil
+		for i := 0; i < 5; i++ {
+			envelopes = append(envelopes, &events.Envelope{})
+		}
+		started = make(chan *events.Envelope, 10)
+		release = make(chan bool)
+		processed = make(chan *events.Envelope, 10)
+		finished = make(chan bool)
+	})
+
+	It("drops the oldest queued envelopes when full", func() {
+		pipeline := run(DropOldest)
+		fill()
+
+		Eventually(func() uint64 { return pipeline.Stats().Dropped }).Should(Equal(uint64(2)))
+		stats := pipeline.Stats()
+		Expect(stats.QueueDepth).To(Equal(2))
+		Expect(stats.QueueCapacity).To(Equal(2))
+		Expect(stats.Received).To(Equal(uint64(5)))
+		Expect(stats.Policy).To(Equal("drop-oldest"))
+
+		Expect(drain()).To(Equal([]*events.Envelope{envelopes[0], envelopes[3], envelopes[4]}))
+		Expect(pipeline.Stats().Processed).To(Equal(uint64(3)))
+	})
+
+	It("drops arriving envelopes when full", func() {
+		pipeline := run(DropNewest)
+		fill()
+
+		Eventually(func() uint64 { return pipeline.Stats().Dropped }).Should(Equal(uint64(2)))
+		Expect(drain()).To(Equal([]*events.Envelope{envelopes[0], envelopes[1], envelopes[2]}))
+	})
+
+	It("stops reading when full and blocking", func() {
+		pipeline := run(Block)
+		in <- envelopes[0]
+		Eventually(started).Should(Receive())
+		// Two envelopes fill the queue and the reader holds on to the third
+		in <- envelopes[1]
+		in <- envelopes[2]
+		in <- envelopes[3]
+
+		Consistently(in).ShouldNot(BeSent(envelopes[4]))
+
+		release <- true
+		Eventually(in).Should(BeSent(envelopes[4]))
+		Expect(drain()).To(Equal(envelopes))
+		Expect(pipeline.Stats().Dropped).To(BeZero())
+	})
+
+	It("parses overflow policies", func() {
+		Expect(ParseOverflowPolicy("drop-newest")).To(Equal(DropNewest))
+		_, err := ParseOverflowPolicy("drop-everything")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,307 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usageevents
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"app-metrics-nozzle/domain"
+	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
+)
+
+// ResolverOptions tune how apps missing from the cache are looked up in the Cloud Controller.
+type ResolverOptions struct {
+	// BatchSize is the most GUIDs looked up together.
+	BatchSize int
+	// BatchWait is how long a lookup waits for more GUIDs to join its batch.
+	BatchWait time.Duration
+	// BulkThreshold is the batch size from which all apps are reloaded at once instead of one by one.
+	BulkThreshold int
+	// RetryAfter is how long an app the Cloud Controller couldn't name is left alone before asking again.
+	RetryAfter time.Duration
+	// MaxPending limits the unknown apps whose events are held back.
+	MaxPending int
+	// PendingRetention is how long events of an app that stays unknown are held before they are discarded.
+	PendingRetention time.Duration
+}
+
+// ResolverStats describe the apps waiting for a name.
+type ResolverStats struct {
+	Unresolved      int    `json:"unresolved"`
+	Queued          int    `json:"queued"`
+	Failed          int    `json:"failed"`
+	HeldEvents      int64  `json:"held_events"`
+	DiscardedEvents uint64 `json:"discarded_events"`
+}
+
+// pendingApp holds the counts of an app seen before its name is known.
+type pendingApp struct {
+	eventCount       int64
+	serverErrorCount int64
+	lastEventTime    int64
+	sources          map[string]domain.SourceUsage
+	// lastSeen is when the app last showed up, whether in a counted event or a lookup request
+	lastSeen time.Time
+	queued   bool
+	// retryAt is set while the app is negatively cached after a failed lookup
+	retryAt time.Time
+}
+
+// Resolver looks up apps missing from the cache in the background, so that a slow Cloud Controller delays
+// names instead of the firehose. Counts of an unknown app are held back and merged into AppDetails once its
+// name is known, so apps are never recorded under an empty org/space/name.
+type Resolver struct {
+	options   ResolverOptions
+	queue     chan string
+	pending   map[string]*pendingApp
+	discarded uint64
+	mutex     sync.Mutex
+	start     sync.Once
+}
+
+// AppResolver names the apps of incoming events. main may replace it before the firehose starts.
+var AppResolver = NewResolver(ResolverOptions{})
+
+func NewResolver(options ResolverOptions) *Resolver {
+	if options.BatchSize <= 0 {
+		options.BatchSize = 50
+	}
+	if options.BatchWait <= 0 {
+		options.BatchWait = time.Second
+	}
+	if options.BulkThreshold <= 0 {
+		options.BulkThreshold = 20
+	}
+	if options.RetryAfter <= 0 {
+		options.RetryAfter = 5 * time.Minute
+	}
+	if options.MaxPending <= 0 {
+		options.MaxPending = 10000
+	}
+	if options.PendingRetention <= 0 {
+		options.PendingRetention = time.Hour
+	}
+
+	return &Resolver{
+		options: options,
+		queue:   make(chan string, options.MaxPending),
+		pending: make(map[string]*pendingApp),
+	}
+}
+
+// Request asks for a lookup of guid unless one is queued or the app is negatively cached.
+func (r *Resolver) Request(guid string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry := r.pending[guid]
+	if entry == nil {
+		if len(r.pending) >= r.options.MaxPending {
+			return
+		}
+		entry = &pendingApp{}
+		r.pending[guid] = entry
+	}
+	entry.lastSeen = time.Now()
+	r.enqueue(guid, entry, entry.lastSeen)
+}
+
+// hold keeps the counts of an event from source that happened at eventTime and whose app has no name yet.
+// When too many apps are unknown already the event is discarded.
+func (r *Resolver) hold(guid string, source string, usage bool, serverErrors int64, eventTime int64, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry := r.pending[guid]
+	if entry == nil {
+		if len(r.pending) >= r.options.MaxPending {
+			r.discarded++
+			return
+		}
+		entry = &pendingApp{}
+		r.pending[guid] = entry
+	}
+	entry.sources = domain.AddSources(entry.sources, map[string]domain.SourceUsage{source: {EventCount: 1, LastEventTime: eventTime}})
+	if usage {
+		entry.eventCount++
+		entry.serverErrorCount += serverErrors
+		if eventTime > entry.lastEventTime {
+			entry.lastEventTime = eventTime
+		}
+	}
+	entry.lastSeen = now
+	r.enqueue(guid, entry, now)
+}
+
+// enqueue must be called with the mutex held.
+func (r *Resolver) enqueue(guid string, entry *pendingApp, now time.Time) {
+	r.start.Do(func() { go r.run() })
+
+	if entry.queued || now.Before(entry.retryAt) {
+		return
+	}
+	select {
+	case r.queue <- guid:
+		entry.queued = true
+	default:
+		// Asked again by the next event or the next sweep
+	}
+}
+
+func (r *Resolver) run() {
+	ticker := time.NewTicker(r.options.BatchWait)
+	defer ticker.Stop()
+
+	var batch []string
+	for {
+		select {
+		case guid := <-r.queue:
+			if batch = append(batch, guid); len(batch) >= r.options.BatchSize {
+				r.resolve(batch, time.Now())
+				batch = nil
+			}
+		case now := <-ticker.C:
+			if len(batch) > 0 {
+				r.resolve(batch, now)
+				batch = nil
+			}
+			r.sweep(now)
+		}
+	}
+}
+
+// resolve looks a batch of GUIDs up and merges the ones that got a name.
+func (r *Resolver) resolve(batch []string, now time.Time) {
+	if len(batch) >= r.options.BulkThreshold {
+		// One listing is cheaper for the Cloud Controller than many single lookups
+		AppDbCache.GetAllApp()
+	} else {
+		for _, guid := range batch {
+			AppDbCache.GetAppByGuid(guid)
+		}
+	}
+
+	for _, guid := range batch {
+		info := AppDbCache.GetAppInfo(guid)
+
+		r.mutex.Lock()
+		entry, ok := r.pending[guid]
+		if ok {
+			entry.queued = false
+			if info.Name != "" {
+				delete(r.pending, guid)
+			} else {
+				entry.retryAt = now.Add(r.options.RetryAfter)
+			}
+		}
+		r.mutex.Unlock()
+
+		if !ok {
+			continue
+		}
+		if info.Name == "" {
+			logger.Println(fmt.Sprintf("Could not resolve app %s, retrying in %s", guid, r.options.RetryAfter))
+			continue
+		}
+		mergePendingApp(guid, &info, entry)
+	}
+}
+
+// sweep retries lookups whose negative caching is over, merges apps that got their name some other way,
+// such as a Cloud Controller reload, and discards what was held too long.
+func (r *Resolver) sweep(now time.Time) {
+	r.mutex.Lock()
+	var waiting []string
+	for guid, entry := range r.pending {
+		if entry.queued {
+			continue
+		}
+		if !entry.retryAt.IsZero() && now.Sub(entry.lastSeen) > r.options.PendingRetention {
+			if entry.eventCount > 0 {
+				logger.Println(fmt.Sprintf("Discarded %d events of unresolved app %s", entry.eventCount, guid))
+			}
+			r.discarded += uint64(entry.eventCount)
+			delete(r.pending, guid)
+			continue
+		}
+		waiting = append(waiting, guid)
+	}
+	r.mutex.Unlock()
+
+	for _, guid := range waiting {
+		app, _ := AppByGUID(guid)
+
+		r.mutex.Lock()
+		entry, ok := r.pending[guid]
+		named := ok && !entry.queued && app.Name != ""
+		if named {
+			delete(r.pending, guid)
+		} else if ok {
+			r.enqueue(guid, entry, now)
+		}
+		r.mutex.Unlock()
+
+		if named {
+			mergePendingApp(guid, nil, entry)
+		}
+	}
+}
+
+// Stats returns the resolver's current backlog.
+func (r *Resolver) Stats() ResolverStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stats := ResolverStats{Unresolved: len(r.pending), DiscardedEvents: r.discarded}
+	for _, entry := range r.pending {
+		if entry.queued {
+			stats.Queued++
+		}
+		if !entry.retryAt.IsZero() {
+			stats.Failed++
+		}
+		stats.HeldEvents += entry.eventCount
+	}
+	return stats
+}
+
+// mergePendingApp adds the held counts to the app, naming it after info unless info is nil.
+func mergePendingApp(guid string, info *caching.App, entry *pendingApp) {
+	mutex.Lock()
+	appDetail := AppDetails[guid]
+	appDetail.GUID = guid
+	if info != nil {
+		indexApp(guid, GetMapKeyFromAppData(info.OrgName, info.SpaceName, info.Name))
+		appDetail.Organization.Name = info.OrgName
+		appDetail.Organization.ID = info.OrgGuid
+		appDetail.Space.Name = info.SpaceName
+		appDetail.Space.ID = info.SpaceGuid
+		appDetail.Name = info.Name
+	}
+	if entry.eventCount > 0 {
+		addEvents(&appDetail, entry.eventCount, entry.serverErrorCount, entry.lastEventTime)
+	}
+	appDetail.Sources = domain.AddSources(appDetail.Sources, entry.sources)
+	AppDetails[guid] = appDetail
+	mutex.Unlock()
+
+	if len(entry.sources) > 0 {
+		publish(appDetail)
+	}
+}
@@ -0,0 +1,148 @@
+package usageevents_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"fmt"
+	"sync"
+	"time"
+
+	"app-metrics-nozzle/domain"
+	. "app-metrics-nozzle/usageevents"
+	"app-metrics-nozzle/usageevents/usageeventsfakes"
+	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var _ = Describe("Resolver", func() {
+	var (
+		fakeCaching   *usageeventsfakes.FakeCachedApp
+		known         map[string]caching.App
+		knownMutex    sync.Mutex
+		savedCache    CachedApp
+		savedResolver *Resolver
+	)
+
+	rtr := func(guid string, status int) *events.Envelope {
+		sourceType := "RTR"
+		message := fmt.Sprintf(`app.example.com - [19/10/2016:12:00:00 +0000] "GET / HTTP/1.1" %d 0 12 "-" "curl"`, status)
+		return &events.Envelope{
+			EventType:  events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{AppId: &guid, SourceType: &sourceType, Message: []byte(message)},
+		}
+	}
+
+	// register makes the Cloud Controller know the app from now on
+	register := func(guid string, name string) {
+		knownMutex.Lock()
+		defer knownMutex.Unlock()
+		known[guid] = caching.App{Guid: guid, Name: name, SpaceName: "dev", OrgName: "acme"}
+	}
+
+	appsWithoutName := func() []string {
+		var keys []string
+		for key, app := range AppDetailsSnapshot() {
+			if app.Name == "" {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+
+	BeforeEach(func() {
+		known = make(map[string]caching.App)
+		fakeCaching = new(usageeventsfakes.FakeCachedApp)
+		fakeCaching.GetAppInfoStub = func(guid string) caching.App {
+			knownMutex.Lock()
+			defer knownMutex.Unlock()
+			return known[guid]
+		}
+
+		savedCache, savedResolver = AppDbCache, AppResolver
+		AppDbCache = fakeCaching
+		AppResolver = NewResolver(ResolverOptions{BatchSize: 2, BatchWait: 20 * time.Millisecond, BulkThreshold: 3, RetryAfter: time.Hour})
+	})
+
+	AfterEach(func() {
+		AppDbCache, AppResolver = savedCache, savedResolver
+	})
+
+	It("holds counts of a new app until its name is known and merges them", func() {
+		fakeCaching.GetAppByGuidStub = func(guid string) []caching.App {
+			register(guid, "resolved-music")
+			return nil
+		}
+
+		ProcessEvent(rtr("resolver-guid-1", 200))
+		ProcessEvent(rtr("resolver-guid-1", 502))
+		ProcessEvent(rtr("resolver-guid-1", 200))
+
+		Eventually(func() domain.App {
+			return AppDetailsSnapshot()["acme/dev/resolved-music"]
+		}).Should(And(
+			WithTransform(func(app domain.App) int64 { return app.EventCount }, Equal(int64(3))),
+			WithTransform(func(app domain.App) int64 { return app.ServerErrorCount }, Equal(int64(1))),
+			WithTransform(func(app domain.App) string { return app.GUID }, Equal("resolver-guid-1")),
+		))
+		Expect(fakeCaching.GetAppByGuidCallCount()).To(Equal(1))
+		Expect(appsWithoutName()).To(BeEmpty())
+
+		// Named now, so further events are counted straight away
+		ProcessEvent(rtr("resolver-guid-1", 200))
+		Expect(AppDetailsSnapshot()["acme/dev/resolved-music"].EventCount).To(Equal(int64(4)))
+	})
+
+	It("caches failed lookups and keeps unknown apps out of the app details", func() {
+		for i := 0; i < 5; i++ {
+			ProcessEvent(rtr("resolver-guid-2", 200))
+		}
+
+		Eventually(func() int { return AppResolver.Stats().Failed }).Should(Equal(1))
+		ProcessEvent(rtr("resolver-guid-2", 200))
+		Consistently(fakeCaching.GetAppByGuidCallCount, 100*time.Millisecond).Should(Equal(1))
+
+		stats := AppResolver.Stats()
+		Expect(stats.Unresolved).To(Equal(1))
+		Expect(stats.HeldEvents).To(Equal(int64(6)))
+		_, recorded := AppByGUID("resolver-guid-2")
+		Expect(recorded).To(BeFalse())
+		Expect(appsWithoutName()).To(BeEmpty())
+	})
+
+	It("merges held counts once the app is named some other way", func() {
+		ProcessEvent(rtr("resolver-guid-3", 200))
+		Eventually(func() int { return AppResolver.Stats().Failed }).Should(Equal(1))
+
+		// The cache learns the name without the resolver, as after a Cloud Controller reload
+		register("resolver-guid-3", "cached-music")
+		ProcessEvent(rtr("resolver-guid-3", 200))
+
+		Eventually(func() int64 {
+			return AppDetailsSnapshot()["acme/dev/cached-music"].EventCount
+		}).Should(Equal(int64(2)))
+		Expect(AppResolver.Stats().Unresolved).To(BeZero())
+	})
+
+	It("reloads all apps instead of looking up large batches one by one", func() {
+		AppResolver = NewResolver(ResolverOptions{BatchSize: 3, BatchWait: time.Hour, BulkThreshold: 3, RetryAfter: time.Hour})
+		fakeCaching.GetAllAppStub = func() []caching.App {
+			register("resolver-guid-4", "bulk-a")
+			register("resolver-guid-5", "bulk-b")
+			register("resolver-guid-6", "bulk-c")
+			return nil
+		}
+
+		ProcessEvent(rtr("resolver-guid-4", 200))
+		ProcessEvent(rtr("resolver-guid-5", 200))
+		ProcessEvent(rtr("resolver-guid-4", 200))
+		ProcessEvent(rtr("resolver-guid-6", 200))
+
+		Eventually(func() int64 {
+			return AppDetailsSnapshot()["acme/dev/bulk-c"].EventCount
+		}).Should(Equal(int64(1)))
+		Expect(AppDetailsSnapshot()["acme/dev/bulk-a"].EventCount).To(Equal(int64(2)))
+		Expect(fakeCaching.GetAllAppCallCount()).To(Equal(1))
+		Expect(fakeCaching.GetAppByGuidCallCount()).To(BeZero())
+	})
+})
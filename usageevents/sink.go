@@ -0,0 +1,326 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usageevents
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sink forwards decorated events to an external system. Send is called from the firehose loop and must
+// never block; a sink that can't keep up drops events and counts them.
+type Sink interface {
+	Send(event Event)
+	// Dropped returns the number of events lost so far, whether to a full queue or a failed delivery.
+	Dropped() uint64
+	// Close delivers what is still queued and releases the connection.
+	Close() error
+}
+
+// Sinks, when set by main, receive every decorated event.
+var Sinks []Sink
+
+// SinkOptions tune the queueing and batching shared by all sinks.
+type SinkOptions struct {
+	// Types limits the sink to events whose event_type or source_type is listed. Empty forwards everything.
+	Types         []string
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+	// TLSConfig is used by sinks whose scheme asks for TLS.
+	TLSConfig *tls.Config
+}
+
+const sinkTimeout = 10 * time.Second
+
+// NewSink creates a sink from a URL such as
+//
+//	syslog://host:514, syslog+tls://host:6514
+//	json://host:5000, json+tls://host:5000
+//	kafka://broker:9092/topic?partition=0
+//
+// A types query parameter with a comma separated list overrides options.Types.
+func NewSink(rawURL string, options SinkOptions) (Sink, error) {
+	sinkURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if sinkURL.Host == "" {
+		return nil, fmt.Errorf("sink %s: missing host", rawURL)
+	}
+	if types := sinkURL.Query().Get("types"); types != "" {
+		options.Types = strings.Split(types, ",")
+	}
+
+	name := sinkURL.Scheme + "://" + sinkURL.Host + sinkURL.Path
+	switch sinkURL.Scheme {
+	case "syslog", "syslog+tls":
+		conn := &tcpConn{addr: sinkURL.Host, tlsConfig: tlsFor(sinkURL.Scheme, options.TLSConfig)}
+		return newBatchSink(name, options, conn.writeWith(syslogBatch), conn.Close), nil
+	case "json", "json+tls":
+		conn := &tcpConn{addr: sinkURL.Host, tlsConfig: tlsFor(sinkURL.Scheme, options.TLSConfig)}
+		return newBatchSink(name, options, conn.writeWith(jsonBatch), conn.Close), nil
+	case "kafka", "kafka+tls":
+		producer, err := newKafkaProducer(sinkURL, tlsFor(sinkURL.Scheme, options.TLSConfig))
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %s", rawURL, err)
+		}
+		return newBatchSink(name, options, producer.produce, producer.Close), nil
+	}
+	return nil, fmt.Errorf("sink %s: unknown scheme %q", rawURL, sinkURL.Scheme)
+}
+
+func tlsFor(scheme string, config *tls.Config) *tls.Config {
+	if !strings.HasSuffix(scheme, "+tls") {
+		return nil
+	}
+	if config == nil {
+		return &tls.Config{}
+	}
+	return config
+}
+
+// forwardEvent hands a decorated event to the tail and the sinks. Events nobody takes are not annotated.
+func forwardEvent(event Event) {
+	if event.AppID == "" || (len(Sinks) == 0 && !Tail.Watching(event.AppID)) {
+		return
+	}
+	if event.AppName == "" {
+		event.AnnotateWithAppData()
+	}
+	Tail.Publish(event.AppID, event)
+	for _, sink := range Sinks {
+		sink.Send(event)
+	}
+}
+
+// batchSink queues events and hands them to write in batches from its own goroutine.
+type batchSink struct {
+	name    string
+	types   map[string]bool
+	queue   chan Event
+	write   func([]Event) error
+	release func() error
+
+	batchSize     int
+	flushInterval time.Duration
+
+	dropped    uint64
+	unreported uint64
+	closed     chan struct{}
+	finished   chan struct{}
+	closeOnce  sync.Once
+}
+
+func newBatchSink(name string, options SinkOptions, write func([]Event) error, release func() error) *batchSink {
+	if options.QueueSize <= 0 {
+		options.QueueSize = 10000
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 100
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = time.Second
+	}
+
+	var types map[string]bool
+	for _, eventType := range options.Types {
+		if eventType = strings.TrimSpace(eventType); eventType != "" {
+			if types == nil {
+				types = make(map[string]bool)
+			}
+			types[eventType] = true
+		}
+	}
+
+	sink := &batchSink{
+		name:          name,
+		types:         types,
+		queue:         make(chan Event, options.QueueSize),
+		write:         write,
+		release:       release,
+		batchSize:     options.BatchSize,
+		flushInterval: options.FlushInterval,
+		closed:        make(chan struct{}),
+		finished:      make(chan struct{}),
+	}
+	go sink.run()
+	return sink
+}
+
+func (s *batchSink) String() string {
+	return s.name
+}
+
+func (s *batchSink) Send(event Event) {
+	if s.types != nil && !s.types[event.Type] && !s.types[event.SourceType] {
+		return
+	}
+	select {
+	case <-s.closed:
+	case s.queue <- event:
+	default:
+		s.drop(1)
+	}
+}
+
+func (s *batchSink) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *batchSink) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	<-s.finished
+	return s.release()
+}
+
+func (s *batchSink) drop(count int) {
+	atomic.AddUint64(&s.dropped, uint64(count))
+	atomic.AddUint64(&s.unreported, uint64(count))
+}
+
+func (s *batchSink) run() {
+	defer close(s.finished)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, s.batchSize)
+	for {
+		select {
+		case event := <-s.queue:
+			if batch = append(batch, event); len(batch) >= s.batchSize {
+				batch = s.flush(batch)
+			}
+		case <-ticker.C:
+			batch = s.flush(batch)
+			if dropped := atomic.SwapUint64(&s.unreported, 0); dropped > 0 {
+				logger.Println(fmt.Sprintf("Sink %s dropped %d events", s.name, dropped))
+			}
+		case <-s.closed:
+			for {
+				select {
+				case event := <-s.queue:
+					if batch = append(batch, event); len(batch) >= s.batchSize {
+						batch = s.flush(batch)
+					}
+				default:
+					s.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *batchSink) flush(batch []Event) []Event {
+	if len(batch) == 0 {
+		return batch
+	}
+	if err := s.write(batch); err != nil {
+		logger.Println(fmt.Sprintf("Error writing %d events to sink %s: %s", len(batch), s.name, err))
+		s.drop(len(batch))
+	}
+	return batch[:0]
+}
+
+// tcpConn is a lazily dialed stream connection that is redialed once when a write fails.
+type tcpConn struct {
+	addr      string
+	tlsConfig *tls.Config
+	conn      net.Conn
+}
+
+func (c *tcpConn) dial() (net.Conn, error) {
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	dialer := &net.Dialer{Timeout: sinkTimeout}
+	if c.tlsConfig != nil {
+		conn, err := tls.DialWithDialer(dialer, "tcp", c.addr, c.tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	} else {
+		conn, err := dialer.Dial("tcp", c.addr)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	return c.conn, nil
+}
+
+func (c *tcpConn) Write(data []byte) (int, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn net.Conn
+		if conn, err = c.dial(); err != nil {
+			return 0, err
+		}
+		conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+		var written int
+		if written, err = conn.Write(data); err == nil {
+			return written, nil
+		}
+		// The peer may have closed an idle connection; a partial write is resent whole
+		c.Close()
+	}
+	return 0, err
+}
+
+// writeWith returns a batch writer sending the batch encoded by encode.
+func (c *tcpConn) writeWith(encode func([]Event) ([]byte, error)) func([]Event) error {
+	return func(batch []Event) error {
+		data, err := encode(batch)
+		if err != nil {
+			return err
+		}
+		_, err = c.Write(data)
+		return err
+	}
+}
+
+func (c *tcpConn) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// jsonBatch encodes events as newline-delimited JSON.
+func jsonBatch(batch []Event) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, event := range batch {
+		if err := encoder.Encode(event); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
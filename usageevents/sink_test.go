@@ -0,0 +1,253 @@
+package usageevents_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	. "app-metrics-nozzle/usageevents"
+)
+
+var _ = Describe("Sinks", func() {
+	var (
+		listener net.Listener
+		options  SinkOptions
+	)
+
+	rtr := Event{Type: "LogMessage", SourceType: "RTR", SourceInstance: "0", MessageType: "OUT", AppID: "guid-1",
+		AppName: "music", SpaceName: "dev", OrgName: "acme", Msg: `music.example.com - "GET / HTTP/1.1" 200 0 12`,
+		Timestamp: time.Date(2016, 10, 19, 12, 0, 0, 0, time.UTC).UnixNano()}
+	metric := Event{Type: "ContainerMetric", AppID: "guid-1", AppName: "music", SpaceName: "dev", OrgName: "acme",
+		InstanceIndex: 1, CPUPercentage: 2.5, MemBytes: 1024, DiskBytes: 2048}
+
+	// accept hands the first connection to the listener to serve
+	accept := func(serve func(net.Conn)) {
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			serve(conn)
+		}()
+	}
+
+	BeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		options = SinkOptions{BatchSize: 10, FlushInterval: 10 * time.Millisecond}
+	})
+
+	AfterEach(func() {
+		listener.Close()
+	})
+
+	It("writes newline-delimited JSON", func() {
+		lines := make(chan string, 10)
+		accept(func(conn net.Conn) {
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		})
+
+		sink, err := NewSink("json://"+listener.Addr().String(), options)
+		Expect(err).NotTo(HaveOccurred())
+		sink.Send(rtr)
+		sink.Send(metric)
+		Expect(sink.Close()).To(Succeed())
+
+		var event Event
+		Eventually(lines).Should(Receive(WithTransform(func(line string) Event {
+			json.Unmarshal([]byte(line), &event)
+			return event
+		}, Equal(rtr))))
+		Eventually(lines).Should(Receive(ContainSubstring(`"event_type":"ContainerMetric"`)))
+	})
+
+	It("only forwards the configured event types", func() {
+		lines := make(chan string, 10)
+		accept(func(conn net.Conn) {
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+		})
+
+		sink, err := NewSink("json://"+listener.Addr().String()+"?types=ContainerMetric", options)
+		Expect(err).NotTo(HaveOccurred())
+		sink.Send(rtr)
+		sink.Send(metric)
+		Expect(sink.Close()).To(Succeed())
+
+		Eventually(lines).Should(Receive(ContainSubstring(`"event_type":"ContainerMetric"`)))
+		Consistently(lines, 50*time.Millisecond).ShouldNot(Receive())
+		Expect(sink.Dropped()).To(BeZero())
+	})
+
+	It("writes octet-counted RFC 5424 syslog messages", func() {
+		messages := make(chan string, 10)
+		accept(func(conn net.Conn) {
+			reader := bufio.NewReader(conn)
+			for {
+				length, err := reader.ReadString(' ')
+				if err != nil {
+					return
+				}
+				size, _ := strconv.Atoi(strings.TrimSpace(length))
+				message := make([]byte, size)
+				if _, err := io.ReadFull(reader, message); err != nil {
+					return
+				}
+				messages <- string(message)
+			}
+		})
+
+		sink, err := NewSink("syslog://"+listener.Addr().String(), options)
+		Expect(err).NotTo(HaveOccurred())
+		sink.Send(rtr)
+		sink.Send(metric)
+		Expect(sink.Close()).To(Succeed())
+
+		Eventually(messages).Should(Receive(Equal(`<14>1 2016-10-19T12:00:00.000000Z acme.dev.music guid-1 [RTR/0] LogMessage ` +
+			`[app@47450 org="acme" space="dev" app="music"] music.example.com - "GET / HTTP/1.1" 200 0 12`)))
+		Eventually(messages).Should(Receive(And(
+			ContainSubstring(" acme.dev.music guid-1 [APP/1] ContainerMetric "),
+			HaveSuffix("cpu_percentage=2.5 mem_bytes=1024 disk_bytes=2048"),
+		)))
+	})
+
+	It("produces record batches to a Kafka broker", func() {
+		values := make(chan string, 10)
+		accept(func(conn net.Conn) {
+			for {
+				var size int32
+				if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+					return
+				}
+				request := make([]byte, size)
+				if _, err := io.ReadFull(conn, request); err != nil {
+					return
+				}
+				correlationID, topic, records := decodeProduceRequest(request)
+				for _, value := range records {
+					values <- topic + " " + value
+				}
+
+				var response bytes.Buffer
+				binary.Write(&response, binary.BigEndian, correlationID)
+				binary.Write(&response, binary.BigEndian, int32(1))
+				binary.Write(&response, binary.BigEndian, int16(len(topic)))
+				response.WriteString(topic)
+				binary.Write(&response, binary.BigEndian, int32(1))
+				binary.Write(&response, binary.BigEndian, int32(0))
+				binary.Write(&response, binary.BigEndian, int16(0))
+				binary.Write(&response, binary.BigEndian, int64(42))
+				binary.Write(&response, binary.BigEndian, int64(-1))
+				binary.Write(&response, binary.BigEndian, int32(0))
+				binary.Write(conn, binary.BigEndian, int32(response.Len()))
+				conn.Write(response.Bytes())
+			}
+		})
+
+		sink, err := NewSink("kafka://"+listener.Addr().String()+"/firehose", options)
+		Expect(err).NotTo(HaveOccurred())
+		sink.Send(rtr)
+		sink.Send(metric)
+		Expect(sink.Close()).To(Succeed())
+
+		Eventually(values).Should(Receive(HavePrefix(`firehose guid-1 {"message":"music.example.com`)))
+		Eventually(values).Should(Receive(ContainSubstring(`"event_type":"ContainerMetric"`)))
+		Expect(sink.Dropped()).To(BeZero())
+	})
+
+	It("counts events it could not deliver as dropped", func() {
+		address := listener.Addr().String()
+		listener.Close()
+
+		sink, err := NewSink("json://"+address, options)
+		Expect(err).NotTo(HaveOccurred())
+		sink.Send(rtr)
+		sink.Send(metric)
+		Expect(sink.Close()).To(Succeed())
+
+		Expect(sink.Dropped()).To(Equal(uint64(2)))
+	})
+
+	It("rejects unknown schemes and incomplete URLs", func() {
+		_, err := NewSink("carrier-pigeon://coop:1", options)
+		Expect(err).To(MatchError(ContainSubstring("unknown scheme")))
+
+		_, err = NewSink("kafka://broker:9092", options)
+		Expect(err).To(MatchError(ContainSubstring("missing topic")))
+	})
+})
+
+// decodeProduceRequest returns the correlation ID, topic and the "key value" of each record of a Produce v3 request.
+func decodeProduceRequest(request []byte) (int32, string, []string) {
+	reader := bytes.NewReader(request)
+	readString := func() string {
+		var length int16
+		binary.Read(reader, binary.BigEndian, &length)
+		if length < 0 {
+			return ""
+		}
+		value := make([]byte, length)
+		reader.Read(value)
+		return string(value)
+	}
+	readVarBytes := func() string {
+		length, _ := binary.ReadVarint(reader)
+		if length < 0 {
+			return ""
+		}
+		value := make([]byte, length)
+		reader.Read(value)
+		return string(value)
+	}
+
+	var apiKey, version, acks int16
+	var correlationID, timeout, count, partition, size int32
+	binary.Read(reader, binary.BigEndian, &apiKey)
+	binary.Read(reader, binary.BigEndian, &version)
+	Expect(apiKey).To(BeZero())
+	Expect(version).To(Equal(int16(3)))
+	binary.Read(reader, binary.BigEndian, &correlationID)
+	readString() // client ID
+	readString() // transactional ID
+	binary.Read(reader, binary.BigEndian, &acks)
+	binary.Read(reader, binary.BigEndian, &timeout)
+	binary.Read(reader, binary.BigEndian, &count)
+	topic := readString()
+	binary.Read(reader, binary.BigEndian, &count)
+	binary.Read(reader, binary.BigEndian, &partition)
+	binary.Read(reader, binary.BigEndian, &size)
+
+	// Skip the batch header up to the record count
+	reader.Seek(8+4+4+1+4+2+4+8+8+8+2+4, io.SeekCurrent)
+	binary.Read(reader, binary.BigEndian, &count)
+
+	var records []string
+	for ; count > 0; count-- {
+		binary.ReadVarint(reader) // length
+		reader.ReadByte()         // attributes
+		binary.ReadVarint(reader) // timestamp delta
+		binary.ReadVarint(reader) // offset delta
+		key := readVarBytes()
+		value := readVarBytes()
+		binary.ReadVarint(reader) // headers
+		records = append(records, key+" "+value)
+	}
+	return correlationID, topic, records
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usageevents
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Sources are the source types app usage is broken down by.
+var Sources = []string{"RTR", "APP/PROC", "TASK", "STG", "API", "CELL", "SSH"}
+
+// UsageSources are the source types whose log messages count as usage of an app: its event count, last
+// event time and request rate. Log messages of every source type show up in the app's breakdown by
+// source. main may change it before the firehose starts.
+var UsageSources = map[string]bool{"RTR": true}
+
+// SourceKind groups the source type of a log message, e.g. APP/PROC/WEB or APP/TASK/migrate, under
+// one of Sources. Source types that are none of them keep their first part.
+func SourceKind(sourceType string) string {
+	switch {
+	case sourceType == "APP" || strings.HasPrefix(sourceType, "APP/PROC"):
+		// Before processes had types, app logs were plain APP
+		return "APP/PROC"
+	case strings.HasPrefix(sourceType, "APP/TASK"):
+		return "TASK"
+	}
+	if idx := strings.Index(sourceType, "/"); idx >= 0 {
+		return sourceType[:idx]
+	}
+	return sourceType
+}
+
+// ParseUsageSources reads a comma separated list of Sources, such as RTR,APP/PROC,TASK.
+func ParseUsageSources(value string) (map[string]bool, error) {
+	usage := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		kind := SourceKind(name)
+		if !knownSource(kind) {
+			return nil, fmt.Errorf("unknown source type %q, use %s", name, strings.Join(Sources, ", "))
+		}
+		usage[kind] = true
+	}
+	if len(usage) == 0 {
+		return nil, fmt.Errorf("no source types count as usage")
+	}
+	return usage, nil
+}
+
+func knownSource(kind string) bool {
+	for _, source := range Sources {
+		if source == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package usageevents_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"time"
+
+	"app-metrics-nozzle/domain"
+	. "app-metrics-nozzle/usageevents"
+	"app-metrics-nozzle/usageevents/usageeventsfakes"
+	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+var _ = Describe("Sources", func() {
+	var (
+		savedCache  CachedApp
+		savedSource map[string]bool
+	)
+
+	logMessage := func(guid string, sourceType string, emitted time.Time) *events.Envelope {
+		message := `app.example.com - [19/10/2016:12:00:00 +0000] "GET / HTTP/1.1" 503 0 12 "-" "curl"`
+		timestamp := emitted.UnixNano()
+		return &events.Envelope{
+			EventType:  events.Envelope_LogMessage.Enum(),
+			LogMessage: &events.LogMessage{AppId: &guid, SourceType: &sourceType, Timestamp: &timestamp, Message: []byte(message)},
+		}
+	}
+
+	BeforeEach(func() {
+		savedCache, savedSource = AppDbCache, UsageSources
+		fakeCaching := new(usageeventsfakes.FakeCachedApp)
+		fakeCaching.GetAppInfoStub = func(guid string) caching.App {
+			return caching.App{Guid: guid, Name: guid, SpaceName: "dev", OrgName: "sources"}
+		}
+		AppDbCache = fakeCaching
+	})
+
+	AfterEach(func() {
+		AppDbCache, UsageSources = savedCache, savedSource
+	})
+
+	It("groups source types", func() {
+		Expect(SourceKind("RTR")).To(Equal("RTR"))
+		Expect(SourceKind("APP/PROC/WEB")).To(Equal("APP/PROC"))
+		Expect(SourceKind("APP")).To(Equal("APP/PROC"))
+		Expect(SourceKind("APP/TASK/migrate")).To(Equal("TASK"))
+		Expect(SourceKind("CELL/SSHD")).To(Equal("CELL"))
+		Expect(SourceKind("STG")).To(Equal("STG"))
+	})
+
+	It("parses the source types that count as usage", func() {
+		usage, err := ParseUsageSources("RTR, APP/PROC,APP/TASK")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage).To(Equal(map[string]bool{"RTR": true, "APP/PROC": true, "TASK": true}))
+
+		_, err = ParseUsageSources("RTR,HTTP")
+		Expect(err).To(MatchError(ContainSubstring(`unknown source type "HTTP"`)))
+		_, err = ParseUsageSources(" , ")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("breaks down every source type but only counts usage sources as usage", func() {
+		now := time.Now()
+		ProcessEvent(logMessage("sources-guid-1", "RTR", now.Add(-time.Minute)))
+		ProcessEvent(logMessage("sources-guid-1", "APP/PROC/WEB", now))
+		ProcessEvent(logMessage("sources-guid-1", "APP/PROC/WEB", now))
+
+		app, ok := AppByGUID("sources-guid-1")
+		Expect(ok).To(BeTrue())
+		Expect(app.EventCount).To(Equal(int64(1)))
+		Expect(app.ServerErrorCount).To(Equal(int64(1)))
+		Expect(app.LastEventTime).To(Equal(now.Add(-time.Minute).UnixNano()))
+		Expect(app.Sources).To(Equal(map[string]domain.SourceUsage{
+			"RTR":      {EventCount: 1, LastEventTime: now.Add(-time.Minute).UnixNano()},
+			"APP/PROC": {EventCount: 2, LastEventTime: now.UnixNano()},
+		}))
+	})
+
+	It("counts worker apps as used when their logs count as usage", func() {
+		UsageSources = map[string]bool{"RTR": true, "APP/PROC": true, "TASK": true}
+		now := time.Now()
+		ProcessEvent(logMessage("sources-guid-2", "APP/PROC/WORKER", now))
+		ProcessEvent(logMessage("sources-guid-2", "APP/TASK/nightly", now))
+		ProcessEvent(logMessage("sources-guid-2", "STG", now))
+
+		app, _ := AppByGUID("sources-guid-2")
+		Expect(app.EventCount).To(Equal(int64(2)))
+		Expect(app.ServerErrorCount).To(BeZero())
+		Expect(app.LastEventTime).To(Equal(now.UnixNano()))
+		Expect(app.Sources).To(HaveLen(3))
+	})
+
+	It("keeps snapshots taken earlier unchanged", func() {
+		ProcessEvent(logMessage("sources-guid-3", "SSH", time.Now()))
+		before, _ := AppByGUID("sources-guid-3")
+		ProcessEvent(logMessage("sources-guid-3", "API", time.Now()))
+
+		Expect(before.Sources).To(HaveLen(1))
+	})
+})
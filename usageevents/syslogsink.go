@@ -0,0 +1,126 @@
+/*
+Copyright 2016 Pivotal
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usageevents
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	syslogFacilityUser = 1
+	syslogSeverityErr  = 3
+	syslogSeverityInfo = 6
+
+	// syslogEnterpriseID names the structured data element; 47450 is the Cloud Foundry Foundation's number
+	syslogEnterpriseID = 47450
+)
+
+// syslogBatch encodes events as RFC 5424 messages with the octet-counting framing of RFC 6587, the way
+// Cloud Foundry syslog drains do: hostname org.space.app, app name the app GUID, process ID the source.
+func syslogBatch(batch []Event) ([]byte, error) {
+	var buffer bytes.Buffer
+	for _, event := range batch {
+		message := syslogMessage(event)
+		fmt.Fprintf(&buffer, "%d %s", len(message), message)
+	}
+	return buffer.Bytes(), nil
+}
+
+func syslogMessage(event Event) string {
+	severity := syslogSeverityInfo
+	if event.MessageType == "ERR" {
+		severity = syslogSeverityErr
+	}
+
+	timestamp := time.Now()
+	if event.Timestamp > 0 {
+		timestamp = time.Unix(0, event.Timestamp)
+	}
+
+	hostname := "-"
+	if event.AppName != "" {
+		hostname = syslogHeaderField(strings.Join([]string{event.OrgName, event.SpaceName, event.AppName}, "."), 255)
+	}
+
+	procID := "-"
+	if event.SourceType != "" {
+		procID = syslogHeaderField(fmt.Sprintf("[%s/%s]", event.SourceType, event.SourceInstance), 128)
+	} else if event.Type == "ContainerMetric" {
+		procID = fmt.Sprintf("[APP/%d]", event.InstanceIndex)
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s %s %s %s %s %s",
+		syslogFacilityUser*8+severity,
+		timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		hostname,
+		syslogHeaderField(event.AppID, 48),
+		procID,
+		syslogHeaderField(event.Type, 32),
+		syslogStructuredData(event),
+		syslogBody(event),
+	)
+}
+
+func syslogStructuredData(event Event) string {
+	params := []struct{ name, value string }{
+		{"org", event.OrgName},
+		{"org_id", event.OrgID},
+		{"space", event.SpaceName},
+		{"space_id", event.SpaceID},
+		{"app", event.AppName},
+		{"origin", event.Origin},
+	}
+
+	var data bytes.Buffer
+	fmt.Fprintf(&data, "[app@%d", syslogEnterpriseID)
+	for _, param := range params {
+		if param.value != "" {
+			fmt.Fprintf(&data, " %s=\"%s\"", param.name, syslogParamEscaper.Replace(param.value))
+		}
+	}
+	data.WriteString("]")
+	return data.String()
+}
+
+func syslogBody(event Event) string {
+	if event.Type == "ContainerMetric" {
+		return fmt.Sprintf("cpu_percentage=%g mem_bytes=%d disk_bytes=%d", event.CPUPercentage, event.MemBytes, event.DiskBytes)
+	}
+	return strings.TrimRight(event.Msg, "\n")
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogHeaderField makes value a valid header field: printable ASCII without spaces, at most max characters.
+func syslogHeaderField(value string, max int) string {
+	field := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+	if field == "" {
+		return "-"
+	}
+	if len(field) > max {
+		field = field[:max]
+	}
+	return field
+}
@@ -20,12 +20,14 @@ import (
 	"fmt"
 	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
 	"sync"
-	"time"
 	"github.com/cloudfoundry/sonde-go/events"
 	"app-metrics-nozzle/domain"
+	"app-metrics-nozzle/stream"
 	"os"
 	"log"
 	"github.com/cloudfoundry-community/go-cfclient"
+	"regexp"
+	"strconv"
 )
 
 // Event is a struct represented an event augmented/decorated with corresponding app/space/org data.
@@ -54,35 +56,53 @@ var mutex sync.Mutex
 
 var logger = log.New(os.Stdout, "", 0)
 
+// AppDetails holds every app seen, keyed by GUID so renamed or moved apps keep their history.
 var AppDetails = make(map[string]domain.App)
+
+// appKeys is the secondary index from org/space/name keys to the GUID currently known by that name,
+// and keyOfApp the key each GUID was last indexed under.
+var appKeys = make(map[string]string)
+var keyOfApp = make(map[string]string)
 var Orgs []cfclient.Org
 var Spaces []cfclient.Space
 var AppDbCache CachedApp
 
+// Stream, when set by main, is told about every change of an app's counters.
+var Stream *stream.Broker
+
+// Tail, when set by main, receives the decorated events of apps someone is tailing.
+var Tail *stream.Tail
+
 var feedStarted int64
 
+// rtrStatusCode matches the response status that follows the quoted request line of a gorouter access log.
+var rtrStatusCode = regexp.MustCompile(`" (\d{3}) `)
+
 func init() {
 	AppDbCache = new(AppCache)
 }
 
-// ProcessEvents churns through the firehose channel, processing incoming events.
+// ProcessEvents churns through the firehose channel, processing incoming events one at a time.
+// Use a Pipeline to process them concurrently.
 func ProcessEvents(in <-chan *events.Envelope) {
-	feedStarted = time.Now().UnixNano()
-	for msg := range in {
-		ProcessEvent(msg)
-	}
+	NewPipeline(PipelineOptions{Workers: 1, Policy: Block}).Run(in)
 }
 
 func ProcessEvent(msg *events.Envelope) {
 	eventType := msg.GetEventType()
 
 	var event Event
-	if eventType == events.Envelope_LogMessage {
+	switch eventType {
+	case events.Envelope_LogMessage:
 		event = LogMessage(msg)
-		if event.SourceType == "RTR" {
-			event.AnnotateWithAppData()
-			updateAppDetails(event)
+		event.AnnotateWithAppData()
+		if app, updated := updateAppDetails(event); updated {
+			publish(app)
 		}
+		forwardEvent(event)
+	case events.Envelope_ContainerMetric:
+		event = ContainerMetric(msg)
+		forwardEvent(event)
 	}
 }
 
@@ -91,45 +111,159 @@ func GetMapKeyFromAppData(orgName string, spaceName string, appName string) stri
 	return fmt.Sprintf("%s/%s/%s", orgName, spaceName, appName)
 }
 
-func updateAppDetails(event Event) {
+// updateAppDetails adds a log message to its app's breakdown by source, and to its usage if the source
+// is one of UsageSources.
+func updateAppDetails(event Event) (domain.App, bool) {
+	if event.AppID == "" {
+		// Without a GUID the event can't be attributed to an app reliably
+		return domain.App{}, false
+	}
+
+	source := SourceKind(event.SourceType)
+	usage := UsageSources[source]
+	var serverErrors int64
+	if source == "RTR" && statusCodeFromRTR(event.Msg) >= 500 {
+		serverErrors = 1
+	}
+
+	now := Now()
+	at := eventTime(event, now)
 
-	appName := event.AppName
-	appOrg := event.OrgName
-	appSpace := event.SpaceName
+	mutex.Lock()
+	appDetail := AppDetails[event.AppID]
+	if event.AppName == "" && appDetail.Name == "" {
+		// Recording it now would file it under an empty org/space/name; hold it until the app is resolved
+		mutex.Unlock()
+		AppResolver.hold(event.AppID, source, usage, serverErrors, at, now)
+		return domain.App{}, false
+	}
+	defer mutex.Unlock()
 
-	appKey := GetMapKeyFromAppData(appOrg, appSpace, appName)
-	appDetail := AppDetails[appKey]
-	appDetail.Organization.Name = appOrg
-	appDetail.Organization.ID = event.OrgID
-	appDetail.Space.Name = appSpace
-	appDetail.Space.ID = event.SpaceID
-	appDetail.Name = appName
 	appDetail.GUID = event.AppID
+	// The cache answers with the app's current name and space, which is how renames and moves show up here.
+	// Keep the known identity when the lookup came back empty.
+	if event.AppName != "" {
+		indexApp(event.AppID, GetMapKeyFromAppData(event.OrgName, event.SpaceName, event.AppName))
+		appDetail.Organization.Name = event.OrgName
+		appDetail.Organization.ID = event.OrgID
+		appDetail.Space.Name = event.SpaceName
+		appDetail.Space.ID = event.SpaceID
+		appDetail.Name = event.AppName
+	}
+
+	appDetail.Sources = domain.AddSources(appDetail.Sources, map[string]domain.SourceUsage{source: {EventCount: 1, LastEventTime: at}})
+	if usage {
+		addEvents(&appDetail, 1, serverErrors, at)
+	}
+	AppDetails[event.AppID] = appDetail
+
+	return appDetail, true
+}
 
-	appDetail.EventCount++
-	appDetail.LastEventTime = time.Now().UnixNano()
+// addEvents counts events of an app, the latest of them at lastEventTime, and updates its rates. An event
+// older than the app's last one is counted without moving the last event time back.
+// Must be called with mutex held.
+func addEvents(appDetail *domain.App, count int64, serverErrors int64, lastEventTime int64) {
+	appDetail.EventCount += count
+	appDetail.ServerErrorCount += serverErrors
+	if lastEventTime > appDetail.LastEventTime {
+		appDetail.LastEventTime = lastEventTime
+	}
 
-	eventElapsed := time.Now().UnixNano() - appDetail.LastEventTime
-	appDetail.ElapsedSinceLastEvent = eventElapsed / 1000000000
-	totalElapsed := time.Now().UnixNano() - feedStarted
-	elapsedSeconds := totalElapsed / 1000000000
-	appDetail.RequestsPerSecond = float64(appDetail.EventCount) / float64(elapsedSeconds)
-	appDetail.ElapsedSinceLastEvent = eventElapsed / 1000000000
-	AppDetails[appKey] = appDetail
-	//spew.Dump(AppDetails[appKey])
+	now := Now().UnixNano()
+	if elapsedSeconds := (now - feedStarted) / 1000000000; elapsedSeconds > 0 {
+		appDetail.RequestsPerSecond = float64(appDetail.EventCount) / float64(elapsedSeconds)
+	}
+}
 
-	//logger.Println("Updated with App Details " + appKey)
+// indexApp points key at guid, dropping the key the app was previously known by. Must be called with mutex held.
+func indexApp(guid string, key string) {
+	if previousKey, ok := keyOfApp[guid]; ok && previousKey != key {
+		if appKeys[previousKey] == guid {
+			delete(appKeys, previousKey)
+		}
+		logger.Println(fmt.Sprintf("App %s renamed or moved from [%s] to [%s]", guid, previousKey, key))
+	}
+	appKeys[key] = guid
+	keyOfApp[guid] = key
+}
 
+// unindexApp removes guid from the name index. Must be called with mutex held.
+func unindexApp(guid string) {
+	if key, ok := keyOfApp[guid]; ok {
+		if appKeys[key] == guid {
+			delete(appKeys, key)
+		}
+		delete(keyOfApp, guid)
+	}
 }
 
-func getAppInfo(appGUID string) caching.App {
-	if app := AppDbCache.GetAppInfo(appGUID); app.Name != "" {
-		return app
+// AppDetailsSnapshot returns the current apps keyed by org/space/name, leaving out apps deleted from the
+// Cloud Controller. It is a copy that is safe to read while events are being processed, and includes the
+// counts of the other instances when running as a cluster.
+func AppDetailsSnapshot() map[string]domain.App {
+	return appDetailsSnapshot(false)
+}
+
+// AllAppDetailsSnapshot is AppDetailsSnapshot including deleted apps that are still within their retention.
+// A deleted app whose name has since been taken by another app is keyed as org/space/name@guid.
+func AllAppDetailsSnapshot() map[string]domain.App {
+	return appDetailsSnapshot(true)
+}
+
+func appDetailsSnapshot(includeDeleted bool) map[string]domain.App {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	now := Now()
+	totals := Peers.Totals()
+	snapshot := make(map[string]domain.App, len(keyOfApp))
+	for guid, key := range keyOfApp {
+		app, ok := AppDetails[guid]
+		if !ok || (app.DeletedAt != 0 && !includeDeleted) {
+			continue
+		}
+		if appKeys[key] != guid {
+			key = fmt.Sprintf("%s@%s", key, guid)
+		}
+		if counts, ok := totals[guid]; ok {
+			app = withPeerCounts(app, counts)
+		}
+		snapshot[key] = app.AsOf(now)
+	}
+	return snapshot
+}
+
+// AppByGUID returns the details of an app by its Cloud Controller GUID.
+func AppByGUID(guid string) (domain.App, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	app, ok := AppDetails[guid]
+	if counts, found := Peers.TotalFor(guid); ok && found {
+		app = withPeerCounts(app, counts)
 	}
+	return app.AsOf(Now()), ok
+}
 
-	AppDbCache.GetAppByGuid(appGUID)
+// statusCodeFromRTR extracts the HTTP status code from a gorouter access log line, or 0 if there is none.
+func statusCodeFromRTR(msg string) int {
+	match := rtrStatusCode.FindStringSubmatch(msg)
+	if match == nil {
+		return 0
+	}
+	code, _ := strconv.Atoi(match[1])
+	return code
+}
 
-	return AppDbCache.GetAppInfo(appGUID)
+// getAppInfo answers from the cache only. Unknown apps are resolved in the background and come back
+// empty until then.
+func getAppInfo(appGUID string) caching.App {
+	app := AppDbCache.GetAppInfo(appGUID)
+	if app.Name == "" {
+		AppResolver.Request(appGUID)
+	}
+	return app
 }
 
 // LogMessage augments a raw message Envelope with log message metadata.
@@ -139,7 +273,7 @@ func LogMessage(msg *events.Envelope) Event {
 	return Event{
 		Origin:         msg.GetOrigin(),
 		AppID:          logMessage.GetAppId(),
-		Timestamp:      logMessage.GetTimestamp(),
+		Timestamp:      logMessageTime(msg),
 		SourceType:     logMessage.GetSourceType(),
 		SourceInstance: logMessage.GetSourceInstance(),
 		MessageType:    logMessage.GetMessageType().String(),
@@ -148,6 +282,30 @@ func LogMessage(msg *events.Envelope) Event {
 	}
 }
 
+// logMessageTime is when a log message was emitted, or when its envelope was if the message has no time.
+func logMessageTime(msg *events.Envelope) int64 {
+	if timestamp := msg.GetLogMessage().GetTimestamp(); timestamp > 0 {
+		return timestamp
+	}
+	return msg.GetTimestamp()
+}
+
+// ContainerMetric augments a raw message Envelope with container metric metadata.
+func ContainerMetric(msg *events.Envelope) Event {
+	containerMetric := msg.GetContainerMetric()
+
+	return Event{
+		Origin:        msg.GetOrigin(),
+		AppID:         containerMetric.GetApplicationId(),
+		Timestamp:     msg.GetTimestamp(),
+		InstanceIndex: containerMetric.GetInstanceIndex(),
+		CPUPercentage: containerMetric.GetCpuPercentage(),
+		MemBytes:      containerMetric.GetMemoryBytes(),
+		DiskBytes:     containerMetric.GetDiskBytes(),
+		Type:          msg.GetEventType().String(),
+	}
+}
+
 // AnnotateWithAppData adds application specific details to an event by looking up the GUID in the cache.
 func (e *Event) AnnotateWithAppData() {
 
@@ -10,11 +10,11 @@ import (
 	"app-metrics-nozzle/usageevents/usageeventsfakes"
 	"github.com/cloudfoundry-community/firehose-to-syslog/caching"
 	"github.com/cloudfoundry/sonde-go/events"
-	"app-metrics-nozzle/domain"
 	"io/ioutil"
 	"fmt"
 	"os"
 	"encoding/json"
+	"time"
 )
 
 var _ = Describe("usageevents", func() {
@@ -25,17 +25,21 @@ var _ = Describe("usageevents", func() {
 		space cfclient.Space
 		org cfclient.Org
 		allApps        []caching.App
-		appInstances map[string]cfclient.AppInstance
 		fakeClient *apifakes.FakeCFClientCaller
 		fakeCaching *usageeventsfakes.FakeCachedApp
 
+		savedClient api.CFClientCaller
+		savedCache CachedApp
+
+		testAppGUID string
 		testAppKey string
-		testAppKeyCC string
+		rtrAppGUID string
 	)
 
 	BeforeEach(func() {
+		testAppGUID = "bb7b3c89-0a7f-47f7-9dd3-5e4fbd8ded6c"
 		testAppKey = "Pivotal/ashumilov/cd-demo-music"
-		testAppKeyCC = "system/system/apps-manager-js"
+		rtrAppGUID = "32315c78-7a36-41f6-a3bf-d72fe40865b7"
 		loadJsonFromFile("fixtures/rtr_log_message.json", &rtrEvent)
 		loadJsonFromFile("fixtures/container_metric_log_message.json", &metricsEvent)
 
@@ -50,44 +54,155 @@ var _ = Describe("usageevents", func() {
 		loadJsonFromFile("fixtures/all_cached_apps.json", &allApps)
 		fakeCaching = new(usageeventsfakes.FakeCachedApp)
 		fakeCaching.GetAllAppReturns(allApps)
-		fakeCaching.GetAppInfoReturns(allApps[11])
+		fakeCaching.GetAppInfoStub = func(guid string) caching.App {
+			for _, app := range allApps {
+				if app.Guid == guid {
+					return app
+				}
+			}
+			return caching.App{}
+		}
 	})
 
 	Describe("Given: a Firehouse events", func() {
 		BeforeEach(func() {
-			AppDetails = make(map[string]domain.App)
-			loadJsonFromFile("fixtures/app_instances.json", &appInstances)
-			fakeClient.GetAppInstancesReturns(appInstances, nil)
+			savedClient = api.Client
+			savedCache = AppDbCache
 			api.Client = fakeClient
 			AppDbCache = fakeCaching
 
-			Expect(len(AppDetails)).To(Equal(0))
+			// The fixtures were recorded in 2016; count them against a clock of that time
+			recorded := time.Unix(0, rtrEvent.GetTimestamp())
+			SetClock(func() time.Time { return recorded })
+
 			ReloadApps(fakeCaching.GetAllApp())
 		})
+
+		AfterEach(func() {
+			SetClock(time.Now)
+			api.Client = savedClient
+			AppDbCache = savedCache
+		})
+
 		Context("When: processed Cloud Controller call", func() {
-			It("then: it should populate the appdetails objects with app info from data returned from CC", func() {
-				Expect(len(AppDetails)).To(BeNumerically(">", 0))
-				Expect(AppDetails[testAppKeyCC].InstanceCount.Configured).To(BeNumerically("==", 6))
-				Expect(AppDetails[testAppKeyCC].InstanceCount.Running).To(BeNumerically("==", 6))
-				Expect(AppDetails[testAppKeyCC].Diego).To(Equal(true))
-				Expect(len(AppDetails[testAppKeyCC].Routes)).To(Equal(3))
+			It("then: it should register every cached app by its GUID with data returned from CC", func() {
+				app, ok := AppByGUID(testAppGUID)
+				Expect(ok).To(BeTrue())
+				Expect(app.Name).To(Equal("cd-demo-music"))
+				Expect(app.Organization.Name).To(Equal(org.Name))
+				Expect(app.Space.Name).To(Equal(space.Name))
+
+				snapshot := AppDetailsSnapshot()
+				Expect(snapshot).To(HaveKey(testAppKey))
+				Expect(snapshot[testAppKey].GUID).To(Equal(testAppGUID))
+				for _, cached := range allApps {
+					_, ok := AppByGUID(cached.Guid)
+					Expect(ok).To(BeTrue())
+				}
 			})
 		})
 		Context("When: processed RTR event", func() {
-			It("then: it should populate the appdetails objects with app info from event with source type RTR", func() {
+			It("then: it should count the event for the app with source type RTR", func() {
+				before, _ := AppByGUID(rtrAppGUID)
+
 				ProcessEvent(&rtrEvent)
-				Expect(len(AppDetails)).To(BeNumerically(">", 0))
-				Expect(AppDetails[testAppKey].EventCount).To(BeNumerically("==", 1))
-				Expect(AppDetails[testAppKey].LastEventTime).ToNot(BeNil())
+
+				app, ok := AppByGUID(rtrAppGUID)
+				Expect(ok).To(BeTrue())
+				Expect(app.EventCount).To(Equal(before.EventCount + 1))
+				Expect(app.LastEventTime).To(Equal(rtrEvent.GetLogMessage().GetTimestamp()))
+				Expect(app.Sources).To(HaveKey("RTR"))
+			})
+		})
+		Context("When: an app is renamed and moved to another space", func() {
+			It("then: it should keep the app's history under its new name", func() {
+				ProcessEvent(&rtrEvent)
+				before, _ := AppByGUID(rtrAppGUID)
+				Expect(before.EventCount).To(BeNumerically(">", 0))
+
+				renamed := append([]caching.App(nil), allApps...)
+				renamed[8].Name = "apps-manager-js-renamed"
+				renamed[8].SpaceName = "moved"
+				ReloadApps(renamed)
+
+				app, ok := AppByGUID(rtrAppGUID)
+				Expect(ok).To(BeTrue())
+				Expect(app.Name).To(Equal("apps-manager-js-renamed"))
+				Expect(app.EventCount).To(Equal(before.EventCount))
+				Expect(app.LastEventTime).To(Equal(before.LastEventTime))
+
+				snapshot := AppDetailsSnapshot()
+				Expect(snapshot).To(HaveKey("system/moved/apps-manager-js-renamed"))
+				Expect(snapshot["system/moved/apps-manager-js-renamed"].GUID).To(Equal(rtrAppGUID))
+				Expect(snapshot).ToNot(HaveKey("system/system/apps-manager-js-venerable"))
+			})
+		})
+		Context("When: two apps end up with the same name", func() {
+			It("then: it should key the one that had the name first as name@guid", func() {
+				clashing := append([]caching.App(nil), allApps...)
+				clashing[12].Name = "console"
+				ReloadApps(clashing)
+
+				snapshot := AppDetailsSnapshot()
+				Expect(snapshot["system/system/console"].GUID).To(Equal(allApps[15].Guid))
+				Expect(snapshot).To(HaveKey("system/system/console@" + allApps[12].Guid))
+				Expect(snapshot["system/system/console@" + allApps[12].Guid].GUID).To(Equal(allApps[12].Guid))
+			})
+		})
+		Context("When: an app disappears from the Cloud Controller", func() {
+			It("then: it should mark the app deleted and purge it once the retention has passed", func() {
+				recorded := Now()
+				deletedGUID := allApps[0].Guid
+				known := len(AllAppDetailsSnapshot())
+				live := len(AppDetailsSnapshot())
+
+				ReloadApps(allApps[1:])
+
+				app, ok := AppByGUID(deletedGUID)
+				Expect(ok).To(BeTrue())
+				Expect(app.DeletedAt).To(Equal(recorded.UnixNano()))
+				Expect(AllAppDetailsSnapshot()).To(HaveLen(known))
+				Expect(AppDetailsSnapshot()).To(HaveLen(live - 1))
+				kept, _ := AppByGUID(allApps[1].Guid)
+				Expect(kept.DeletedAt).To(BeZero())
+
+				SetClock(func() time.Time { return recorded.Add(DeletedAppRetention - time.Hour) })
+				ReloadApps(allApps[1:])
+				app, ok = AppByGUID(deletedGUID)
+				Expect(ok).To(BeTrue())
+				Expect(app.DeletedAt).To(Equal(recorded.UnixNano()))
+
+				SetClock(func() time.Time { return recorded.Add(DeletedAppRetention + time.Hour) })
+				ReloadApps(allApps[1:])
+				_, ok = AppByGUID(deletedGUID)
+				Expect(ok).To(BeFalse())
+				_, ok = AppByGUID(allApps[1].Guid)
+				Expect(ok).To(BeTrue())
+			})
+		})
+		Context("When: the Cloud Controller returns no apps", func() {
+			It("then: it should not mark any app deleted", func() {
+				live := len(AppDetailsSnapshot())
+
+				ReloadApps(nil)
+
+				for _, cached := range allApps {
+					app, ok := AppByGUID(cached.Guid)
+					Expect(ok).To(BeTrue())
+					Expect(app.DeletedAt).To(BeZero())
+				}
+				Expect(AppDetailsSnapshot()).To(HaveLen(live))
 			})
 		})
 		Context("When: processed app metrics event", func() {
-			It("then: it should populate the appdetails objects with app info from application metrics event", func() {
+			It("then: it should not count the container metric as usage", func() {
+				before, _ := AppByGUID(rtrAppGUID)
+
 				ProcessEvent(&metricsEvent)
-				Expect(AppDetails[testAppKey].Instances[5].CellIP).ToNot(BeNil())
-				Expect(AppDetails[testAppKey].Instances[5].CPUUsage).ToNot(BeNil())
-				Expect(AppDetails[testAppKey].Instances[5].DiskUsage).ToNot(BeNil())
-				Expect(AppDetails[testAppKey].Instances[5].MemoryUsage).ToNot(BeNil())
+
+				app, _ := AppByGUID(rtrAppGUID)
+				Expect(app.EventCount).To(Equal(before.EventCount))
+				Expect(app.LastEventTime).To(Equal(before.LastEventTime))
 			})
 		})
 